@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	agentOnce   sync.Once
+	agentClient agent.ExtendedAgent
+	agentErr    error
+)
+
+// agentAuth authenticates with the keys of the local ssh-agent. The agent
+// connection is opened on first use and shared by all hosts.
+func agentAuth() (ssh.AuthMethod, error) {
+	agentOnce.Do(func() {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			agentErr = fmt.Errorf("failed to connect to ssh-agent: %w", err)
+			return
+		}
+		agentClient = agent.NewClient(conn)
+	})
+	if agentErr != nil {
+		return nil, agentErr
+	}
+	return ssh.PublicKeysCallback(agentClient.Signers), nil
+}
+
+// forwardAgent serves agent requests of the host's remote commands from the
+// local ssh-agent when the credential has forward_agent set
+func (s *SftpSender) forwardAgent(client *ssh.Client, cred *Credential) {
+	if !cred.ForwardAgent {
+		return
+	}
+	host := cred.IP
+	if cred.Name != "" {
+		host = cred.Name
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		s.warnOnce("agent "+host, "forward_agent is set for %s but SSH_AUTH_SOCK is not, no agent to forward\n", host)
+		return
+	}
+	if err := agent.ForwardToRemote(client, socket); err != nil {
+		logWarnf("failed to forward ssh-agent to %s: %v\n", host, err)
+	}
+}
+
+// requestAgent asks the host to expose the forwarded agent to a command session
+func (s *SftpSender) requestAgent(session *ssh.Session, host string) {
+	cred, err := s.findCredential(host)
+	if err != nil || !cred.ForwardAgent || os.Getenv("SSH_AUTH_SOCK") == "" {
+		return
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		s.warnOnce("agent-refused "+host, "%s refused agent forwarding (AllowAgentForwarding in sshd_config?): %v\n", host, err)
+	}
+}
+
+// warnOnce logs a warning the first time key is seen
+func (s *SftpSender) warnOnce(key, format string, args ...interface{}) {
+	if _, warned := s.warned.LoadOrStore(key, true); !warned {
+		logWarnf(format, args...)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// useExecBackend reports whether the selected --backend can handle a directory
+// transfer. rsync must be installed on both ends, tar only on the remote host.
+// remoteCheck is an extra remote command that must succeed, e.g. a directory test.
+func (s *SftpSender) useExecBackend(client *ssh.Client, host, remoteCheck string) bool {
+	if s.backend == "sftp" {
+		return false
+	}
+	if s.sync && s.backend == "tar" {
+		s.warnOnce("sync tar", "--sync compares files over SFTP, not using the tar backend\n")
+		return false
+	}
+	if s.backend == "rsync" {
+		if _, err := exec.LookPath("rsync"); err != nil {
+			s.hostLog(host).Warnf("rsync not found locally, using SFTP\n")
+			return false
+		}
+	}
+	if err := remoteRun(client, "command -v "+s.backend+" >/dev/null"); err != nil {
+		s.hostLog(host).Warnf("%s not found on %s, using SFTP\n", s.backend, host)
+		return false
+	}
+	if remoteCheck != "" && remoteRun(client, remoteCheck) != nil {
+		return false
+	}
+	return true
+}
+
+// uploadExec uploads a directory with the selected exec backend
+func (s *SftpSender) uploadExec(client *ssh.Client, host, localPath, remotePath string) error {
+	if s.backend == "rsync" {
+		return s.uploadRsync(client, host, localPath, remotePath)
+	}
+	return s.uploadTar(client, host, localPath, remotePath)
+}
+
+// downloadExec downloads a directory with the selected exec backend
+func (s *SftpSender) downloadExec(client *ssh.Client, host, remotePath, localPath string) error {
+	if s.backend == "rsync" {
+		return s.downloadRsync(client, host, remotePath, localPath)
+	}
+	return s.downloadTar(client, host, remotePath, localPath)
+}
+
+// remoteRun runs a command on the remote host without showing its output
+func remoteRun(client *ssh.Client, command string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run(command)
+}
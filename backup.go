@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+)
+
+// snapshotLayout names backup snapshot directories; it sorts chronologically
+// and contains no characters Windows rejects in file names
+const snapshotLayout = "2006-01-02T150405"
+
+// runBackup implements the "backup" subcommand: it mirrors a remote directory
+// of each host into a new dated local snapshot, once or every --every
+func runBackup(args []string) error {
+	fs := pflag.NewFlagSet("backup", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to back up")
+	group := fs.String("group", "", "Back up every host of this group")
+	remote := fs.String("remote", "", "Remote directory to back up (required)")
+	dest := fs.String("dest", "backups", "Local directory holding one snapshot directory per host and run")
+	keep := fs.Int("keep", 7, "Number of snapshots to keep per host, older ones are deleted (0 = keep all)")
+	every := fs.Duration("every", 0, "Take a snapshot at this interval until interrupted, e.g. 6h (0 = once)")
+	hardlink := fs.Bool("hardlink", false, "Hard link files unchanged since the previous snapshot instead of downloading them again")
+	parallel := fs.Int("parallel", 1, "Number of hosts to back up at the same time")
+	fs.SetNormalizeFunc(threadsAlias)
+	threads := fs.Int("threads", 4, "Number of files per host to download concurrently")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if *remote == "" {
+		return fmt.Errorf("usage: sftpsender backup (--ip hosts | --group name) --remote DIR [--dest DIR] [--keep N] [--every 6h]")
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	s.historyPath = defaultHistoryPath
+	s.auditPath = s.config.AuditLog
+	s.threads = *threads
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	for {
+		report, err := s.startRun("backup")
+		if err != nil {
+			return err
+		}
+		report.Hosts = hosts
+		started := report.StartedAt
+
+		var mu sync.Mutex
+		s.forEachHost(hosts, *parallel, func(i int) {
+			err := s.backupHost(hosts[i], *remote, *dest, *keep, *hardlink, started)
+			if err != nil {
+				mu.Lock()
+				report.Errors = append(report.Errors, fmt.Sprintf("Failed to back up %s: %v", hosts[i], err))
+				mu.Unlock()
+				s.hostLog(hosts[i]).Errorf("%s: backup failed: %v\n", hosts[i], err)
+				s.hostFailed(hosts[i], err)
+			}
+		})
+		s.finishRun(report)
+
+		if *every <= 0 {
+			if len(report.Errors) > 0 {
+				return fmt.Errorf("backup failed on %d of %d hosts", len(report.Errors), len(hosts))
+			}
+			return nil
+		}
+		next := started.Add(*every)
+		logInfof("Next backup at %s\n", next.Format("2006-01-02 15:04:05"))
+		for time.Now().Before(next) && !s.interrupted() {
+			time.Sleep(time.Second)
+		}
+		if s.interrupted() {
+			return nil
+		}
+	}
+}
+
+// backupHost takes one snapshot of remoteDir on host and prunes old snapshots.
+// The snapshot is written to a hidden directory and only renamed to its final
+// dated name once complete, so an interrupted backup never counts as one.
+func (s *SftpSender) backupHost(host, remoteDir, dest string, keep int, hardlink bool, started time.Time) error {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	hostDir := filepath.Join(dest, safeFileName(host))
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	snapshots, err := listSnapshots(hostDir)
+	if err != nil {
+		return err
+	}
+	var previous string
+	if hardlink && len(snapshots) > 0 {
+		previous = filepath.Join(hostDir, snapshots[len(snapshots)-1])
+	}
+
+	name := started.Format(snapshotLayout)
+	partial := filepath.Join(hostDir, "."+name+".partial")
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sftpClient, err := s.getSFTPClient(client, s.tuneLink(client, host))
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	s.hostLog(host).Infof("Backing up %s:%s to %s\n", host, remoteDir, filepath.Join(hostDir, name))
+	downloaded, linked, err := s.snapshot(sftpClient, host, remoteDir, partial, previous)
+	if err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	if err := os.Rename(partial, filepath.Join(hostDir, name)); err != nil {
+		return fmt.Errorf("failed to finish snapshot: %w", err)
+	}
+	if linked > 0 {
+		s.hostLog(host).Infof("%s: %d files downloaded, %d unchanged files linked to the previous snapshot\n", host, downloaded, linked)
+	} else {
+		s.hostLog(host).Infof("%s: %d files downloaded\n", host, downloaded)
+	}
+	return pruneSnapshots(hostDir, keep)
+}
+
+// snapshot downloads remoteDir into target. Files with the same size and
+// modification time as in the previous snapshot are hard linked from it.
+func (s *SftpSender) snapshot(sftpClient *sftp.Client, host, remoteDir, target, previous string) (int, int, error) {
+	if info, err := sftpClient.Stat(remoteDir); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat remote directory: %w", err)
+	} else if !info.IsDir() {
+		return 0, 0, fmt.Errorf("%s is not a directory", remoteDir)
+	}
+
+	var downloaded, linked atomic.Int32
+	pool := newTransferPool(s.threads)
+	walker := sftpClient.Walk(remoteDir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			pool.wait()
+			return 0, 0, err
+		}
+		rel, err := filepath.Rel(remoteDir, walker.Path())
+		if err != nil {
+			pool.wait()
+			return 0, 0, err
+		}
+		local := filepath.Join(target, rel)
+		info := walker.Stat()
+
+		if info.IsDir() {
+			if err := os.MkdirAll(local, 0755); err != nil {
+				pool.wait()
+				return 0, 0, err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if previous != "" {
+			old, err := os.Stat(filepath.Join(previous, rel))
+			if err == nil && old.Size() == info.Size() && old.ModTime().Equal(info.ModTime()) {
+				if err := os.Link(filepath.Join(previous, rel), local); err == nil {
+					linked.Add(1)
+					continue
+				}
+			}
+		}
+
+		remotePath := walker.Path()
+		err = pool.submit(func() error {
+			if err := s.downloadFileSFTP(sftpClient, host, remotePath, local); err != nil {
+				return err
+			}
+			downloaded.Add(1)
+			// Keeping the remote time lets the next snapshot recognize unchanged files
+			return os.Chtimes(local, info.ModTime(), info.ModTime())
+		})
+		if err != nil {
+			break
+		}
+	}
+	err := pool.wait()
+	return int(downloaded.Load()), int(linked.Load()), err
+}
+
+// listSnapshots returns the names of the finished snapshots in hostDir, oldest first
+func listSnapshots(hostDir string) ([]string, error) {
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := time.Parse(snapshotLayout, e.Name()); err == nil && e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// pruneSnapshots deletes the oldest snapshots of hostDir beyond keep
+func pruneSnapshots(hostDir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	names, err := listSnapshots(hostDir)
+	if err != nil {
+		return err
+	}
+	for len(names) > keep {
+		logInfof("Removing old snapshot %s\n", filepath.Join(hostDir, names[0]))
+		if err := os.RemoveAll(filepath.Join(hostDir, names[0])); err != nil {
+			return fmt.Errorf("failed to remove old snapshot: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
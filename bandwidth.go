@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BandwidthRule limits transfers to Limit bytes per second during a daily
+// time window, e.g. hours "09:00-18:00", limit "1M", days "mon-fri"
+type BandwidthRule struct {
+	Hours string `yaml:"hours"` // local time; a window may cross midnight, e.g. 22:00-06:00
+	Days  string `yaml:"days"`  // optional, e.g. mon-fri or sat,sun; empty means every day
+	Limit string `yaml:"limit"`
+
+	start, end int // minutes since midnight
+	days       [7]bool
+	rate       int64
+}
+
+// bandwidthSchedule is the parsed bandwidth_schedule of the config; the first
+// rule whose window contains the current time applies
+type bandwidthSchedule []BandwidthRule
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseBandwidthSchedule validates the rules and fills in their parsed fields
+func parseBandwidthSchedule(rules []BandwidthRule) (bandwidthSchedule, error) {
+	for i := range rules {
+		r := &rules[i]
+		from, to, ok := strings.Cut(r.Hours, "-")
+		if !ok {
+			return nil, fmt.Errorf("rule %d: hours must be HH:MM-HH:MM, got %q", i+1, r.Hours)
+		}
+		var err error
+		if r.start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if r.end, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rate, err := parseSize(r.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid limit: %w", i+1, err)
+		}
+		r.rate = int64(rate)
+		if r.days, err = parseDays(r.Days); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseDays parses a comma-separated list of days and day ranges such as mon-fri
+func parseDays(v string) ([7]bool, error) {
+	var days [7]bool
+	if strings.TrimSpace(v) == "" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	day := func(name string) (int, error) {
+		for i, d := range weekdays {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(name)), d) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid day %q", name)
+	}
+	for _, part := range strings.Split(v, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := day(from)
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if isRange {
+			if last, err = day(to); err != nil {
+				return days, err
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// rate returns the limit in bytes per second at t, 0 when unlimited
+func (sched bandwidthSchedule) rate(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range sched {
+		day := int(t.Weekday())
+		var inside bool
+		if r.start <= r.end {
+			inside = minute >= r.start && minute < r.end
+		} else {
+			// The window crosses midnight; after midnight it belongs to the previous day
+			inside = minute >= r.start
+			if minute < r.end {
+				inside, day = true, (day+6)%7
+			}
+		}
+		if inside && r.days[day] {
+			return r.rate
+		}
+	}
+	return 0
+}
+
+// bandwidthLimit is the current rate limit of the run: the lower of the
+// bandwidth_schedule window and --limit-rate, 0 when unlimited
+func (s *SftpSender) bandwidthLimit() int64 {
+	rate := s.schedule.rate(time.Now())
+	if s.limitRate > 0 && (rate == 0 || s.limitRate < rate) {
+		rate = s.limitRate
+	}
+	return rate
+}
+
+// hostLimiter returns the limiter shared by all connections to the host of
+// cred, which enforces its max_rate
+func (s *SftpSender) hostLimiter(cred *Credential) *rateLimiter {
+	rate := cred.maxRate
+	l, _ := s.hostLimiters.LoadOrStore(cred.Username+"@"+cred.IP, &rateLimiter{rate: func() int64 { return rate }})
+	return l.(*rateLimiter)
+}
+
+// rateLimiter is a token bucket shared by all connections of a run. Its rate
+// is looked up for every transfer so a schedule takes effect mid-transfer.
+type rateLimiter struct {
+	rate func() int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// wait blocks until n more bytes may be transferred
+func (l *rateLimiter) wait(n int) {
+	rate := l.rate()
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		// Up to one second of unused allowance may be spent as a burst
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(rate), float64(rate))
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedConn passes the bytes read and written through the rate limiter
+type limitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limiter.wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.limiter.wait(len(p))
+	return c.Conn.Write(p)
+}
@@ -23,3 +23,8 @@ func PrintBanner() {
 `
 	fmt.Printf("%s\n%50s\n\n", banner, "Current sftpsender version "+version)
 }
+
+// Version returns the version of this build
+func Version() string {
+	return version
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// batchOp is one line of a batch file: VERB ARG HOSTS [DIR] or exec HOSTS COMMAND
+type batchOp struct {
+	line    int
+	verb    string
+	path    string // local path for upload and sync, remote path for download
+	hosts   string // comma-separated names or IPs, or @group
+	dir     string // destination directory
+	command string // command of exec
+}
+
+// batchResult is the outcome of one batch line for the summary
+type batchResult struct {
+	op       batchOp
+	hosts    int
+	failed   []string
+	duration time.Duration
+	err      error // set when the line could not be run at all
+}
+
+// runBatch implements the "batch" subcommand: it runs the operations of a
+// batch file in order, keeping one connection per host open for all of them
+func runBatch(args []string) error {
+	fs := pflag.NewFlagSet("batch", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	parallel := fs.Int("parallel", 16, "Number of hosts of a line handled at the same time")
+	fs.SetNormalizeFunc(threadsAlias)
+	threads := fs.Int("threads", 4, "Number of files per host transferred concurrently")
+	retries := fs.Int("retries", 0, "Retry transfers failing with transient errors this many times")
+	stopOnError := fs.Bool("stop-on-error", false, "Stop at the first line that fails on any host instead of running the rest")
+	readOnly := fs.Bool("read-only", false, "Refuse the lines that would write or delete on a host, only running downloads")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sftpsender batch [--parallel N] [--stop-on-error] commands.txt")
+	}
+
+	ops, err := parseBatchFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	s.historyPath = defaultHistoryPath
+	s.auditPath = s.config.AuditLog
+	s.threads = *threads
+	s.retries = *retries
+	s.readOnly = *readOnly
+	s.backend = "sftp"
+	s.conns = &connPool{}
+	defer s.conns.closeAll()
+
+	report, err := s.startRun("batch")
+	if err != nil {
+		return err
+	}
+	var results []batchResult
+	for _, op := range ops {
+		if s.interrupted() {
+			report.Errors = append(report.Errors, fmt.Sprintf("line %d not started: %v", op.line, ErrInterrupted))
+			break
+		}
+		logGroupStart(fmt.Sprintf("Line %d: %s", op.line, op.verb))
+		logInfof("\n=== Line %d: %s ===\n", op.line, op.describe())
+		r := s.runBatchOp(op, *parallel)
+		logGroupEnd()
+		results = append(results, r)
+
+		if r.err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("line %d: %v", op.line, r.err))
+		}
+		for _, host := range r.failed {
+			report.Errors = append(report.Errors, fmt.Sprintf("line %d failed on %s", op.line, host))
+			if !slices.Contains(report.Hosts, host) {
+				report.Hosts = append(report.Hosts, host)
+			}
+		}
+		if *stopOnError && (r.err != nil || len(r.failed) > 0) {
+			break
+		}
+	}
+	s.finishRun(report)
+
+	logInfof("\n=== Batch Summary ===\n")
+	failedLines := 0
+	for _, r := range results {
+		status := fmt.Sprintf("%d/%d hosts ok", r.hosts-len(r.failed), r.hosts)
+		switch {
+		case r.err != nil:
+			status = r.err.Error()
+		case len(r.failed) > 0:
+			status += ", failed: " + strings.Join(r.failed, ", ")
+		}
+		if r.err != nil || len(r.failed) > 0 {
+			failedLines++
+		}
+		logInfof("line %-4d %-8s %-10s %s\n", r.op.line, r.op.verb, r.duration.Round(time.Millisecond), status)
+	}
+	if skipped := len(ops) - len(results); skipped > 0 {
+		logInfof("%d lines not run\n", skipped)
+	}
+	s.logTrippedHosts()
+	if failedLines > 0 || len(results) < len(ops) {
+		return fmt.Errorf("%d of %d lines failed", failedLines+len(ops)-len(results), len(ops))
+	}
+	logInfof("All %d lines completed successfully!\n", len(ops))
+	return nil
+}
+
+// parseBatchFile reads the operations of a batch file. Blank lines and lines
+// starting with # are ignored.
+func parseBatchFile(path string) ([]batchOp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch file: %v", err)
+	}
+	defer f.Close()
+
+	var ops []batchOp
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		op, err := parseBatchLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		op.line = n
+		ops = append(ops, op)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read batch file: %v", err)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("%s contains no operations", path)
+	}
+	return ops, nil
+}
+
+func parseBatchLine(line string) (batchOp, error) {
+	fields := strings.Fields(line)
+	op := batchOp{verb: fields[0]}
+	switch op.verb {
+	case "upload", "download", "sync":
+		if len(fields) < 3 || len(fields) > 4 {
+			return op, fmt.Errorf("usage: %s PATH HOSTS [DIR]", op.verb)
+		}
+		op.path, op.hosts = fields[1], fields[2]
+		if len(fields) == 4 {
+			op.dir = fields[3]
+		}
+	case "exec":
+		if len(fields) < 3 {
+			return op, fmt.Errorf("usage: exec HOSTS COMMAND")
+		}
+		op.hosts = fields[1]
+		// The command keeps its original spacing and quoting
+		rest := strings.TrimSpace(strings.TrimPrefix(line, "exec"))
+		op.command = strings.TrimSpace(strings.TrimPrefix(rest, op.hosts))
+	default:
+		return op, fmt.Errorf("unknown operation %q (upload, download, sync or exec)", op.verb)
+	}
+	return op, nil
+}
+
+func (op batchOp) describe() string {
+	if op.verb == "exec" {
+		return fmt.Sprintf("exec on %s: %s", op.hosts, op.command)
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s %s", op.verb, op.path, op.hosts, op.dir))
+}
+
+// runBatchOp runs one batch line on each of its hosts
+func (s *SftpSender) runBatchOp(op batchOp, parallel int) batchResult {
+	started := time.Now()
+	result := batchResult{op: op}
+	ips, group := op.hosts, ""
+	if strings.HasPrefix(ips, "@") {
+		ips, group = "", ips[1:]
+	}
+	hosts, err := s.selectHosts(ips, group)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.hosts = len(hosts)
+
+	// sync mirrors a directory with rsync, removing what the source no longer has
+	if op.verb == "sync" {
+		s.backend, s.rsyncDelete = "rsync", true
+		defer func() { s.backend, s.rsyncDelete = "sftp", false }()
+	}
+
+	width := 0
+	for _, h := range hosts {
+		width = max(width, len(h))
+	}
+	color := useColor()
+
+	// Every line is tagged with its host, even with --parallel 1
+	defer s.tagHosts(hosts)()
+	var mu sync.Mutex
+	s.forEachHost(hosts, parallel, func(i int) {
+		host := hosts[i]
+		prefix := hostPrefix(host, width, color)
+		var err error
+		switch op.verb {
+		case "upload", "sync":
+			err = s.uploadHost(op.path, host, op.dir)
+		case "download":
+			location := op.dir
+			if location == "" && len(hosts) > 1 {
+				location = "{host}"
+			}
+			err = s.downloadHost(op.path, host, expandLocation(location, host, i+1, started))
+		case "exec":
+			stdout := &prefixWriter{prefix: prefix, out: os.Stdout, mu: &mu}
+			stderr := &prefixWriter{prefix: prefix, out: os.Stderr, mu: &mu}
+			err = s.guarded(host, func() error { return s.execCommand(host, op.command, stdout, stderr) })
+			stdout.flush()
+			stderr.flush()
+		}
+		if err != nil {
+			mu.Lock()
+			result.failed = append(result.failed, host)
+			s.hostLog(host).Errorf("%v\n", err)
+			mu.Unlock()
+			s.hostFailed(host, err)
+		}
+	})
+	result.duration = time.Since(started)
+	return result
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// braceExpand expands shell-style braces the way bash does, so quoted
+// arguments and shells without brace expansion (cmd.exe, PowerShell) work the
+// same: "f{a,b}" gives fa fb, "chunk{1..3}" gives chunk1 chunk2 chunk3, and
+// ranges accept a step ({0..10..5}), zero padding ({01..10}) and letters
+// ({a..e}). Braces without a comma or range are kept as they are.
+func braceExpand(s string) []string {
+	open, close, ok := findBraces(s)
+	if !ok {
+		return []string{s}
+	}
+	prefix, body, suffix := s[:open], s[open+1:close], s[close+1:]
+
+	alternatives, ok := braceRange(body)
+	if !ok {
+		alternatives = splitBraceBody(body)
+	}
+	if len(alternatives) < 2 && !ok {
+		// Not an expression, keep the braces and expand what follows them
+		var out []string
+		for _, rest := range braceExpand(suffix) {
+			out = append(out, prefix+"{"+body+"}"+rest)
+		}
+		return out
+	}
+
+	var out []string
+	for _, alt := range alternatives {
+		out = append(out, braceExpand(prefix+alt+suffix)...)
+	}
+	return out
+}
+
+// findBraces returns the positions of the first top-level brace pair
+// globExpand expands the wildcards (*, ? and [...]) of local paths for the
+// same reason. Like bash, a pattern that matches nothing is kept as it is.
+func globExpand(paths []string) []string {
+	var out []string
+	for _, p := range paths {
+		matches, err := filepath.Glob(p)
+		if err != nil || len(matches) == 0 {
+			out = append(out, p)
+			continue
+		}
+		out = append(out, matches...)
+	}
+	return out
+}
+
+func findBraces(s string) (int, int, bool) {
+	open, depth := -1, 0
+	for i, c := range s {
+		switch c {
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				return open, i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// splitBraceBody splits the inside of a brace pair at its top-level commas
+func splitBraceBody(body string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range body {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, body[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, body[start:])
+}
+
+// braceRange expands a {first..last[..step]} sequence of integers or letters
+func braceRange(body string) ([]string, bool) {
+	parts := strings.Split(body, "..")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, false
+	}
+	step := 1
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil || n == 0 {
+			return nil, false
+		}
+		step = max(n, -n)
+	}
+
+	var out []string
+	if first, err1 := strconv.Atoi(parts[0]); err1 == nil {
+		last, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, false
+		}
+		width := 0
+		if zeroPadded(parts[0]) || zeroPadded(parts[1]) {
+			width = max(len(parts[0]), len(parts[1]))
+		}
+		for _, n := range steps(first, last, step) {
+			out = append(out, fmt.Sprintf("%0*d", width, n))
+		}
+		return out, true
+	}
+
+	if len(parts[0]) != 1 || len(parts[1]) != 1 || !isLetter(parts[0][0]) || !isLetter(parts[1][0]) {
+		return nil, false
+	}
+	for _, n := range steps(int(parts[0][0]), int(parts[1][0]), step) {
+		out = append(out, string(rune(n)))
+	}
+	return out, true
+}
+
+func steps(first, last, step int) []int {
+	var out []int
+	if first <= last {
+		for n := first; n <= last; n += step {
+			out = append(out, n)
+		}
+	} else {
+		for n := first; n >= last; n -= step {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func zeroPadded(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return len(s) > 1 && s[0] == '0'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
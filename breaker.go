@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hostBreaker counts the consecutive failures of one host. Once the count
+// reaches the threshold the breaker opens and the host gets no further work
+// until the cool-down has passed.
+type hostBreaker struct {
+	failures  int
+	openUntil time.Time
+	tripped   bool // opened at least once during this run
+}
+
+// guarded runs one operation on host through its circuit breaker: an open
+// breaker fails the operation right away, the outcome updates the breaker
+func (s *SftpSender) guarded(host string, op func() error) error {
+	if err := s.breakerAllow(host); err != nil {
+		return err
+	}
+	err := op()
+	s.breakerRecord(host, err)
+	return err
+}
+
+// breakerAllow returns an ErrCircuitOpen error while the host's breaker is open
+func (s *SftpSender) breakerAllow(host string) error {
+	if s.breakerThreshold <= 0 {
+		return nil
+	}
+	s.breakerMu.Lock()
+	defer s.breakerMu.Unlock()
+	b := s.breakers[host]
+	if b == nil || !time.Now().Before(b.openUntil) {
+		return nil
+	}
+	return fmt.Errorf("%w after %d consecutive failures, skipping %s until %s",
+		ErrCircuitOpen, b.failures, host, b.openUntil.Format("15:04:05"))
+}
+
+// breakerRecord counts a failure of host, opening its breaker at the
+// threshold, or resets the count after a success
+func (s *SftpSender) breakerRecord(host string, err error) {
+	if s.breakerThreshold <= 0 || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	s.breakerMu.Lock()
+	defer s.breakerMu.Unlock()
+	if s.breakers == nil {
+		s.breakers = make(map[string]*hostBreaker)
+	}
+	b := s.breakers[host]
+	if b == nil {
+		b = &hostBreaker{}
+		s.breakers[host] = b
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= s.breakerThreshold {
+		b.openUntil = time.Now().Add(s.breakerCooldown)
+		b.tripped = true
+		s.hostLog(host).Warnf("%s failed %d consecutive operations, pausing it for %s\n", host, b.failures, s.breakerCooldown)
+	}
+}
+
+// trippedHosts returns the hosts whose breaker opened during the run
+func (s *SftpSender) trippedHosts() []string {
+	s.breakerMu.Lock()
+	defer s.breakerMu.Unlock()
+	var hosts []string
+	for host, b := range s.breakers {
+		if b.tripped {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// logTrippedHosts adds the paused hosts to a run summary
+func (s *SftpSender) logTrippedHosts() {
+	if hosts := s.trippedHosts(); len(hosts) > 0 {
+		logInfof("Paused by circuit breaker: %s\n", strings.Join(hosts, ", "))
+	}
+}
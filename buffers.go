@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// Copy buffers and buffered readers/writers are pooled and shared across
+// concurrent transfers instead of being allocated for every file. Pooled items
+// of a different size (after --buffer-size changed) are dropped.
+
+func (s *SftpSender) getBuffer() *[]byte {
+	if b, ok := s.bufPool.Get().(*[]byte); ok && len(*b) == s.bufferSize {
+		return b
+	}
+	b := make([]byte, s.bufferSize)
+	return &b
+}
+
+func (s *SftpSender) putBuffer(b *[]byte) {
+	s.bufPool.Put(b)
+}
+
+func (s *SftpSender) getReader(r io.Reader) *bufio.Reader {
+	if br, ok := s.readerPool.Get().(*bufio.Reader); ok && br.Size() == s.bufferSize {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, s.bufferSize)
+}
+
+func (s *SftpSender) putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	s.readerPool.Put(br)
+}
+
+func (s *SftpSender) getWriter(w io.Writer) *bufio.Writer {
+	if bw, ok := s.writerPool.Get().(*bufio.Writer); ok && bw.Size() == s.bufferSize {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, s.bufferSize)
+}
+
+func (s *SftpSender) putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	s.writerPool.Put(bw)
+}
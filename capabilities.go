@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+)
+
+// sftpProtocolVersion is the only SFTP version the client negotiates; servers
+// answering with another version are refused when the session starts
+const sftpProtocolVersion = 3
+
+// sftpExtensions are the OpenSSH protocol extensions sftpsender looks for,
+// with what it uses each one for
+var sftpExtensions = []struct{ name, short, use string }{
+	{"posix-rename@openssh.com", "posix-rename", "replacing existing files atomically"},
+	{"statvfs@openssh.com", "statvfs", "checking free space before uploads"},
+	{"fsync@openssh.com", "fsync", "flushing uploaded files to disk"},
+	{"hardlink@openssh.com", "hardlink", "creating hard links"},
+	{"limits@openssh.com", "limits", "sizing requests to the server's limits"},
+	{"expand-path@openssh.com", "expand-path", "resolving ~ in remote paths"},
+	{"copy-data", "copy-data", "copying files on the server"},
+}
+
+// ServerCaps describes the SFTP protocol support of one host
+type ServerCaps struct {
+	Host       string          `json:"host"`
+	Version    int             `json:"version,omitempty"`
+	Extensions map[string]bool `json:"extensions,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// probeCaps reads the version and extensions announced by an SFTP server
+func probeCaps(host string, c *sftp.Client) ServerCaps {
+	caps := ServerCaps{Host: host, Version: sftpProtocolVersion, Extensions: make(map[string]bool)}
+	for _, ext := range sftpExtensions {
+		_, ok := c.HasExtension(ext.name)
+		caps.Extensions[ext.short] = ok
+	}
+	return caps
+}
+
+// hasCap reports whether host supports an extension. The first time a
+// missing extension matters for a host, a warning explains the consequence.
+func (s *SftpSender) hasCap(host string, c *sftp.Client, short, fallback string) bool {
+	if _, ok := c.HasExtension(extensionName(short)); ok {
+		return true
+	}
+	s.warnOnce(host+" "+short, "%s does not support %s, %s\n", host, extensionName(short), fallback)
+	return false
+}
+
+func extensionName(short string) string {
+	for _, ext := range sftpExtensions {
+		if ext.short == short {
+			return ext.name
+		}
+	}
+	return short
+}
+
+// checkFreeSpace fails an upload of need bytes below remotePath up front when
+// the remote file system reports less space than that
+func (s *SftpSender) checkFreeSpace(host string, c *sftp.Client, remotePath string, need int64) error {
+	if need <= 0 {
+		return nil
+	}
+	free, ok := s.remoteFree(host, c, remotePath, "skipping the free space check")
+	if ok && need > free {
+		return fmt.Errorf("%w: upload to %s needs %s but only %s is free on %s",
+			ErrNoSpace, remotePath, formatBytes(need), formatBytes(free), host)
+	}
+	return nil
+}
+
+// remoteFree returns the space available below remotePath, or false when the
+// server cannot tell; fallback says what happens then
+func (s *SftpSender) remoteFree(host string, c *sftp.Client, remotePath, fallback string) (int64, bool) {
+	if !s.hasCap(host, c, "statvfs", fallback) {
+		return 0, false
+	}
+	// The destination may not exist yet, the nearest existing parent is on the same file system
+	dir := remotePath
+	for {
+		if _, err := c.Stat(dir); err == nil || dir == "/" || dir == "." {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	vfs, err := c.StatVFS(dir)
+	if err != nil {
+		s.hostLog(host).Warnf("%s: free space check failed: %v\n", host, err)
+		return 0, false
+	}
+	return int64(vfs.Bavail * vfs.Frsize), true
+}
+
+// uploadNeeds estimates the additional remote space an upload takes. A file
+// replacing an existing one only needs the difference; re-uploads of an
+// existing directory are not estimated since most files may be skipped.
+func (s *SftpSender) uploadNeeds(c *sftp.Client, localPath, remotePath string, info os.FileInfo) int64 {
+	remote, err := c.Stat(remotePath)
+	switch {
+	case !info.IsDir() && err == nil:
+		return info.Size() - remote.Size()
+	case !info.IsDir():
+		return info.Size()
+	case err == nil:
+		return 0
+	default:
+		return localSize(localPath)
+	}
+}
+
+// runCaps implements the "caps" subcommand, which reports the SFTP protocol
+// version and extensions of each host
+func runCaps(args []string) error {
+	fs := pflag.NewFlagSet("caps", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to probe")
+	group := fs.String("group", "", "Probe every host of this group")
+	asJSON := fs.Bool("json", false, "Print the capabilities as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	results := make([]ServerCaps, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			results[i] = s.probeHost(host)
+		}(i, host)
+	}
+	wg.Wait()
+
+	if *asJSON {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := []string{"HOST", "SFTP"}
+	for _, ext := range sftpExtensions {
+		header = append(header, strings.ToUpper(ext.short))
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+			fmt.Fprintf(w, "%s\terror: %s\n", r.Host, r.Error)
+			continue
+		}
+		row := []string{r.Host, fmt.Sprintf("v%d", r.Version)}
+		for _, ext := range sftpExtensions {
+			mark := "-"
+			if r.Extensions[ext.short] {
+				mark = "yes"
+			}
+			row = append(row, mark)
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not probe %d of %d hosts", failed, len(hosts))
+	}
+	return nil
+}
+
+// probeHost connects to a host and reads its capabilities
+func (s *SftpSender) probeHost(host string) ServerCaps {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return ServerCaps{Host: host, Error: err.Error()}
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return ServerCaps{Host: host, Error: err.Error()}
+	}
+	defer client.Close()
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		if isNoSFTPSubsystem(err) {
+			return ServerCaps{Host: host, Error: "no SFTP subsystem (SCP only, see --scp)"}
+		}
+		return ServerCaps{Host: host, Error: err.Error()}
+	}
+	defer sftpClient.Close()
+	return probeCaps(host, sftpClient)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for several upload sources with the same base name, which would
+// otherwise overwrite each other in the destination directory
+const (
+	collisionError    = "error"     // refuse the run
+	collisionSuffix   = "suffix"    // name later ones file-1.txt, file-2.txt, ...
+	collisionKeepDirs = "keep-dirs" // keep their directories below the common parent
+)
+
+func validCollisionPolicy(policy string) bool {
+	return policy == collisionError || policy == collisionSuffix || policy == collisionKeepDirs
+}
+
+// planUploadNames picks the remote names of the upload sources under the
+// collision policy. Sources whose base names are unique keep them; repeated
+// sources are dropped, and the remaining list is returned.
+func (s *SftpSender) planUploadNames(uploads []string, policy string) ([]string, error) {
+	var sources []string
+	seen := make(map[string]bool)
+	byName := make(map[string][]string)
+	for _, localPath := range uploads {
+		abs, err := filepath.Abs(localPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+		sources = append(sources, localPath)
+		byName[filepath.Base(localPath)] = append(byName[filepath.Base(localPath)], localPath)
+	}
+
+	names := make(map[string]string)
+	for _, source := range sources {
+		base := filepath.Base(source)
+		paths := byName[base]
+		if len(paths) == 1 || paths[0] != source {
+			continue
+		}
+		switch policy {
+		case collisionSuffix:
+			ext := filepath.Ext(base)
+			stem := strings.TrimSuffix(base, ext)
+			n := 1
+			for _, localPath := range paths[1:] {
+				name := fmt.Sprintf("%s-%d%s", stem, n, ext)
+				for byName[name] != nil {
+					n++
+					name = fmt.Sprintf("%s-%d%s", stem, n, ext)
+				}
+				names[localPath] = name
+				n++
+			}
+		case collisionKeepDirs:
+			rels, err := relativeToCommonParent(paths)
+			if err != nil {
+				return nil, err
+			}
+			for i, localPath := range paths {
+				names[localPath] = rels[i]
+			}
+		default:
+			return nil, fmt.Errorf("%s would all be uploaded as %s, use --on-collision suffix or keep-dirs", strings.Join(paths, ", "), base)
+		}
+	}
+	s.uploadNames = names
+	return sources, nil
+}
+
+// relativeToCommonParent returns the slash-separated paths of files relative
+// to the deepest directory containing all of them
+func relativeToCommonParent(files []string) ([]string, error) {
+	abs := make([]string, len(files))
+	for i, f := range files {
+		var err error
+		if abs[i], err = filepath.Abs(f); err != nil {
+			return nil, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+	}
+	parent := filepath.Dir(abs[0])
+	for _, a := range abs[1:] {
+		for !strings.HasPrefix(a, parent+string(filepath.Separator)) && parent != filepath.Dir(parent) {
+			parent = filepath.Dir(parent)
+		}
+	}
+	rels := make([]string, len(abs))
+	for i, a := range abs {
+		rel, err := filepath.Rel(parent, a)
+		if err != nil {
+			return nil, err
+		}
+		rels[i] = filepath.ToSlash(rel)
+	}
+	return rels, nil
+}
+
+// remoteName is the name localPath is uploaded as inside the destination
+// directory, its base name unless planUploadNames renamed it
+func (s *SftpSender) remoteName(localPath string) string {
+	if name, ok := s.uploadNames[localPath]; ok {
+		return name
+	}
+	return filepath.Base(localPath)
+}
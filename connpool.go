@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// connPool keeps one SSH connection per credential open across operations.
+// Clients handed out by it ignore Close; the connections are closed by
+// closeAll. A connection that dropped is replaced on the next use.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*pooledConn // by user@ip of the credential
+}
+
+// pooledConn wraps a shared connection so the Close of its users is a no-op
+type pooledConn struct {
+	ssh.Conn
+	client *ssh.Client
+	closed atomic.Bool
+}
+
+func (c *pooledConn) Close() error { return nil }
+
+// pooledClient returns the open connection of cred, dialing it first if needed
+func (s *SftpSender) pooledClient(cred *Credential) (*ssh.Client, error) {
+	p := s.conns
+	key := cred.Username + "@" + cred.IP
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c := p.conns[key]; c != nil && !c.closed.Load() {
+		return c.client, nil
+	}
+
+	client, err := s.connectHost(cred)
+	if err != nil {
+		return nil, err
+	}
+	// Incoming channels and requests stay with the dialed client, which
+	// serves agent forwarding; the wrapper only opens channels
+	chans, reqs := make(chan ssh.NewChannel), make(chan *ssh.Request)
+	close(chans)
+	close(reqs)
+	c := &pooledConn{Conn: client.Conn}
+	c.client = ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		c.closed.Store(true)
+	}()
+	if p.conns == nil {
+		p.conns = make(map[string]*pooledConn)
+	}
+	p.conns[key] = c
+	return c.client, nil
+}
+
+// closeAll closes every pooled connection
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, c := range p.conns {
+		c.Conn.Close()
+		delete(p.conns, key)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// isRemoteSpec reports whether a cp argument is a host:path remote location.
+// sftp:// URLs are remote too. Paths starting with . or /, and Windows drive
+// letters such as C:\ stay local.
+func isRemoteSpec(arg string) bool {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.HasPrefix(arg, ".") || strings.HasPrefix(arg, "/") {
+		return false
+	}
+	if i == 1 && len(arg) > 2 && (arg[2] == '\\' || arg[2] == '/') {
+		return false
+	}
+	return !strings.ContainsAny(arg[:i], `/\`)
+}
+
+// parseCopyArgs maps the scp-style "cp SOURCE DEST" arguments onto the
+// --upload, --download and --ip flag values plus the local download location.
+// Exactly one side must be remote.
+func parseCopyArgs(src, dst string) (upload, download, ip, location string, err error) {
+	srcRemote, dstRemote := isRemoteSpec(src), isRemoteSpec(dst)
+	switch {
+	case srcRemote && dstRemote:
+		return "", "", "", "", fmt.Errorf("copying between two remote hosts is not supported")
+	case !srcRemote && !dstRemote:
+		return "", "", "", "", fmt.Errorf("one of SOURCE or DEST must be a remote host:path or sftp:// URL")
+	case dstRemote:
+		return src, "", dst, "", nil
+	}
+
+	if strings.HasPrefix(src, "sftp://") {
+		u, err := url.Parse(src)
+		if err != nil {
+			return "", "", "", "", fmt.Errorf("invalid sftp URL: %v", err)
+		}
+		download, u.Path = u.Path, ""
+		if download == "" {
+			return "", "", "", "", fmt.Errorf("remote source %q has no path", src)
+		}
+		return "", download, u.String(), dst, nil
+	}
+
+	if u, download, ok := parseInlineTarget(src); ok {
+		if download == "" {
+			return "", "", "", "", fmt.Errorf("remote source %q has no path", src)
+		}
+		return "", download, u.String(), dst, nil
+	}
+
+	parts := strings.SplitN(src, ":", 2)
+	if parts[1] == "" {
+		return "", "", "", "", fmt.Errorf("remote source %q has no path", src)
+	}
+	return "", parts[1], parts[0], dst, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// readCredentials reads the credentials of --credentials from a file, or from
+// stdin for "-", so orchestration systems can hand short-lived credentials to
+// one run without writing them to disk. Both a list of credentials and a
+// document with a credentials list are accepted, as YAML or JSON.
+func readCredentials(source string) ([]Credential, error) {
+	var data []byte
+	var err error
+	if source == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %v", err)
+	}
+	var creds []Credential
+	if _, ok := raw.([]interface{}); ok {
+		err = yaml.UnmarshalStrict(data, &creds)
+	} else {
+		var doc struct {
+			Credentials []Credential `yaml:"credentials"`
+		}
+		err = yaml.UnmarshalStrict(data, &doc)
+		creds = doc.Credentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %v", err)
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("no credentials given")
+	}
+	for i := range creds {
+		if creds[i].IP == "" {
+			return nil, fmt.Errorf("credential %d has no ip", i+1)
+		}
+		if err := parseCredentialLimits(&creds[i], "--credentials"); err != nil {
+			return nil, err
+		}
+	}
+	if err := decryptCredentials(creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// activeDashboard is set while --dashboard owns the terminal; log messages are
+// then kept for the dashboard instead of being printed. Workers log while the
+// dashboard starts and stops, so it is accessed atomically.
+var activeDashboard atomic.Pointer[dashboard]
+
+// dashboardRecentLines is the number of recent warnings and errors shown below the host rows
+const dashboardRecentLines = 5
+
+// dashboard is a full-screen view of a parallel run with one row per host,
+// redrawn in place instead of scrolling interleaved logs
+type dashboard struct {
+	title string
+	start time.Time
+
+	mu     sync.Mutex
+	rows   []*dashRow
+	byHost map[string]*dashRow
+	recent []string
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// dashRow is the state of one host
+type dashRow struct {
+	host     string
+	file     string // base name of the upload, empty for downloads
+	status   string
+	bytes    int64 // bytes sent and received on the host's connections
+	total    int64 // size of the upload, 0 if unknown
+	started  time.Time
+	finished time.Time
+	lastErr  string
+}
+
+// dashboardSupported reports whether stdout is a terminal the dashboard can draw on
+func dashboardSupported() bool {
+	if ciMode || sysLog != nil {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newDashboard(title string, hosts []string) *dashboard {
+	d := &dashboard{
+		title:  title,
+		start:  time.Now(),
+		byHost: make(map[string]*dashRow),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, h := range hosts {
+		d.addHost(h)
+	}
+	return d
+}
+
+func (d *dashboard) addHost(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byHost[host] != nil {
+		return
+	}
+	row := &dashRow{host: host, status: "queued"}
+	d.rows = append(d.rows, row)
+	d.byHost[host] = row
+}
+
+// run takes over the terminal and redraws it until close is called
+func (d *dashboard) run() {
+	activeDashboard.Store(d)
+	fmt.Print("\033[?25l")
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			d.render()
+			select {
+			case <-ticker.C:
+			case <-d.stop:
+				d.render()
+				return
+			}
+		}
+	}()
+}
+
+// close draws the final state, gives the terminal back and restores logging.
+// A fatal error may close the dashboard while the run closes it as well, the
+// second call waits for the first.
+func (d *dashboard) close() {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+		fmt.Print("\033[?25h")
+		activeDashboard.CompareAndSwap(d, nil)
+	})
+}
+
+// setStatus updates the status of a host; a non-nil err marks it failed
+func (d *dashboard) setStatus(host, status string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	row := d.byHost[host]
+	if row == nil {
+		return
+	}
+	now := time.Now()
+	if row.started.IsZero() && status != "queued" {
+		row.started = now
+	}
+	row.status = status
+	switch {
+	case err != nil:
+		row.status = "failed"
+		row.lastErr = err.Error()
+		row.finished = now
+	case status == "done":
+		row.finished = now
+	}
+}
+
+// setUpload sets the file a host receives and its size for the progress columns
+func (d *dashboard) setUpload(host, file string, total int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if row := d.byHost[host]; row != nil {
+		row.file = file
+		row.total = total
+	}
+}
+
+// rowFor finds the row of a credential by name or IP
+func (d *dashboard) rowFor(cred *Credential) *dashRow {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if row := d.byHost[cred.Name]; row != nil && cred.Name != "" {
+		return row
+	}
+	return d.byHost[cred.IP]
+}
+
+// wrapConn counts the traffic of a host's connection towards its row
+func (d *dashboard) wrapConn(conn net.Conn, cred *Credential) net.Conn {
+	row := d.rowFor(cred)
+	if row == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, add: func(n int) {
+		d.mu.Lock()
+		row.bytes += int64(n)
+		d.mu.Unlock()
+	}}
+}
+
+// log keeps a warning or error for the recent messages area
+func (d *dashboard) log(level, format string, args ...interface{}) {
+	msg := syslogMessage(format, args...)
+	if msg == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, line := range strings.Split(msg, "\n") {
+		d.recent = append(d.recent, level+line)
+	}
+	if len(d.recent) > dashboardRecentLines {
+		d.recent = d.recent[len(d.recent)-dashboardRecentLines:]
+	}
+}
+
+func (d *dashboard) render() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	width, fileWidth := len("HOST"), 0
+	counts := make(map[string]int)
+	for _, row := range d.rows {
+		width = max(width, len(row.host))
+		if row.file != "" {
+			fileWidth = max(fileWidth, len("FILE"), min(len(row.file), 30))
+		}
+		counts[row.status]++
+	}
+	// The file column is left out when no host has one, as in downloads
+	file := func(f string) string {
+		if fileWidth == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%-*s  ", fileWidth, truncate(f, fileWidth))
+	}
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "sftpsender %s  %d/%d done, %d failed, %d active  elapsed %s\n\n",
+		d.title, counts["done"], len(d.rows), counts["failed"],
+		len(d.rows)-counts["done"]-counts["failed"]-counts["queued"], time.Since(d.start).Round(time.Second))
+	fmt.Fprintf(&b, "%-*s  %s%-12s  %-17s  %-19s  %-10s  %s\n", width, "HOST", file("FILE"), "STATUS", "BYTES", "PROGRESS",
+		"SPEED", "LAST ERROR")
+	for _, row := range d.rows {
+		fmt.Fprintf(&b, "%-*s  %s%-12s  %-17s  %-19s  %-10s  %s\n", width, row.host, file(row.file), truncate(row.status, 12),
+			row.transferred(), row.progress(), row.speed(), truncate(row.lastErr, 60))
+	}
+	if len(d.recent) > 0 {
+		b.WriteString("\n")
+		for _, line := range d.recent {
+			b.WriteString(truncate(line, 120) + "\n")
+		}
+	}
+	fmt.Print(b.String())
+}
+
+// done is the number of bytes of the total transferred so far
+func (r *dashRow) done() int64 {
+	// Protocol overhead is counted too, so only a finished host shows 100%
+	if r.status == "done" {
+		return r.total
+	}
+	return min(r.bytes, r.total*99/100)
+}
+
+// transferred renders the bytes done out of the total when it is known, else
+// the byte count
+func (r *dashRow) transferred() string {
+	if r.total <= 0 {
+		if r.bytes == 0 {
+			return ""
+		}
+		return formatBytes(r.bytes)
+	}
+	return formatBytes(r.done()) + "/" + formatBytes(r.total)
+}
+
+// progress renders a bar with percentage when the total is known
+func (r *dashRow) progress() string {
+	if r.total <= 0 {
+		return ""
+	}
+	const barWidth = 12
+	done := r.done()
+	filled := int(done * barWidth / r.total)
+	return fmt.Sprintf("[%s%s] %3d%%", strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), done*100/r.total)
+}
+
+// speed is the average rate of the host since it started
+func (r *dashRow) speed() string {
+	if r.started.IsZero() || r.bytes == 0 {
+		return ""
+	}
+	end := r.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(r.started).Seconds()
+	if elapsed <= 0 {
+		return ""
+	}
+	return formatBytes(int64(float64(r.bytes)/elapsed)) + "/s"
+}
+
+// countingConn reports the bytes read and written on a connection
+type countingConn struct {
+	net.Conn
+	add func(n int)
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.add(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.add(n)
+	return n, err
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. 1.5MB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "…"
+}
+
+// localSize returns the size of a local file or the total size of a directory tree
+func localSize(path string) int64 {
+	var total int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// hostTiming is how the upload to one host of a run went, for its summary
+type hostTiming struct {
+	label   string
+	host    string
+	file    string
+	size    int64
+	elapsed time.Duration
+	err     error
+}
+
+// logTimings prints the hosts of a run with the time and average speed of
+// their uploads, retries included
+func logTimings(timings []hostTiming) {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKER\tHOST\tFILE\tSIZE\tTIME\tSPEED\tSTATE")
+	for _, t := range timings {
+		state, speed := "ok", "-"
+		switch {
+		case errors.Is(t.err, ErrInterrupted):
+			state = "interrupted"
+		case t.err != nil:
+			state = "failed"
+		case t.elapsed > 0:
+			speed = formatBytes(int64(float64(t.size)/t.elapsed.Seconds())) + "/s"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.label, t.host, t.file, formatBytes(t.size),
+			t.elapsed.Round(100*time.Millisecond), speed, state)
+	}
+	w.Flush()
+	logInfof("%s", b.String())
+}
+
+// startDashboard shows the dashboard for hosts if stdout is a terminal
+func (s *SftpSender) startDashboard(title string, hosts []string) {
+	if !dashboardSupported() {
+		logWarnf("--dashboard needs an interactive terminal, using regular output\n")
+		return
+	}
+	s.dashboard = newDashboard(title, hosts)
+	s.dashboard.run()
+}
+
+// stopDashboard closes the dashboard, if any, leaving its final state on screen
+func (s *SftpSender) stopDashboard() {
+	if s.dashboard != nil {
+		s.dashboard.close()
+		s.dashboard = nil
+	}
+}
+
+// hostStatus updates the dashboard row of host, if the dashboard is shown
+func (s *SftpSender) hostStatus(host, status string, err error) {
+	if s.dashboard != nil {
+		s.dashboard.setStatus(host, status, err)
+	}
+}
+
+// uploadHost uploads to one host of a multi-host run, keeping its dashboard row current
+func (s *SftpSender) uploadHost(localPath, host, location string, displayPath ...string) error {
+	if s.interrupted() {
+		s.hostStatus(host, "done", ErrInterrupted)
+		return ErrInterrupted
+	}
+	if s.dashboard != nil {
+		s.dashboard.setUpload(host, filepath.Base(localPath), localSize(localPath))
+	}
+	s.hostStatus(host, "uploading", nil)
+	err := s.retry(host, func() error { return s.Upload(localPath, host, location, displayPath...) })
+	s.hostStatus(host, "done", err)
+	return err
+}
+
+// downloadHost downloads from one host of a multi-host run, keeping its dashboard row current
+func (s *SftpSender) downloadHost(remotePath, host, location string) error {
+	if s.interrupted() {
+		s.hostStatus(host, "done", ErrInterrupted)
+		return ErrInterrupted
+	}
+	s.hostStatus(host, "downloading", nil)
+	err := s.retry(host, func() error { return s.Download(remotePath, host, location) })
+	s.hostStatus(host, "done", err)
+	return err
+}
+
+// forEachHost calls fn for the index of each host in order on up to parallel goroutines
+func (s *SftpSender) forEachHost(hosts []string, parallel int, fn func(i int)) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	n := len(hosts)
+	if parallel > 1 && n > 1 {
+		// Output of hosts handled at the same time interleaves, so each
+		// host's log lines get its tag
+		defer s.tagHosts(hosts)()
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(parallel, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
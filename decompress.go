@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// decompressCommands maps the remote file extensions --decompress recognizes
+// to the local command that decompresses them; gzip needs no command
+var decompressCommands = map[string][]string{
+	".gz":  nil,
+	".zst": {"zstd", "-dc"},
+	".xz":  {"xz", "-dc"},
+}
+
+// decompressTarget returns the local path a downloaded file is written to and
+// its compression extension, which is empty when the file is kept as it is
+func (s *SftpSender) decompressTarget(remotePath, localPath string) (string, string) {
+	if !s.decompress {
+		return localPath, ""
+	}
+	ext := strings.ToLower(path.Ext(remotePath))
+	command, ok := decompressCommands[ext]
+	if !ok || strings.EqualFold(path.Base(remotePath), ext) {
+		return localPath, ""
+	}
+	if command != nil {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			s.warnOnce("decompress "+ext, "%s is not installed, keeping %s files compressed\n", command[0], ext)
+			return localPath, ""
+		}
+	}
+	return localPath[:len(localPath)-len(ext)], ext
+}
+
+// downloadDecompressed downloads a compressed remote file and writes it
+// decompressed to localPath, returning the number of bytes written and their
+// SHA-256 checksum
+func (s *SftpSender) downloadDecompressed(sftpClient *sftp.Client, remotePath, localPath, ext string) (_ int64, _ string, err error) {
+	if s.resume {
+		s.warnOnce("decompress resume", "--resume does not apply to decompressed downloads, fetching whole files\n")
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create local directory: %w", err)
+	}
+	remoteFile, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer remoteFile.Close()
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer localFile.Close()
+	// Without resume there is nothing to continue from, a broken file is
+	// only in the way
+	defer func() {
+		if err != nil {
+			os.Remove(localPath)
+		}
+	}()
+	defer s.onAbort("partial file "+localPath, func() error { return os.Remove(localPath) })()
+
+	// The remote file is read with concurrent requests into a pipe, the
+	// decompressor reads the other end
+	pr, pw := io.Pipe()
+	fetched := make(chan int64, 1)
+	go func() {
+		n, err := remoteFile.WriteTo(pw)
+		pw.CloseWithError(err)
+		fetched <- n
+	}()
+	defer func() {
+		pr.Close()
+		s.addTransferred(<-fetched)
+	}()
+
+	writer := s.getWriter(localFile)
+	defer s.putWriter(writer)
+	hash := sha256.New()
+	out := &countingWriter{w: io.MultiWriter(writer, hash)}
+	if command := decompressCommands[ext]; command != nil {
+		var stderr bytes.Buffer
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = pr, out, &stderr
+		if err := cmd.Run(); err != nil {
+			return out.n, "", fmt.Errorf("failed to decompress %s: %v: %s", remotePath, err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		buffer := s.getBuffer()
+		defer s.putBuffer(buffer)
+		zr, err := gzip.NewReader(bufio.NewReaderSize(pr, len(*buffer)))
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to decompress %s: %w", remotePath, err)
+		}
+		if _, err := io.CopyBuffer(out, zr, *buffer); err != nil {
+			return out.n, "", fmt.Errorf("failed to decompress %s: %w", remotePath, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return out.n, "", fmt.Errorf("failed to write local file: %w", err)
+	}
+	return out.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/pkg/sftp"
+)
+
+// parseDirMode parses an octal directory mode such as 0750 or 750
+func parseDirMode(s string) (os.FileMode, error) {
+	return parseMode(s, "directory", "0750")
+}
+
+// parseFileMode parses an octal file mode such as 0600 or 600
+func parseFileMode(s string) (os.FileMode, error) {
+	return parseMode(s, "file", "0600")
+}
+
+func parseMode(s, kind, example string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid %s mode %q, expected octal like %s", kind, s, example)
+	}
+	return os.FileMode(mode), nil
+}
+
+// chmodUpload gives an uploaded file the mode of --chmod
+func (s *SftpSender) chmodUpload(sftpClient *sftp.Client, remotePath string) error {
+	if s.fileMode == 0 {
+		return nil
+	}
+	if err := sftpClient.Chmod(remotePath, s.fileMode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", remotePath, err)
+	}
+	return nil
+}
+
+// mkdirAllRemote creates a remote directory and its missing parents, giving
+// every directory it creates s.dirMode; existing directories are left alone
+func (s *SftpSender) mkdirAllRemote(sftpClient *sftp.Client, dir string) error {
+	if s.dirMode == 0 {
+		return sftpClient.MkdirAll(dir)
+	}
+
+	var missing []string
+	for d := dir; d != "." && d != "/"; d = path.Dir(d) {
+		if _, err := sftpClient.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := sftpClient.MkdirAll(dir); err != nil {
+		return err
+	}
+	// Chmod also overrides the server's umask
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := sftpClient.Chmod(missing[i], s.dirMode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", missing[i], err)
+		}
+	}
+	return nil
+}
+
+// remoteUmask prefixes a remote shell command that creates directories so they
+// get at most s.dirMode, for the exec based backends that cannot chmod them
+func (s *SftpSender) remoteUmask(command string) string {
+	if s.dirMode == 0 {
+		return command
+	}
+	return fmt.Sprintf("umask %03o && %s", ^s.dirMode&0777, command)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// downloadCaps bounds what a run may download, so an unexpectedly huge remote
+// tree cannot fill the local disk
+type downloadCaps struct {
+	maxSize  int64 // total bytes of all downloads of the run, 0 = unlimited
+	maxDepth int   // directory levels below the downloaded directory, 0 = unlimited
+	planned  atomic.Int64
+}
+
+// reserveDownload accounts for a file about to be downloaded and fails when it
+// would take the run over --max-download-size
+func (s *SftpSender) reserveDownload(remotePath string, size int64) error {
+	if s.caps.maxSize <= 0 {
+		return nil
+	}
+	if total := s.caps.planned.Add(size); total > s.caps.maxSize {
+		s.caps.planned.Add(-size)
+		return fmt.Errorf("downloading %s (%s) would exceed --max-download-size %s (%s of other files already downloading or done)",
+			remotePath, formatBytes(size), formatBytes(s.caps.maxSize), formatBytes(total-size))
+	}
+	return nil
+}
+
+// beyondDepth reports whether an entry at the slash-separated path rel below
+// the downloaded directory is deeper than --max-depth. Files directly in the
+// directory are at depth 1.
+func (s *SftpSender) beyondDepth(rel string) bool {
+	if s.caps.maxDepth <= 0 {
+		return false
+	}
+	rel = path.Clean(rel)
+	return strings.Count(rel, "/")+1 > s.caps.maxDepth
+}
+
+// rsyncDepthFilter returns the rsync exclude that enforces --max-depth
+func (s *SftpSender) rsyncDepthFilter() []string {
+	if s.caps.maxDepth <= 0 {
+		return nil
+	}
+	return []string{"--exclude=/" + strings.Repeat("*/", s.caps.maxDepth) + "*"}
+}
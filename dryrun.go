@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// With --dry-run, uploads and downloads resolve their sources and
+// destinations as usual and print every file they would transfer instead.
+// Uploads do not connect at all, downloads only to list the remote side.
+// Hooks, notifications and the history are left alone.
+
+// dryRunUpload prints the files an upload of localPath to remotePath on host
+// would send
+func (s *SftpSender) dryRunUpload(host, localPath, remotePath, pathToDisplay string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat local path: %w", err)
+	}
+	if !info.IsDir() {
+		s.hostLog(host).Infof("Would upload %s (%s) to %s:%s\n", pathToDisplay, formatBytes(info.Size()), host, remotePath)
+		return nil
+	}
+
+	scan, err := scanLocalTree(localPath, s.filter)
+	if err != nil {
+		return fmt.Errorf("failed to scan local directory: %w", err)
+	}
+	files := slices.SortedFunc(slices.Values(scan.files), func(a, b localEntry) int { return strings.Compare(a.rel, b.rel) })
+	s.hostLog(host).Infof("Would upload %s (%d files, %s) to %s:%s\n", pathToDisplay, len(files), formatBytes(scan.totalSize), host, remotePath)
+	for _, f := range files {
+		rel := filepath.ToSlash(f.rel)
+		s.hostLog(host).Infof("  %s -> %s:%s (%s)\n", rel, host, path.Join(remotePath, rel), formatBytes(f.info.Size()))
+	}
+	return nil
+}
+
+// dryRunDownload lists remotePath on the host and prints the files a download
+// to localPath would fetch
+func (s *SftpSender) dryRunDownload(cred *Credential, host, remotePath, localPath string) error {
+	var c *sftp.Client
+	if s.transport == transportOpenSSH {
+		var err error
+		if c, err = s.openSSHSFTP(cred); err != nil {
+			return err
+		}
+	} else {
+		client, err := s.getSSHClient(cred)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if c, err = s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket}); err != nil {
+			return err
+		}
+	}
+	defer c.Close()
+
+	info, err := c.Stat(remotePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat remote path: %w", err)
+	}
+	if !info.IsDir() {
+		target, _ := s.decompressTarget(remotePath, localPath)
+		s.hostLog(host).Infof("Would download %s:%s (%s) to %s\n", host, remotePath, formatBytes(info.Size()), target)
+		return nil
+	}
+
+	type dryRunFile struct {
+		rel  string
+		size int64
+	}
+	var files []dryRunFile
+	var total int64
+	walker := c.Walk(remotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(remotePath, walker.Path())
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		stat := walker.Stat()
+		if s.beyondDepth(rel) || s.filter.excludes(rel, stat.IsDir()) {
+			if stat.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if !stat.IsDir() {
+			files = append(files, dryRunFile{rel: rel, size: stat.Size()})
+			total += stat.Size()
+		}
+	}
+	s.hostLog(host).Infof("Would download %s:%s (%d files, %s) to %s\n", host, remotePath, len(files), formatBytes(total), localPath)
+	for _, f := range files {
+		target, _ := s.decompressTarget(path.Join(remotePath, f.rel), filepath.Join(localPath, filepath.FromSlash(f.rel)))
+		s.hostLog(host).Infof("  %s:%s -> %s (%s)\n", host, path.Join(remotePath, f.rel), target, formatBytes(f.size))
+	}
+	return nil
+}
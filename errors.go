@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Error classes of failed host operations. Errors returned by Upload, Download
+// and getSSHClient wrap one of these when the cause is known, so callers can
+// branch with errors.Is instead of matching messages.
+var (
+	ErrAuthFailed       = errors.New("authentication failed")
+	ErrHostUnreachable  = errors.New("host unreachable")
+	ErrHostKeyMismatch  = errors.New("host key mismatch")
+	ErrNoSpace          = errors.New("no space left on device")
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrCircuitOpen is returned without contacting a host whose circuit
+	// breaker opened after too many consecutive failures
+	ErrCircuitOpen = errors.New("circuit breaker open")
+
+	// ErrTransferTimeout is returned when --stall-timeout or --max-time
+	// aborted a transfer
+	ErrTransferTimeout = errors.New("transfer timed out")
+
+	// ErrInterrupted is returned for files and hosts not started because
+	// the run was interrupted with Ctrl-C
+	ErrInterrupted = errors.New("interrupted")
+
+	// ErrRunTimeLimit is recorded for a run aborted by --max-total-time
+	ErrRunTimeLimit = errors.New("run time limit reached")
+
+	// ErrReadOnly is returned without contacting a host for operations that
+	// would modify a read_only host or any host of a --read-only run
+	ErrReadOnly = errors.New("read-only")
+)
+
+// SFTP status codes of version 6 servers for a full disk or exceeded quota
+const (
+	sftpNoSpaceOnFilesystem = 14
+	sftpQuotaExceeded       = 15
+)
+
+// classifiedError attaches an error class to an error without changing its message
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string { return e.err.Error() }
+
+func (e *classifiedError) Unwrap() []error { return []error{e.class, e.err} }
+
+// classifyError wraps err with its error class, if one applies
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	class := errorClass(err)
+	if class == nil || errors.Is(err, class) {
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+func errorClass(err error) error {
+	var keyErr *knownhosts.KeyError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var statusErr *sftp.StatusError
+	switch {
+	case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+		return ErrHostKeyMismatch
+	case strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		// x/crypto/ssh reports exhausted auth methods with an untyped error
+		return ErrAuthFailed
+	case errors.As(err, &dnsErr), errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrHostUnreachable
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT),
+		errors.As(err, &statusErr) && (statusErr.Code == sftpNoSpaceOnFilesystem || statusErr.Code == sftpQuotaExceeded):
+		return ErrNoSpace
+	case errors.Is(err, os.ErrPermission):
+		return ErrPermissionDenied
+	}
+	return nil
+}
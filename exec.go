@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+)
+
+// ExecResult is the outcome of a command on one host, written to summary.json
+// by exec --collect-output
+type ExecResult struct {
+	Host     string    `json:"host"`
+	ExitCode int       `json:"exit_code"` // -1 when the command could not be run
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Stdout   string    `json:"stdout,omitempty"` // file holding the output
+	Stderr   string    `json:"stderr,omitempty"`
+}
+
+// runExec implements the "exec" subcommand: it runs one command on many hosts
+// concurrently, printing output with a per-host prefix
+func runExec(args []string) error {
+	fs := pflag.NewFlagSet("exec", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to run on")
+	group := fs.String("group", "", "Run on every host of this group")
+	parallel := fs.Int("parallel", 16, "Number of hosts to run on at the same time")
+	cwd := fs.String("cwd", "", "Remote directory to run the command in, checked against allowed_remote_prefixes")
+	collect := fs.String("collect-output", "", "Write each host's stdout, stderr and exit code to this directory, plus summary.json")
+	auditLog := fs.String("audit-log", "", "Append an audit entry for every command to this file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: sftpsender exec (--ip hosts | --group name) [--cwd dir] [--collect-output dir] -- COMMAND")
+	}
+	command := strings.Join(fs.Args(), " ")
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	s.auditPath = s.config.AuditLog
+	if *auditLog != "" {
+		s.auditPath = *auditLog
+	}
+	s.execDir = *cwd
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+	if *collect != "" {
+		if err := os.MkdirAll(*collect, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
+	}
+
+	width := 0
+	for _, h := range hosts {
+		if len(h) > width {
+			width = len(h)
+		}
+	}
+	color := useColor()
+
+	var outMu sync.Mutex
+	results := make([]ExecResult, len(hosts))
+	sem := make(chan struct{}, max(*parallel, 1))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prefix := hostPrefix(host, width, color)
+			stdout := &prefixWriter{prefix: prefix, out: os.Stdout, mu: &outMu}
+			stderr := &prefixWriter{prefix: prefix, out: os.Stderr, mu: &outMu}
+			results[i] = s.execOnHost(host, command, stdout, stderr, *collect)
+			stdout.flush()
+			stderr.flush()
+			if r := results[i]; r.Error != "" {
+				outMu.Lock()
+				logErrorf("%s%s\n", prefix, r.Error)
+				outMu.Unlock()
+			} else if r.ExitCode != 0 {
+				outMu.Lock()
+				logErrorf("%sexit code %d\n", prefix, r.ExitCode)
+				outMu.Unlock()
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.ExitCode != 0 {
+			failed++
+		}
+	}
+
+	if *collect != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(*collect, "summary.json"), append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write summary: %v", err)
+		}
+		logInfof("Output of %d hosts collected in %s\n", len(hosts), *collect)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("command failed on %d of %d hosts", failed, len(hosts))
+	}
+	return nil
+}
+
+// execOnHost runs the command on one host. With a collect directory the output
+// is also written to <host>.stdout, <host>.stderr and <host>.exit there.
+func (s *SftpSender) execOnHost(host, command string, stdout, stderr io.Writer, collect string) ExecResult {
+	result := ExecResult{Host: host, Started: time.Now()}
+
+	if collect != "" {
+		base := filepath.Join(collect, safeFileName(host))
+		result.Stdout, result.Stderr = base+".stdout", base+".stderr"
+		outFile, err := os.Create(result.Stdout)
+		if err == nil {
+			defer outFile.Close()
+			stdout = io.MultiWriter(stdout, outFile)
+		}
+		errFile, err := os.Create(result.Stderr)
+		if err == nil {
+			defer errFile.Close()
+			stderr = io.MultiWriter(stderr, errFile)
+		}
+		defer func() {
+			os.WriteFile(base+".exit", []byte(fmt.Sprintf("%d\n", result.ExitCode)), 0644)
+		}()
+	}
+
+	err := s.execCommand(host, command, stdout, stderr)
+	result.Duration = time.Since(result.Started).Round(time.Millisecond).String()
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+	default:
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (s *SftpSender) execCommand(host, command string, stdout, stderr io.Writer) error {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	// Commands may change anything, so read-only hosts refuse them all
+	if err := s.refuseReadOnly(cred, "run commands"); err != nil {
+		return err
+	}
+	if s.execDir != "" {
+		if err := checkRemotePrefix(cred, s.execDir, "run commands in"); err != nil {
+			return err
+		}
+		command = "cd " + shellQuote(s.execDir) + " && " + command
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return s.runRemoteCommandOutput(client, host, command, stdout, stderr)
+}
+
+// safeFileName replaces characters that cannot appear in file names
+func safeFileName(name string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+}
+
+// prefixWriter writes complete lines to out with a prefix, holding back a
+// partial last line until it is finished or flushed
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.buf.Next(i + 1)
+		w.mu.Lock()
+		fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+		w.mu.Unlock()
+	}
+}
+
+func (w *prefixWriter) flush() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	w.mu.Lock()
+	fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf.Bytes())
+	w.mu.Unlock()
+	w.buf.Reset()
+}
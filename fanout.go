@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// broadcastTarget is one host of a broadcast upload
+type broadcastTarget struct {
+	host     string
+	location string
+}
+
+// fanOutPeer is a broadcast host with its open connection and final file path
+type fanOutPeer struct {
+	broadcastTarget
+	cred       *Credential
+	client     *ssh.Client
+	remotePath string
+}
+
+// broadcast uploads the same file to every target and returns the error of
+// each host (nil on success). With seeds > 0 the file is uploaded to that many
+// hosts only, which then copy it on to the others.
+func (s *SftpSender) broadcast(localPath string, targets []broadcastTarget, seeds int) map[string]error {
+	results := make(map[string]error)
+
+	info, err := os.Stat(localPath)
+	if seeds > 0 && s.dryRun {
+		logInfof("Dry run: with --fan-out, %d seed hosts would receive %s and copy it on to the others\n", min(seeds, len(targets)), localPath)
+		seeds = 0
+	}
+	if seeds > 0 && seeds < len(targets) && err == nil && !info.IsDir() {
+		s.fanOut(localPath, info.Size(), targets, seeds, results)
+		return results
+	}
+	if seeds > 0 && err == nil && info.IsDir() {
+		logWarnf("--fan-out only applies to single files, uploading %s to every host directly\n", localPath)
+	}
+
+	hosts := make([]string, len(targets))
+	for i, t := range targets {
+		hosts[i] = t.host
+	}
+	var mu sync.Mutex
+	s.forEachHost(hosts, s.parallelHosts, func(i int) {
+		t := targets[i]
+		s.hostLog(t.host).Infof("\n[%d/%d] Uploading to %s...\n", i+1, len(targets), t.host)
+		err := s.uploadHost(localPath, t.host, t.location)
+		mu.Lock()
+		results[t.host] = err
+		mu.Unlock()
+	})
+	return results
+}
+
+// fanOut uploads to the seed hosts, then lets every host holding the file copy
+// it to one more host per round, doubling the number of copies each round. A
+// temporary key pair authorizes the peer copies and is removed afterwards.
+func (s *SftpSender) fanOut(localPath string, size int64, targets []broadcastTarget, seeds int, results map[string]error) {
+	key, err := newFanOutKey()
+	if err != nil {
+		logWarnf("failed to create fan-out key, uploading directly: %v\n", err)
+		for _, t := range targets {
+			results[t.host] = s.uploadHost(localPath, t.host, t.location)
+		}
+		return
+	}
+
+	// Peer copies run at the same time, so each host's log lines get its tag
+	hosts := make([]string, len(targets))
+	for i, t := range targets {
+		hosts[i] = t.host
+	}
+	defer s.tagHosts(hosts)()
+
+	// Connect to every host and install the temporary key
+	var peers []*fanOutPeer
+	for _, t := range targets {
+		s.hostStatus(t.host, "connecting", nil)
+		peer, err := s.prepareFanOutPeer(t, localPath, key)
+		if err != nil {
+			results[t.host] = err
+			s.hostStatus(t.host, "", err)
+			continue
+		}
+		defer func() {
+			remoteRun(peer.client, key.cleanupCommand())
+			peer.client.Close()
+		}()
+		peers = append(peers, peer)
+		s.hostStatus(t.host, "waiting", nil)
+	}
+
+	var have, pending []*fanOutPeer
+	for i, peer := range peers {
+		if i >= seeds {
+			pending = append(pending, peer)
+			continue
+		}
+		s.hostLog(peer.host).Infof("\nSeeding %s...\n", peer.host)
+		if err := s.uploadHost(localPath, peer.host, peer.location); err != nil {
+			results[peer.host] = err
+			continue
+		}
+		results[peer.host] = nil
+		have = append(have, peer)
+	}
+
+	for round := 1; len(pending) > 0 && len(have) > 0; round++ {
+		n := len(have)
+		if n > len(pending) {
+			n = len(pending)
+		}
+		logInfof("\nFan-out round %d: %d peer copies\n", round, n)
+
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = s.peerCopy(have[i], pending[i], localPath, size, key)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := 0; i < n; i++ {
+			dst := pending[i]
+			if errs[i] != nil {
+				// A failed peer copy falls back to uploading from here
+				s.hostLog(dst.host).Warnf("Peer copy %s -> %s failed, uploading directly: %v\n", have[i].host, dst.host, errs[i])
+				errs[i] = s.uploadHost(localPath, dst.host, dst.location)
+			}
+			results[dst.host] = errs[i]
+			if errs[i] == nil {
+				have = append(have, dst)
+			}
+		}
+		pending = pending[n:]
+	}
+
+	// Every seed failed, so nobody can pass the file on
+	for _, peer := range pending {
+		results[peer.host] = s.uploadHost(localPath, peer.host, peer.location)
+	}
+}
+
+func (s *SftpSender) prepareFanOutPeer(t broadcastTarget, localPath string, key *fanOutKey) (*fanOutPeer, error) {
+	cred, err := s.findCredential(t.host)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.refuseReadOnly(cred, "upload"); err != nil {
+		return nil, err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return nil, err
+	}
+
+	location := t.location
+	if location == "" {
+		location = s.config.DefaultRemoteLocation
+	}
+	peer := &fanOutPeer{
+		broadcastTarget: t,
+		cred:            cred,
+		client:          client,
+		remotePath:      fmt.Sprintf("%s/%s", strings.TrimSuffix(location, "/"), s.remoteName(localPath)),
+	}
+	if err := checkRemotePrefix(cred, peer.remotePath, "upload to"); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(key.private)
+	if err := session.Run(key.installCommand()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to install fan-out key: %w", err)
+	}
+	return peer, nil
+}
+
+// peerCopy makes src copy the file to dst with scp and the temporary key.
+// scp checks dst against the host keys pinned for it here.
+func (s *SftpSender) peerCopy(src, dst *fanOutPeer, localPath string, size int64, key *fanOutKey) error {
+	start := time.Now()
+	s.hostStatus(dst.host, "from "+src.host, nil)
+	knownHosts, err := peerKnownHosts(dst)
+	if err == nil {
+		err = remoteRun(dst.client, s.remoteUmask("mkdir -p "+shellQuote(path.Dir(dst.remotePath))))
+	}
+	if err == nil {
+		host, port, splitErr := net.SplitHostPort(dst.cred.IP)
+		if splitErr != nil {
+			host, port = dst.cred.IP, "22"
+		}
+		knownHostsFile := key.remoteFile + ".known_hosts." + safeFileName(dst.host)
+		command := fmt.Sprintf("umask 077 && echo %s > %s && scp -q -i %s -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s -o BatchMode=yes -P %s %s %s",
+			shellQuote(knownHosts), shellQuote(knownHostsFile), key.remoteFile, shellQuote(knownHostsFile), port,
+			shellQuote(src.remotePath), shellQuote(dst.cred.Username+"@"+host+":"+dst.remotePath))
+		err = remoteRun(src.client, command)
+	}
+	if err == nil {
+		s.addTransferred(size)
+		s.hostLog(dst.host).Infof("✓ %s copied the file to %s\n", src.host, dst.host)
+	}
+	return s.fileDone("upload", dst.host, localPath, dst.remotePath, size, "", start, err)
+}
+
+// peerKnownHosts returns the known_hosts lines of the keys pinned for dst,
+// for the peer copying to it
+func peerKnownHosts(dst *fanOutPeer) (string, error) {
+	knownHostsMu.Lock()
+	keys, err := pinnedKeys(sshAddress(dst.cred.IP))
+	knownHostsMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no host key of %s is pinned to check the peer copy against", dst.host)
+	}
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = knownhosts.Line([]string{knownhosts.Normalize(dst.cred.IP)}, k.Key)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// fanOutKey is the temporary key pair peers use to copy to each other
+type fanOutKey struct {
+	private    string // OpenSSH private key
+	authorized string // authorized_keys line
+	marker     string // unique comment identifying the authorized_keys line
+	remoteFile string // where the private key is stored on the peers
+}
+
+func newFanOutKey() (*fanOutKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	marker := "sftpsender-fanout-" + hex.EncodeToString(id)
+
+	block, err := ssh.MarshalPrivateKey(priv, marker)
+	if err != nil {
+		return nil, err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return &fanOutKey{
+		private:    string(pem.EncodeToMemory(block)),
+		authorized: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + marker,
+		marker:     marker,
+		remoteFile: "/tmp/." + marker,
+	}, nil
+}
+
+// installCommand authorizes the public key and stores the private key read from stdin
+func (k *fanOutKey) installCommand() string {
+	return fmt.Sprintf("umask 077 && mkdir -p ~/.ssh && echo %s >> ~/.ssh/authorized_keys && cat > %s",
+		shellQuote(k.authorized), k.remoteFile)
+}
+
+// cleanupCommand removes both halves of the key and the known_hosts files
+// of the peer copies from a peer
+func (k *fanOutKey) cleanupCommand() string {
+	return fmt.Sprintf("sed -i.sftpsender '/%s/d' ~/.ssh/authorized_keys; rm -f ~/.ssh/authorized_keys.sftpsender %s %s.known_hosts.*",
+		k.marker, k.remoteFile, k.remoteFile)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// filterRule is one --include or --exclude pattern. Patterns follow rsync: a
+// trailing / matches directories only, a leading / anchors the pattern at the
+// top of the transferred directory, and patterns with a / in them match the
+// end of the relative path while others match the name. * and ? do not match
+// /, ** does.
+type filterRule struct {
+	include bool
+	pattern string
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// transferFilter is the list of rules in command-line order; the first rule
+// that matches decides, and entries no rule matches are transferred
+type transferFilter []filterRule
+
+func newFilterRule(include bool, pattern string) (filterRule, error) {
+	rule := filterRule{include: include, pattern: pattern}
+	p := pattern
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return rule, fmt.Errorf("empty filter pattern %q", pattern)
+	}
+	prefix := "(^|/)"
+	if strings.HasPrefix(p, "/") {
+		prefix = "^"
+		p = strings.TrimLeft(p, "/")
+	}
+	expr, err := globRegexp(p)
+	if err != nil {
+		return rule, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+	}
+	if rule.re, err = regexp.Compile(prefix + expr + "$"); err != nil {
+		return rule, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+	}
+	return rule, nil
+}
+
+// globRegexp translates a shell pattern into a regular expression
+func globRegexp(pattern string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed [")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// excludes reports whether the entry at the slash-separated path rel below
+// the transferred directory is filtered out. Everything below an excluded
+// directory is excluded too, as rsync does not descend into it.
+func (f transferFilter) excludes(rel string, isDir bool) bool {
+	if len(f) == 0 {
+		return false
+	}
+	rel = path.Clean(rel)
+	if rel == "." {
+		return false
+	}
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && !f.includes(rel[:i], true) {
+			return true
+		}
+	}
+	return !f.includes(rel, isDir)
+}
+
+func (f transferFilter) includes(rel string, isDir bool) bool {
+	for _, r := range f {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			return r.include
+		}
+	}
+	return true
+}
+
+// rsyncArgs passes the rules on to rsync, which understands them natively
+func (f transferFilter) rsyncArgs() []string {
+	var args []string
+	for _, r := range f {
+		if r.include {
+			args = append(args, "--include="+r.pattern)
+		} else {
+			args = append(args, "--exclude="+r.pattern)
+		}
+	}
+	return args
+}
+
+// filterFlag is --include or --exclude. Both append to the same list so the
+// rules keep the order they were given in.
+type filterFlag struct {
+	rules   *transferFilter
+	include bool
+}
+
+func (f filterFlag) String() string { return "" }
+func (f filterFlag) Type() string   { return "pattern" }
+
+func (f filterFlag) Set(pattern string) error {
+	rule, err := newFilterRule(f.include, pattern)
+	if err != nil {
+		return err
+	}
+	*f.rules = append(*f.rules, rule)
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+)
+
+// treeHashes maps the slash-separated relative path of every regular file
+// below a directory to its SHA-256
+type treeHashes map[string]string
+
+// digest hashes the sorted path and file hash list, so equal trees have equal digests
+func (t treeHashes) digest() string {
+	h := sha256.New()
+	for _, p := range slices.Sorted(maps.Keys(t)) {
+		fmt.Fprintf(h, "%s  %s\n", t[p], p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// diff lists the files of t that differ from want, are missing or are extra
+func (t treeHashes) diff(want treeHashes) (changed, missing, extra []string) {
+	for p, sum := range want {
+		switch got, ok := t[p]; {
+		case !ok:
+			missing = append(missing, p)
+		case got != sum:
+			changed = append(changed, p)
+		}
+	}
+	for p := range t {
+		if _, ok := want[p]; !ok {
+			extra = append(extra, p)
+		}
+	}
+	slices.Sort(changed)
+	slices.Sort(missing)
+	slices.Sort(extra)
+	return changed, missing, extra
+}
+
+// runFingerprint implements the "fingerprint" subcommand: it hashes a remote
+// directory on every host, on the host itself where possible, and compares
+// the result with a local directory
+func runFingerprint(args []string) error {
+	fs := pflag.NewFlagSet("fingerprint", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to check")
+	group := fs.String("group", "", "Check every host of this group")
+	remote := fs.String("remote", "", "Remote directory to fingerprint (required)")
+	list := fs.Bool("list", false, "List the files that differ on each host")
+	parallel := fs.Int("parallel", 16, "Number of hosts checked at the same time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if *remote == "" || fs.NArg() > 1 {
+		return fmt.Errorf("usage: sftpsender fingerprint (--ip hosts | --group name) --remote DIR [LOCAL_DIR]")
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	var local treeHashes
+	if fs.NArg() == 1 {
+		if local, err = localTreeHashes(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	trees := make([]treeHashes, len(hosts))
+	errs := make([]error, len(hosts))
+	s.forEachHost(hosts, *parallel, func(i int) {
+		trees[i], errs[i] = s.remoteTreeHashes(hosts[i], *remote)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tDIGEST\tFILES\tSTATUS")
+	if local != nil {
+		fmt.Fprintf(w, "local\t%s\t%d\t%s\n", local.digest()[:12], len(local), fs.Arg(0))
+	}
+	var details []string
+	failed, differ := 0, 0
+	for i, host := range hosts {
+		if errs[i] != nil {
+			failed++
+			fmt.Fprintf(w, "%s\t-\t-\terror: %v\n", host, errs[i])
+			continue
+		}
+		status := ""
+		if local != nil {
+			changed, missing, extra := trees[i].diff(local)
+			status = "up to date"
+			if n := len(changed) + len(missing) + len(extra); n > 0 {
+				differ++
+				status = fmt.Sprintf("%d changed, %d missing, %d extra", len(changed), len(missing), len(extra))
+				if *list {
+					for _, p := range changed {
+						details = append(details, fmt.Sprintf("%s: changed %s", host, p))
+					}
+					for _, p := range missing {
+						details = append(details, fmt.Sprintf("%s: missing %s", host, p))
+					}
+					for _, p := range extra {
+						details = append(details, fmt.Sprintf("%s: extra %s", host, p))
+					}
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", host, trees[i].digest()[:12], len(trees[i]), status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(details) > 0 {
+		fmt.Println()
+		fmt.Println(strings.Join(details, "\n"))
+	}
+
+	switch {
+	case failed > 0:
+		return fmt.Errorf("could not fingerprint %d of %d hosts", failed, len(hosts))
+	case differ > 0:
+		return fmt.Errorf("%d of %d hosts differ from %s", differ, len(hosts), fs.Arg(0))
+	}
+	return nil
+}
+
+// localTreeHashes hashes every regular file below dir
+func localTreeHashes(dir string) (treeHashes, error) {
+	hashes := make(treeHashes)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		hashes[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", dir, err)
+	}
+	return hashes, nil
+}
+
+// remoteTreeHashes hashes every regular file below dir on the host. The
+// hashing runs on the host with sha256sum or shasum; when that fails, for
+// example without a shell, the files are read over SFTP instead.
+func (s *SftpSender) remoteTreeHashes(host, dir string) (treeHashes, error) {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return s.clientTreeHashes(client, dir)
+}
+
+// clientTreeHashes is remoteTreeHashes over an open connection
+func (s *SftpSender) clientTreeHashes(client *ssh.Client, dir string) (treeHashes, error) {
+	command := "cd " + shellQuote(dir) + " && " +
+		"if command -v sha256sum >/dev/null 2>&1; then h=sha256sum; else h='shasum -a 256'; fi && " +
+		"find . -type f -exec $h {} +"
+	var out bytes.Buffer
+	session, err := client.NewSession()
+	if err == nil {
+		session.Stdout, session.Stderr = &out, io.Discard
+		err = session.Run(command)
+		session.Close()
+	}
+	if err == nil {
+		return parseHashList(out.String())
+	}
+
+	sftpClient, err := s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket})
+	if err != nil {
+		return nil, err
+	}
+	defer sftpClient.Close()
+	return sftpTreeHashes(sftpClient, dir)
+}
+
+// parseHashList reads sha256sum output of paths relative to the hashed directory
+func parseHashList(out string) (treeHashes, error) {
+	hashes := make(treeHashes)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("unexpected checksum output %q", line)
+		}
+		hashes[strings.TrimPrefix(name, "./")] = sum
+	}
+	return hashes, nil
+}
+
+// sftpTreeHashes hashes the files below dir by reading them over SFTP
+func sftpTreeHashes(c *sftp.Client, dir string) (treeHashes, error) {
+	hashes := make(treeHashes)
+	walker := c.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		f, err := c.Open(walker.Path())
+		if err != nil {
+			return nil, fmt.Errorf("failed to open remote file: %w", err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read remote file: %w", err)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), path.Clean(dir)), "/")
+		hashes[rel] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes, nil
+}
@@ -6,6 +6,7 @@ require (
 	github.com/pkg/sftp v1.13.10
 	github.com/spf13/pflag v1.0.10
 	golang.org/x/crypto v0.49.0
+	golang.org/x/term v0.41.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
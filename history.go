@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var defaultHistoryPath = stateFile("history.jsonl")
+
+// HistoryEntry is one recorded file transfer, stored as a JSON line in the history file
+type HistoryEntry struct {
+	Time       time.Time `json:"time"`
+	Host       string    `json:"host"`
+	Direction  string    `json:"direction"`
+	LocalPath  string    `json:"local_path"`
+	RemotePath string    `json:"remote_path"`
+	Size       int64     `json:"size"`
+	Duration   string    `json:"duration"`
+	Status     string    `json:"status"`
+	Checksum   string    `json:"checksum,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var historyMu sync.Mutex
+
+// recordTransfer appends a transfer to the history file. Failures to record are
+// reported but never fail the transfer itself.
+func (s *SftpSender) recordTransfer(direction, host, localPath, remotePath string, size int64, checksum string, start time.Time, transferErr error) {
+	if s.historyPath == "" && s.auditPath == "" {
+		return
+	}
+
+	if abs, err := filepath.Abs(localPath); err == nil {
+		localPath = abs
+	}
+
+	entry := HistoryEntry{
+		Time:       start,
+		Host:       host,
+		Direction:  direction,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		Size:       size,
+		Duration:   time.Since(start).Round(time.Millisecond).String(),
+		Status:     "success",
+		Checksum:   checksum,
+	}
+	if transferErr != nil {
+		entry.Status = "failed"
+		entry.Error = transferErr.Error()
+	}
+
+	s.audit(AuditEntry{
+		Type:       "transfer",
+		Host:       host,
+		Direction:  direction,
+		LocalPath:  localPath,
+		RemotePath: remotePath,
+		Size:       size,
+		Checksum:   checksum,
+		Status:     entry.Status,
+		Error:      entry.Error,
+	})
+
+	if s.historyPath == "" {
+		return
+	}
+	if err := appendHistory(s.historyPath, entry); err != nil {
+		s.hostLog(host).Warnf("failed to record transfer history: %v\n", err)
+	}
+}
+
+func appendHistory(historyPath string, entry HistoryEntry) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	historyPath = expandHomeDir(historyPath)
+	if err := os.MkdirAll(filepath.Dir(historyPath), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// runHistory implements the "history" subcommand
+func runHistory(args []string) error {
+	fs := pflag.NewFlagSet("history", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	historyFile := fs.String("history-file", defaultHistoryPath, "Path to the transfer history file (JSON lines)")
+	host := fs.String("host", "", "Only show transfers to/from this IP or VPS name")
+	failed := fs.Bool("failed", false, "Only show failed transfers")
+	pathFilter := fs.String("path", "", "Only show transfers whose local or remote path contains this string")
+	limit := fs.Int("limit", 0, "Only show the last N matching transfers (0 = all)")
+	asJSON := fs.Bool("json", false, "Print matching entries as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+
+	f, err := os.Open(expandHomeDir(*historyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("No transfer history recorded yet.")
+			return nil
+		}
+		return fmt.Errorf("failed to open history file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // skip corrupt lines
+		}
+		if *host != "" && entry.Host != *host {
+			continue
+		}
+		if *failed && entry.Status != "failed" {
+			continue
+		}
+		if *pathFilter != "" && !strings.Contains(entry.LocalPath, *pathFilter) && !strings.Contains(entry.RemotePath, *pathFilter) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read history file: %v", err)
+	}
+
+	if *limit > 0 && len(entries) > *limit {
+		entries = entries[len(entries)-*limit:]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tHOST\tDIRECTION\tSTATUS\tSIZE\tDURATION\tLOCAL\tREMOTE")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			e.Time.Format("2006-01-02 15:04:05"), e.Host, e.Direction, e.Status, e.Size, e.Duration, e.LocalPath, e.RemotePath)
+	}
+	return w.Flush()
+}
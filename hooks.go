@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Hooks lists external programs to run at each lifecycle point. Every program
+// receives a JSON HookEvent on stdin.
+type Hooks struct {
+	PreRun   []string `yaml:"pre_run"`
+	PreHost  []string `yaml:"pre_host"`
+	PostFile []string `yaml:"post_file"`
+	PostRun  []string `yaml:"post_run"`
+	OnError  []string `yaml:"on_error"`
+}
+
+// HookEvent is the JSON document written to a hook's stdin
+type HookEvent struct {
+	Event      string     `json:"event"`
+	Time       time.Time  `json:"time"`
+	Operation  string     `json:"operation,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	Direction  string     `json:"direction,omitempty"`
+	LocalPath  string     `json:"local_path,omitempty"`
+	RemotePath string     `json:"remote_path,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Report     *RunReport `json:"report,omitempty"`
+}
+
+func (h Hooks) commands(event string) []string {
+	switch event {
+	case "pre_run":
+		return h.PreRun
+	case "pre_host":
+		return h.PreHost
+	case "post_file":
+		return h.PostFile
+	case "post_run":
+		return h.PostRun
+	case "on_error":
+		return h.OnError
+	}
+	return nil
+}
+
+// startRun begins a run report and executes the pre_run hooks
+func (s *SftpSender) startRun(operation string) (*RunReport, error) {
+	s.operation = operation
+	if err := s.runHook(HookEvent{Event: "pre_run", Operation: operation}); err != nil {
+		return nil, err
+	}
+	report := newRunReport(operation)
+	s.handleInterrupts(report)
+	return report, nil
+}
+
+// finishRun completes the report, executes the post_run hooks and sends notifications
+func (s *SftpSender) finishRun(report *RunReport) {
+	report.finish(s)
+	s.logInterrupted(report)
+	s.runHook(HookEvent{Event: "post_run", Operation: report.Operation, Report: report})
+	if !s.dryRun {
+		s.notify(report)
+	}
+	if s.saveHosts {
+		if err := s.saveInlineHosts(); err != nil {
+			logWarnf("failed to save hosts to the config: %v\n", err)
+		}
+	}
+}
+
+// hostFailed executes the on_error hooks for a host whose transfer failed
+func (s *SftpSender) hostFailed(host string, err error) {
+	s.runHook(HookEvent{Event: "on_error", Operation: s.operation, Host: host, Error: err.Error()})
+}
+
+// runHook executes every program configured for the event. A failing pre_run or
+// pre_host hook aborts the run or host; failures of other hooks are only reported.
+func (s *SftpSender) runHook(event HookEvent) error {
+	commands := s.config.Hooks.commands(event.Event)
+	// A dry run changes nothing for hooks to react to
+	if len(commands) == 0 || s.dryRun {
+		return nil
+	}
+
+	event.Time = time.Now()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s hook event: %v", event.Event, err)
+	}
+
+	for _, command := range commands {
+		cmd := shellCommand(command)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			err = fmt.Errorf("%s hook %q failed: %v", event.Event, command, err)
+			if event.Event == "pre_run" || event.Event == "pre_host" {
+				return err
+			}
+			s.hostLog(event.Host).Warnf("%v\n", err)
+		}
+	}
+	return nil
+}
+
+// runLocalCommands runs the global and per-host pre_upload/post_download shell
+// commands with {local_path}, {remote_path} and {host} substituted. The values
+// are quoted for the shell, since remote file names are not trusted.
+func (s *SftpSender) runLocalCommands(kind string, commands []string, host, localPath, remotePath string) error {
+	replacer := strings.NewReplacer(
+		"{local_path}", localShellQuote(localPath),
+		"{remote_path}", localShellQuote(remotePath),
+		"{host}", localShellQuote(host),
+	)
+
+	for _, command := range commands {
+		if command == "" {
+			continue
+		}
+		command = replacer.Replace(command)
+		cmd := shellCommand(command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s command %q failed: %v", kind, command, err)
+		}
+	}
+	return nil
+}
+
+// localShellQuote quotes a value for the shell that shellCommand uses. cmd.exe
+// has no escape for a double quote inside quotes nor for %VAR% expansion, so
+// on Windows those characters are dropped.
+func localShellQuote(value string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + strings.NewReplacer(`"`, "", "%", "").Replace(value) + `"`
+	}
+	return shellQuote(value)
+}
+
+// shellCommand runs a command line through the platform shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
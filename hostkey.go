@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// knownHostsMu serializes reading and pinning keys in the known_hosts file
+var knownHostsMu sync.Mutex
+
+// knownHostsPath is the file holding the pinned host keys, in OpenSSH format
+func knownHostsPath() string {
+	return stateFile("known_hosts")
+}
+
+// loadKnownHosts parses the known_hosts file, creating it when missing
+func loadKnownHosts() (ssh.HostKeyCallback, error) {
+	path := knownHostsPath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create state directory: %w", err)
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			return nil, fmt.Errorf("failed to create known_hosts: %w", err)
+		}
+	}
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+	return check, nil
+}
+
+// pinnedKeys returns the keys pinned for address
+func pinnedKeys(address string) ([]knownhosts.KnownKey, error) {
+	check, err := loadKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+	// Checking a key no host has yields every pinned key of the address
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	probe, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+	var keyErr *knownhosts.KeyError
+	if err := check(address, &net.TCPAddr{}, probe.PublicKey()); errors.As(err, &keyErr) {
+		return keyErr.Want, nil
+	}
+	return nil, nil
+}
+
+// hostKeyAlgorithms restricts the handshake to the types of the keys pinned
+// for address, so a host with several keys presents the pinned one
+func hostKeyAlgorithms(address string) []string {
+	knownHostsMu.Lock()
+	keys, err := pinnedKeys(address)
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil
+	}
+	var algorithms []string
+	for _, k := range keys {
+		if t := k.Key.Type(); t == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		} else if !slices.Contains(algorithms, t) {
+			algorithms = append(algorithms, t)
+		}
+	}
+	return algorithms
+}
+
+// hostKeyCallback verifies host keys trust-on-first-use: the key a host
+// presents first is pinned in known_hosts and any later different key is
+// refused. host_key_checking: off in the config accepts every key.
+func (s *SftpSender) hostKeyCallback(cred *Credential) ssh.HostKeyCallback {
+	if s.config.HostKeyChecking == "off" {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return func(address string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+		check, err := loadKnownHosts()
+		if err != nil {
+			return err
+		}
+		err = check(address, remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			if err := pinHostKey(address, key); err != nil {
+				return err
+			}
+			logInfof("Pinned host key of %s: %s\n", credentialLabel(*cred), ssh.FingerprintSHA256(key))
+			return nil
+		case errors.As(err, &keyErr):
+			return fmt.Errorf("%w: %s presented %s, which differs from the pinned key; if the host was reinstalled, run: sftpsender hostkey accept %s",
+				err, credentialLabel(*cred), ssh.FingerprintSHA256(key), credentialLabel(*cred))
+		}
+		return err
+	}
+}
+
+// pinHostKey appends key for address to the known_hosts file
+func pinHostKey(address string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(knownHostsPath(), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to pin host key: %w", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(address)}, key))
+	return err
+}
+
+// runHostKey implements the "hostkey" subcommand: "hostkey accept HOST..."
+// replaces the pinned key of each host with the one it presents now
+func runHostKey(args []string) error {
+	fs := pflag.NewFlagSet("hostkey", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	yes := fs.BoolP("yes", "y", false, "Accept the new keys without asking")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 || fs.Arg(0) != "accept" {
+		return fmt.Errorf("usage: sftpsender hostkey accept [--yes] HOST...")
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, host := range fs.Args()[1:] {
+		if err := s.acceptHostKey(host, *yes); err != nil {
+			logErrorf("%s: %v\n", host, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not accept the key of %d hosts", failed)
+	}
+	return nil
+}
+
+// acceptHostKey shows the pinned and the presented key of host and, once
+// confirmed, replaces the pinned keys with the presented one
+func (s *SftpSender) acceptHostKey(host string, yes bool) error {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	address := sshAddress(cred.IP)
+
+	// Only the key is needed, so the handshake stops right after receiving it.
+	// A reinstalled host may offer a new key type, so any type is accepted.
+	var presented ssh.PublicKey
+	errGotKey := errors.New("got host key")
+	_, err = s.dialSSHWith(cred, func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		presented = key
+		return errGotKey
+	}, false)
+	if presented == nil {
+		return fmt.Errorf("failed to get the host key: %w", err)
+	}
+
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	old, err := pinnedKeys(address)
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		if bytes.Equal(k.Key.Marshal(), presented.Marshal()) {
+			logInfof("%s: the presented key %s is already pinned\n", host, ssh.FingerprintSHA256(presented))
+			return nil
+		}
+	}
+
+	fmt.Printf("%s (%s)\n", host, address)
+	for _, k := range old {
+		fmt.Printf("  pinned: %s %s (%s:%d)\n", k.Key.Type(), ssh.FingerprintSHA256(k.Key), k.Filename, k.Line)
+	}
+	fmt.Printf("  new:    %s %s\n", presented.Type(), ssh.FingerprintSHA256(presented))
+	if !yes {
+		if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return fmt.Errorf("not on a terminal, use --yes to accept without asking")
+		}
+		fmt.Fprint(os.Stderr, "Replace the pinned key? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("not accepted")
+		}
+	}
+
+	if err := removeKnownHostLines(old); err != nil {
+		return err
+	}
+	if err := pinHostKey(address, presented); err != nil {
+		return err
+	}
+	logInfof("%s: pinned %s\n", host, ssh.FingerprintSHA256(presented))
+	return nil
+}
+
+// removeKnownHostLines deletes the lines of the given keys from known_hosts
+func removeKnownHostLines(keys []knownhosts.KnownKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	path := knownHostsPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	var kept []string
+	for i, line := range lines {
+		if !slices.ContainsFunc(keys, func(k knownhosts.KnownKey) bool { return k.Line == i+1 }) {
+			kept = append(kept, line)
+		}
+	}
+	return os.WriteFile(path, []byte(strings.Join(kept, "")), 0600)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// Hosts that are not in the config can be given inline, scp-style as
+// user[:password]@host[:port][:path] or with --user and --ask-pass. Their
+// credentials live for the run only unless --save-host writes the ones that
+// logged in back to the config.
+
+// inlineHosts tracks the credentials registered for inline hosts
+type inlineHosts struct {
+	mu    sync.Mutex
+	creds []Credential
+	ok    map[string]bool // by inlineKey, hosts logged in to
+}
+
+func inlineKey(cred *Credential) string {
+	return cred.Username + "@" + cred.IP
+}
+
+func (h *inlineHosts) add(cred Credential) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.creds = append(h.creds, cred)
+}
+
+func (h *inlineHosts) has(cred *Credential) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.creds {
+		if inlineKey(&c) == inlineKey(cred) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedIn records a successful login with cred if it is an inline one
+func (h *inlineHosts) loggedIn(cred *Credential) {
+	if !h.has(cred) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ok == nil {
+		h.ok = make(map[string]bool)
+	}
+	h.ok[inlineKey(cred)] = true
+}
+
+// parseInlineTarget splits an scp-style user[:password]@host[:port][:path]
+// target into an sftp URL for urlCredential and the path. A password must
+// not contain a /; use an sftp:// URL with percent-encoding for those.
+func parseInlineTarget(target string) (*url.URL, string, bool) {
+	if strings.HasPrefix(target, "sftp://") {
+		return nil, "", false
+	}
+	head := target
+	if i := strings.IndexByte(target, '/'); i >= 0 {
+		head = target[:i]
+	}
+	at := strings.LastIndexByte(head, '@')
+	if at <= 0 {
+		return nil, "", false
+	}
+	host, location, _ := strings.Cut(target[at+1:], ":")
+	if port, rest, _ := strings.Cut(location, ":"); isPort(port) {
+		host, location = host+":"+port, rest
+	}
+	if host == "" {
+		return nil, "", false
+	}
+
+	u := &url.URL{Scheme: "sftp", Host: host}
+	if username, password, ok := strings.Cut(target[:at], ":"); ok {
+		u.User = url.UserPassword(username, password)
+	} else {
+		u.User = url.User(username)
+	}
+	return u, location, true
+}
+
+func isPort(s string) bool {
+	if s == "" || len(s) > 5 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// addInlineHosts gives the hosts of --ip that are not in the config the user
+// of --user and the password of --ask-pass. Inline user@host targets without
+// a password get the password too.
+func (s *SftpSender) addInlineHosts(ips, username string, askPass bool) error {
+	var password string
+	if askPass {
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return fmt.Errorf("--ask-pass needs a terminal")
+		}
+		fmt.Fprint(os.Stderr, "SSH password: ")
+		p, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		password = string(p)
+	}
+	if username == "" {
+		// Like ssh, fall back to the local user name
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+
+	for _, target := range strings.Split(ips, ",") {
+		host, _, err := s.resolveTarget(strings.TrimSpace(target))
+		if err != nil {
+			return err
+		}
+		if cred, err := s.findCredential(host); err == nil {
+			if password == "" || cred.Password != "" || !s.inline.has(cred) {
+				continue
+			}
+			for i := range s.config.Credentials {
+				if c := &s.config.Credentials[i]; c.Name == host {
+					c.Password = password
+				}
+			}
+			continue
+		}
+		cred := Credential{IP: host, Username: username, Password: password}
+		s.config.Credentials = append(s.config.Credentials, cred)
+		s.inline.add(cred)
+	}
+	return nil
+}
+
+// saveInlineHosts adds the inline hosts that were logged in to to the
+// credentials of the config file, named by their host. Hosts already in
+// the file are left alone. The previous file is kept as config.yaml.bak since
+// comments are not preserved.
+func (s *SftpSender) saveInlineHosts() error {
+	// The config holds the credentials as completed by addInlineHosts
+	s.inline.mu.Lock()
+	var save []Credential
+	for _, cred := range s.config.Credentials {
+		if s.inline.ok[inlineKey(&cred)] {
+			save = append(save, cred)
+			delete(s.inline.ok, inlineKey(&cred))
+		}
+	}
+	s.inline.mu.Unlock()
+	if len(save) == 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+	i := 0
+	for i < len(config) && config[i].Key != "credentials" {
+		i++
+	}
+	if i == len(config) {
+		config = append(config, yaml.MapItem{Key: "credentials"})
+	}
+	entries, _ := config[i].Value.([]interface{})
+
+	added := 0
+	for _, cred := range save {
+		if hasCredentialEntry(entries, cred) {
+			continue
+		}
+		// An IP with a port cannot be combined with a :path in --ip, the
+		// bare host name can
+		var fields yaml.MapSlice
+		if name := hostOnly(cred.IP); !hasNameEntry(entries, name) {
+			fields = append(fields, yaml.MapItem{Key: "name", Value: name})
+		}
+		fields = append(fields, yaml.MapItem{Key: "ip", Value: cred.IP}, yaml.MapItem{Key: "username", Value: cred.Username})
+		if cred.Password != "" {
+			fields = append(fields, yaml.MapItem{Key: "password", Value: cred.Password})
+		}
+		entries = append(entries, fields)
+		added++
+		logInfof("Saving %s to %s\n", inlineKey(&cred), s.configPath)
+	}
+	if added == 0 {
+		return nil
+	}
+	config[i].Value = entries
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config file: %w", err)
+	}
+	if err := os.WriteFile(s.configPath+".bak", data, 0600); err != nil {
+		return fmt.Errorf("failed to back up config file: %w", err)
+	}
+	if err := os.WriteFile(s.configPath, out, 0600); err != nil {
+		return err
+	}
+	if strings.Contains(string(data), encPrefix) {
+		logWarnf("The saved passwords are not encrypted, run sftpsender config encrypt\n")
+	}
+	return nil
+}
+
+// hasCredentialEntry reports whether the config entries have one with
+// the IP and user name of cred
+func hasCredentialEntry(entries []interface{}, cred Credential) bool {
+	for _, entry := range entries {
+		fields, ok := entry.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		var ip, username string
+		for _, f := range fields {
+			switch f.Key {
+			case "ip":
+				ip = fmt.Sprint(f.Value)
+			case "username":
+				username = fmt.Sprint(f.Value)
+			}
+		}
+		if ip == cred.IP && cmp.Or(username, cred.Username) == cred.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNameEntry reports whether one of the config entries is called name
+func hasNameEntry(entries []interface{}, name string) bool {
+	for _, entry := range entries {
+		fields, _ := entry.(yaml.MapSlice)
+		for _, f := range fields {
+			if f.Key == "name" && fmt.Sprint(f.Value) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hostOnly returns the host of an IP that may carry a port
+func hostOnly(ip string) string {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
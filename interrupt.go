@@ -0,0 +1,141 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// interruptState tracks Ctrl-C handling: the first interrupt stops new files
+// from starting and lets the ones in flight finish, a second one aborts them
+// and runs the registered cleanups before exiting. Reaching the deadline of
+// --max-total-time aborts the same way.
+type interruptState struct {
+	once        sync.Once
+	abortOnce   sync.Once
+	interrupted atomic.Bool
+	deadline    time.Time
+
+	mu       sync.Mutex
+	next     int
+	cleanups map[int]abortCleanup
+}
+
+// abortCleanupTimeout bounds the cleanups of an aborted run together
+const abortCleanupTimeout = 10 * time.Second
+
+// abortCleanup undoes the side effects of an in-flight operation, such as a
+// partially written file, when the run is aborted
+type abortCleanup struct {
+	desc string
+	fn   func() error
+}
+
+// handleInterrupts installs the SIGINT/SIGTERM handler for the run of report
+func (s *SftpSender) handleInterrupts(report *RunReport) {
+	s.interrupts.once.Do(func() {
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			s.interrupts.interrupted.Store(true)
+			logWarnf("Interrupted: finishing the files in progress, no new files are started (press Ctrl-C again to abort them)\n")
+			<-signals
+			s.abortRun(report, ErrInterrupted, 130)
+		}()
+
+		if s.maxTotalTime > 0 {
+			s.interrupts.deadline = time.Now().Add(s.maxTotalTime)
+			time.AfterFunc(s.maxTotalTime, func() {
+				s.interrupts.interrupted.Store(true)
+				logWarnf("--max-total-time of %s reached\n", s.maxTotalTime)
+				s.abortRun(report, ErrRunTimeLimit, 1)
+			})
+		}
+	})
+}
+
+// interrupted reports whether the run was interrupted and must not start new files
+func (s *SftpSender) interrupted() bool {
+	return s.interrupts.interrupted.Load()
+}
+
+// onAbort registers a cleanup to run if the run is aborted while the
+// operation is in flight; the returned function unregisters it
+func (s *SftpSender) onAbort(desc string, fn func() error) func() {
+	st := &s.interrupts
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.cleanups == nil {
+		st.cleanups = make(map[int]abortCleanup)
+	}
+	id := st.next
+	st.next++
+	st.cleanups[id] = abortCleanup{desc: desc, fn: fn}
+	return func() {
+		st.mu.Lock()
+		delete(st.cleanups, id)
+		st.mu.Unlock()
+	}
+}
+
+// abortRun cleans up after the operations still in flight, records cause in
+// the report and exits with code, 130 being the conventional status for SIGINT
+func (s *SftpSender) abortRun(report *RunReport, cause error, code int) {
+	first := false
+	s.interrupts.abortOnce.Do(func() { first = true })
+	if !first {
+		return
+	}
+	s.stopDashboard()
+	logWarnf("Aborting, cleaning up transfers in progress\n")
+
+	st := &s.interrupts
+	st.mu.Lock()
+	cleanups := st.cleanups
+	st.cleanups = nil
+	st.mu.Unlock()
+	ids := slices.Sorted(maps.Keys(cleanups))
+	slices.Reverse(ids) // newest first, like deferred calls
+	// A cleanup over a stalled connection would block the exit forever
+	timeout := time.After(abortCleanupTimeout)
+	timedOut := false
+	for _, id := range ids {
+		c := cleanups[id]
+		if timedOut {
+			logWarnf("not removing %s, cleanup took longer than %s\n", c.desc, abortCleanupTimeout)
+			continue
+		}
+		done := make(chan error, 1)
+		go func() { done <- c.fn() }()
+		select {
+		case err := <-done:
+			if err != nil && !os.IsNotExist(err) {
+				logWarnf("failed to remove %s: %v\n", c.desc, err)
+			} else {
+				logInfof("Removed %s\n", c.desc)
+			}
+		case <-timeout:
+			timedOut = true
+			logWarnf("gave up removing %s after %s\n", c.desc, abortCleanupTimeout)
+		}
+	}
+
+	report.Errors = append(report.Errors, cause.Error())
+	s.finishRun(report)
+	os.Exit(code)
+}
+
+// logInterrupted prints what an interrupted run completed
+func (s *SftpSender) logInterrupted(report *RunReport) {
+	if !s.interrupted() {
+		return
+	}
+	logWarnf("Run interrupted: %d files (%s) completed before the interruption\n",
+		report.Files, formatBytes(report.Bytes))
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Job is a declarative pipeline run by "sftpsender run job.yaml". Host steps
+// (upload, exec, wait, collect) run on every host of the job concurrently;
+// local steps (split, merge) run once on this machine.
+type Job struct {
+	Name         string            `yaml:"name"`
+	Config       string            `yaml:"config"` // sftpsender config, default $XDG_CONFIG_HOME/sftpsender/config.yaml
+	Vars         map[string]string `yaml:"vars"`   // available as {name} in templates
+	Hosts        JobHosts          `yaml:"hosts"`
+	Parallel     int               `yaml:"parallel"`       // hosts handled at the same time, default 16
+	Retries      int               `yaml:"retries"`        // retries of uploads and collects failing with transient errors
+	RetryBudget  int               `yaml:"retry_budget"`   // retries allowed across all hosts together, 0 = no limit
+	MaxTotalTime string            `yaml:"max_total_time"` // abort the job after this long, e.g. 8h
+	Breaker      *JobBreaker       `yaml:"breaker"`
+	Steps        []JobStep         `yaml:"steps"`
+}
+
+// JobHosts selects the hosts of a job by group and/or explicit names or IPs
+type JobHosts struct {
+	Group string   `yaml:"group"`
+	IPs   []string `yaml:"ips"`
+}
+
+// JobBreaker overrides the circuit breaker settings, default 5 failures and 5m
+type JobBreaker struct {
+	Threshold int    `yaml:"threshold"` // consecutive failures that pause a host, 0 disables
+	Cooldown  string `yaml:"cooldown"`
+}
+
+// JobStep is one pipeline step; exactly one of the action fields is set
+type JobStep struct {
+	Name            string        `yaml:"name"`
+	Split           *SplitStep    `yaml:"split"`
+	Upload          *TransferStep `yaml:"upload"`
+	Exec            string        `yaml:"exec"`
+	Wait            *WaitStep     `yaml:"wait"`
+	Collect         *TransferStep `yaml:"collect"`
+	Merge           *MergeStep    `yaml:"merge"`
+	ContinueOnError bool          `yaml:"continue_on_error"`
+}
+
+// SplitStep splits a local file by lines into one part per host; Output is a
+// template such as chunks/targets_{index}.txt
+type SplitStep struct {
+	Input  string `yaml:"input"`
+	Output string `yaml:"output"`
+}
+
+// TransferStep copies Path to the directory To. For upload Path is local and To
+// remote, for collect the other way round.
+type TransferStep struct {
+	Path string `yaml:"path"`
+	To   string `yaml:"to"`
+}
+
+// WaitStep polls a remote shell condition until it succeeds on every host
+type WaitStep struct {
+	For      string `yaml:"for"`
+	Interval string `yaml:"interval"` // default 10s
+	Timeout  string `yaml:"timeout"`  // default no limit
+}
+
+// MergeStep concatenates the local files matching the Inputs glob into Output
+type MergeStep struct {
+	Inputs string `yaml:"inputs"`
+	Output string `yaml:"output"`
+	Unique bool   `yaml:"unique"` // drop duplicate lines, keeping the first
+}
+
+// kind returns the action of the step
+func (st JobStep) kind() string {
+	switch {
+	case st.Split != nil:
+		return "split"
+	case st.Upload != nil:
+		return "upload"
+	case st.Exec != "":
+		return "exec"
+	case st.Wait != nil:
+		return "wait"
+	case st.Collect != nil:
+		return "collect"
+	case st.Merge != nil:
+		return "merge"
+	}
+	return ""
+}
+
+// runJob implements the "run" subcommand
+func runJob(args []string) error {
+	fs := pflag.NewFlagSet("run", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", "", "Path to config file, overrides the job's config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sftpsender run job.yaml")
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read job file: %v", err)
+	}
+	var job Job
+	if err := yaml.UnmarshalStrict(data, &job); err != nil {
+		return fmt.Errorf("failed to parse job file: %v", err)
+	}
+	for i, st := range job.Steps {
+		if st.kind() == "" {
+			return fmt.Errorf("step %d has no action (split, upload, exec, wait, collect or merge)", i+1)
+		}
+	}
+
+	cfg := job.Config
+	if *configPath != "" {
+		cfg = *configPath
+	}
+	if cfg == "" {
+		cfg = defaultConfigPath
+	}
+	s, err := NewSftpSender(cfg)
+	if err != nil {
+		return err
+	}
+	s.historyPath = defaultHistoryPath
+	s.auditPath = s.config.AuditLog
+	s.retries = job.Retries
+	s.retryBudget = job.RetryBudget
+	if job.MaxTotalTime != "" {
+		if s.maxTotalTime, err = time.ParseDuration(job.MaxTotalTime); err != nil {
+			return fmt.Errorf("invalid max_total_time: %v", err)
+		}
+	}
+	if job.Breaker != nil {
+		s.breakerThreshold = job.Breaker.Threshold
+		if job.Breaker.Cooldown != "" {
+			if s.breakerCooldown, err = time.ParseDuration(job.Breaker.Cooldown); err != nil {
+				return fmt.Errorf("invalid breaker cooldown: %v", err)
+			}
+		}
+	}
+
+	hosts, err := s.selectHosts(strings.Join(job.Hosts.IPs, ","), job.Hosts.Group)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.startRun("run")
+	if err != nil {
+		return err
+	}
+	report.Hosts = hosts
+	err = s.runJobSteps(&job, hosts)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	s.finishRun(report)
+	s.logTrippedHosts()
+	if err != nil {
+		return err
+	}
+	logInfof("\nJob %s completed successfully!\n", job.Name)
+	return nil
+}
+
+func (s *SftpSender) runJobSteps(job *Job, hosts []string) error {
+	for i, st := range job.Steps {
+		title := st.Name
+		if title == "" {
+			title = st.kind()
+		}
+		if s.interrupted() {
+			return fmt.Errorf("step %d (%s) not started: %w", i+1, title, ErrInterrupted)
+		}
+		logGroupStart(fmt.Sprintf("Step %d/%d: %s", i+1, len(job.Steps), title))
+		logInfof("\n=== Step %d/%d: %s ===\n", i+1, len(job.Steps), title)
+		err := s.runJobStep(job, st, hosts)
+		logGroupEnd()
+
+		if err != nil {
+			if !st.ContinueOnError {
+				return fmt.Errorf("step %d (%s) failed: %v", i+1, title, err)
+			}
+			logWarnf("step %d (%s) failed, continuing: %v\n", i+1, title, err)
+		}
+	}
+	return nil
+}
+
+func (s *SftpSender) runJobStep(job *Job, st JobStep, hosts []string) error {
+	switch st.kind() {
+	case "split":
+		return splitLines(job.expand(st.Split.Input, "", 0, len(hosts)), len(hosts), func(i int) string {
+			return job.expand(st.Split.Output, hosts[i], i+1, len(hosts))
+		})
+	case "merge":
+		return mergeFiles(job.expand(st.Merge.Inputs, "", 0, len(hosts)), job.expand(st.Merge.Output, "", 0, len(hosts)), st.Merge.Unique)
+	}
+
+	// Host steps run on every host, up to job.Parallel at a time
+	parallel := job.Parallel
+	if parallel <= 0 {
+		parallel = 16
+	}
+	width := 0
+	for _, h := range hosts {
+		width = max(width, len(h))
+	}
+	color := useColor()
+
+	defer s.tagHosts(hosts)()
+	var mu sync.Mutex
+	var failed []string
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			prefix := hostPrefix(host, width, color)
+			expand := func(t string) string { return job.expand(t, host, i+1, len(hosts)) }
+			if err := s.runHostStep(st, host, prefix, expand, &mu); err != nil {
+				mu.Lock()
+				failed = append(failed, host)
+				s.hostLog(host).Errorf("%v\n", err)
+				mu.Unlock()
+				s.hostFailed(host, err)
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed on %d of %d hosts: %s", len(failed), len(hosts), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (s *SftpSender) runHostStep(st JobStep, host, prefix string, expand func(string) string, outMu *sync.Mutex) error {
+	switch st.kind() {
+	case "upload":
+		return s.retry(host, func() error { return s.Upload(expand(st.Upload.Path), host, expand(st.Upload.To)) })
+	case "collect":
+		localDir := expand(st.Collect.To)
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			return fmt.Errorf("failed to create local directory: %v", err)
+		}
+		return s.retry(host, func() error { return s.Download(expand(st.Collect.Path), host, localDir) })
+	case "exec":
+		stdout := &prefixWriter{prefix: prefix, out: os.Stdout, mu: outMu}
+		stderr := &prefixWriter{prefix: prefix, out: os.Stderr, mu: outMu}
+		defer stdout.flush()
+		defer stderr.flush()
+		return s.guarded(host, func() error { return s.execCommand(host, expand(st.Exec), stdout, stderr) })
+	case "wait":
+		return s.guarded(host, func() error { return s.waitFor(host, expand(st.Wait.For), st.Wait) })
+	}
+	return nil
+}
+
+// waitFor polls the condition on the host until it exits successfully
+func (s *SftpSender) waitFor(host, condition string, w *WaitStep) error {
+	interval := 10 * time.Second
+	if w.Interval != "" {
+		d, err := time.ParseDuration(w.Interval)
+		if err != nil {
+			return fmt.Errorf("invalid wait interval: %v", err)
+		}
+		interval = d
+	}
+	var deadline time.Time
+	if w.Timeout != "" {
+		d, err := time.ParseDuration(w.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid wait timeout: %v", err)
+		}
+		deadline = time.Now().Add(d)
+	}
+
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for {
+		if remoteRun(client, condition) == nil {
+			s.hostLog(host).Infof("%s: ready\n", host)
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("timed out waiting for %q", condition)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// expand fills in the job's vars, {host}, {index} (1-based) and {count}
+func (j *Job) expand(template, host string, index, count int) string {
+	builtin := strings.NewReplacer("{host}", host, "{index}", strconv.Itoa(index), "{count}", strconv.Itoa(count))
+	var pairs []string
+	for k, v := range j.Vars {
+		// Vars may use the built-in placeholders themselves
+		pairs = append(pairs, "{"+k+"}", builtin.Replace(v))
+	}
+	return builtin.Replace(strings.NewReplacer(pairs...).Replace(template))
+}
+
+// splitLines writes the lines of input into n contiguous parts of near equal size
+func splitLines(input string, n int, output func(i int) string) error {
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", input, err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(lines)-start)/(n-i)
+		path := output(i)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(lines[start:end], "")), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		logInfof("%s: %d lines\n", path, end-start)
+		start = end
+	}
+	return nil
+}
+
+// mergeFiles concatenates the lines of every file matching pattern into output
+func mergeFiles(pattern, output string, unique bool) error {
+	inputs, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid merge pattern: %v", err)
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("no files match %s", pattern)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	seen := make(map[string]bool)
+	total := 0
+	for _, input := range inputs {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if unique {
+				if seen[line] {
+					continue
+				}
+				seen[line] = true
+			}
+			w.WriteString(line + "\n")
+			total++
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read %s: %v", input, err)
+		}
+	}
+	logInfof("Merged %d files into %s (%d lines)\n", len(inputs), output, total)
+	return w.Flush()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxJumps limits jump_host chains, catching hosts that jump through each other
+const maxJumps = 8
+
+// jumpConn is a connection tunneled through a jump host; closing it also
+// closes the connection to the jump host
+type jumpConn struct {
+	net.Conn
+	bastion *ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.bastion.Close()
+	return err
+}
+
+// dialJump connects to address through the jump host of cred, like ssh -J.
+// The jump host may have a jump_host of its own.
+func (s *SftpSender) dialJump(cred *Credential, address string) (net.Conn, error) {
+	hop := cred
+	for i := 0; hop.JumpHost != ""; i++ {
+		if i == maxJumps {
+			return nil, fmt.Errorf("jump_host of %s loops or is longer than %d hops", cred.JumpHost, maxJumps)
+		}
+		next, err := s.findCredential(hop.JumpHost)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump_host: %w", err)
+		}
+		hop = next
+	}
+
+	bastion, err := s.findCredential(cred.JumpHost)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.dialSSH(bastion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to jump host %s: %w", cred.JumpHost, err)
+	}
+	conn, err := client.Dial("tcp", address)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("jump host %s could not reach %s: %w", cred.JumpHost, address, err)
+	}
+	return &jumpConn{Conn: conn, bastion: client}, nil
+}
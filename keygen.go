@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// runKeygen implements the "keygen" subcommand: it creates an ed25519 key
+// pair and with --deploy installs it on the selected hosts and switches their
+// credentials to key authentication
+func runKeygen(args []string) error {
+	fs := pflag.NewFlagSet("keygen", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	keyPath := fs.String("key", "~/.config/sftpsender/id_ed25519", "Private key file; an existing key is reused")
+	deploy := fs.Bool("deploy", false, "Install the public key on the selected hosts and set identity_file in the config")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to deploy to")
+	group := fs.String("group", "", "Deploy to every host of this group")
+	removePasswords := fs.Bool("remove-passwords", false, "With --deploy, remove the password of every host switched to the key from the config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+
+	signer, publicKey, err := loadOrCreateKey(expandHomeDir(*keyPath))
+	if err != nil {
+		return err
+	}
+	if !*deploy {
+		fmt.Print(publicKey)
+		return nil
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	s.auditPath = s.config.AuditLog
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	var deployed []*Credential
+	for _, host := range hosts {
+		cred, err := s.deployKey(host, publicKey, signer)
+		if err != nil {
+			logErrorf("✗ %s: %v\n", host, err)
+			continue
+		}
+		logInfof("✓ %s: key installed and verified\n", host)
+		deployed = append(deployed, cred)
+	}
+
+	if len(deployed) > 0 {
+		if err := switchToKeyAuth(expandHomeDir(*configPath), deployed, *keyPath, *removePasswords); err != nil {
+			return err
+		}
+		logInfof("Updated %d credentials in %s to use %s\n", len(deployed), *configPath, *keyPath)
+	}
+	if len(deployed) < len(hosts) {
+		return fmt.Errorf("key deployment failed on %d of %d hosts", len(hosts)-len(deployed), len(hosts))
+	}
+	return nil
+}
+
+// loadOrCreateKey reads the private key at keyPath, generating an ed25519 key
+// pair (keyPath and keyPath.pub) first if it does not exist
+func loadOrCreateKey(keyPath string) (ssh.Signer, string, error) {
+	data, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to generate key: %w", err)
+		}
+		hostname, _ := os.Hostname()
+		block, err := ssh.MarshalPrivateKey(private, "sftpsender@"+hostname)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode key: %w", err)
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return nil, "", fmt.Errorf("failed to create key directory: %w", err)
+		}
+		if err := os.WriteFile(keyPath, data, 0600); err != nil {
+			return nil, "", fmt.Errorf("failed to write private key: %w", err)
+		}
+		logInfof("Generated ed25519 key %s\n", keyPath)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to read key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s: %w", keyPath, err)
+	}
+	publicKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if _, err := os.Stat(keyPath + ".pub"); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile(keyPath+".pub", []byte(publicKey), 0644); err != nil {
+			return nil, "", fmt.Errorf("failed to write public key: %w", err)
+		}
+	}
+	return signer, publicKey, nil
+}
+
+// deployKey appends the public key to the host's authorized_keys using its
+// current credentials, then checks that the key alone logs in
+func (s *SftpSender) deployKey(host, publicKey string, signer ssh.Signer) (*Credential, error) {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.refuseReadOnly(cred, "install a key"); err != nil {
+		return nil, err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return nil, err
+	}
+	key := shellQuote(strings.TrimSpace(publicKey))
+	command := "umask 077 && mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys && " +
+		"(grep -qxF " + key + " ~/.ssh/authorized_keys || echo " + key + " >> ~/.ssh/authorized_keys)"
+	err = s.runRemoteCommandOutput(client, host, command, os.Stdout, os.Stderr)
+	client.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to install key: %w", err)
+	}
+
+	keyOnly := *cred
+	keyOnly.Password = ""
+	keyOnly.signer = signer
+	client, err = s.getSSHClient(&keyOnly)
+	if err != nil {
+		return nil, fmt.Errorf("key installed but logging in with it failed: %w", err)
+	}
+	client.Close()
+	return cred, nil
+}
+
+// switchToKeyAuth sets identity_file on the deployed credentials of the config
+// file, optionally removing their passwords. The previous file is kept as
+// config.yaml.bak since comments are not preserved.
+func switchToKeyAuth(configPath string, deployed []*Credential, keyPath string, removePasswords bool) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	for _, item := range config {
+		if item.Key != "credentials" {
+			continue
+		}
+		entries, _ := item.Value.([]interface{})
+		for i, entry := range entries {
+			fields, ok := entry.(yaml.MapSlice)
+			if !ok || !isDeployed(fields, deployed) {
+				continue
+			}
+			fields = setField(fields, "identity_file", keyPath)
+			if removePasswords {
+				fields = removeField(fields, "password")
+			}
+			entries[i] = fields
+		}
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config file: %w", err)
+	}
+	if err := os.WriteFile(configPath+".bak", data, 0600); err != nil {
+		return fmt.Errorf("failed to back up config file: %w", err)
+	}
+	return os.WriteFile(configPath, out, 0600)
+}
+
+// isDeployed reports whether a config credential entry is one of the deployed ones
+func isDeployed(fields yaml.MapSlice, deployed []*Credential) bool {
+	var name, ip string
+	for _, f := range fields {
+		switch f.Key {
+		case "name":
+			name = fmt.Sprint(f.Value)
+		case "ip":
+			ip = fmt.Sprint(f.Value)
+		}
+	}
+	for _, cred := range deployed {
+		if cred.IP == ip && cred.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func setField(fields yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i := range fields {
+		if fields[i].Key == key {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, yaml.MapItem{Key: key, Value: value})
+}
+
+func removeField(fields yaml.MapSlice, key string) yaml.MapSlice {
+	for i := range fields {
+		if fields[i].Key == key {
+			return append(fields[:i], fields[i+1:]...)
+		}
+	}
+	return fields
+}
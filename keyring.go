@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyringResolve reads a "keyring:<service>/<account>" password from the OS
+// keyring with the keyringGet of the platform
+func keyringResolve(ref string) (string, error) {
+	service, account, ok := strings.Cut(ref, "/")
+	if !ok || service == "" || account == "" {
+		return "", fmt.Errorf("keyring references must look like keyring:<service>/<account>")
+	}
+	return keyringGet(service, account)
+}
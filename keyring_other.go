@@ -0,0 +1,23 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// keyringGet reads a password from the Secret Service (GNOME Keyring,
+// KWallet) with secret-tool, as stored by
+// secret-tool store --label=... service SERVICE username ACCOUNT
+func keyringGet(service, account string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "username", account).Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("secret-tool is not installed (libsecret-tools)")
+	}
+	if err != nil || len(out) == 0 {
+		return "", fmt.Errorf("no password for service %q and account %q in the keyring", service, account)
+	}
+	return string(out), nil
+}
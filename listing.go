@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// remoteListing caches remote directory listings so that checking many files
+// costs one ReadDir round trip per directory instead of one Stat per file
+type remoteListing struct {
+	client *sftp.Client
+
+	mu   sync.Mutex
+	dirs map[string]map[string]os.FileInfo
+}
+
+func newRemoteListing(client *sftp.Client) *remoteListing {
+	return &remoteListing{client: client, dirs: make(map[string]map[string]os.FileInfo)}
+}
+
+// lookup returns the remote file info for remotePath, if the file exists
+func (l *remoteListing) lookup(remotePath string) (os.FileInfo, bool) {
+	dir, name := path.Split(remotePath)
+	dir = path.Clean(dir)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, ok := l.dirs[dir]
+	if !ok {
+		entries = make(map[string]os.FileInfo)
+		// A missing or unreadable directory simply has no existing files
+		if infos, err := l.client.ReadDir(dir); err == nil {
+			for _, info := range infos {
+				entries[info.Name()] = info
+			}
+		}
+		l.dirs[dir] = entries
+	}
+
+	info, ok := entries[name]
+	return info, ok
+}
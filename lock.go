@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// lockDestination takes the local lock of a transfer destination so that
+// overlapping sftpsender runs (e.g. cron jobs) cannot write it at the same
+// time. It waits up to s.lockWait for another run to finish.
+func (s *SftpSender) lockDestination(key string) (func(), error) {
+	dir := stateFile("locks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(key))
+	lockPath := filepath.Join(dir, hex.EncodeToString(sum[:8])+".lock")
+
+	deadline := time.Now().Add(s.lockWait)
+	for {
+		f, err := openLockFile(lockPath)
+		if err == nil {
+			ok, lockErr := tryLockFile(f)
+			if ok {
+				f.Truncate(0)
+				fmt.Fprintf(f, "%d %s\n", os.Getpid(), key)
+				forget := func() {}
+				if !flockSupported {
+					forget = s.onAbort("lock file "+lockPath, func() error { return os.Remove(lockPath) })
+				}
+				return func() {
+					forget()
+					unlockFile(f)
+					f.Close()
+					if !flockSupported {
+						os.Remove(lockPath)
+					}
+				}, nil
+			}
+			f.Close()
+			if lockErr != nil {
+				return nil, fmt.Errorf("failed to lock %s: %w", lockPath, lockErr)
+			}
+		} else if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to open lock file: %w", err)
+		}
+
+		if !time.Now().Before(deadline) {
+			owner, _ := os.ReadFile(lockPath)
+			pid, _, _ := strings.Cut(strings.TrimSpace(string(owner)), " ")
+			return nil, fmt.Errorf("%s is being written by another sftpsender run (pid %s, lock %s)", key, pid, lockPath)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// remoteLockDir creates <remotePath>.sftpsender-lock on the host with an atomic
+// mkdir, so runs from different machines don't write the destination at once
+func (s *SftpSender) remoteLockDir(client *ssh.Client, remotePath string) (func(), error) {
+	lockDir := remotePath + ".sftpsender-lock"
+	hostname, _ := os.Hostname()
+	command := fmt.Sprintf("mkdir -p %s && mkdir %s && echo %s > %s/owner",
+		shellQuote(path.Dir(remotePath)), shellQuote(lockDir),
+		shellQuote(hostname+" "+strconv.Itoa(os.Getpid())), shellQuote(lockDir))
+
+	deadline := time.Now().Add(s.lockWait)
+	for remoteRun(client, command) != nil {
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s is locked by another sftpsender run (remove %s if it is stale)", remotePath, lockDir)
+		}
+		time.Sleep(time.Second)
+	}
+	release := func() error { return remoteRun(client, "rm -rf "+shellQuote(lockDir)) }
+	forget := s.onAbort("remote lock "+lockDir, release)
+	return func() {
+		forget()
+		release()
+	}, nil
+}
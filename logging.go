@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// syslogWriter is the subset of *syslog.Writer used for the syslog log target
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Crit(m string) error
+}
+
+// sysLog is set when --log-target syslog is active; nil means terminal output
+var sysLog syslogWriter
+
+// ciMode emits line-oriented output with GitHub Actions annotations (--ci)
+var ciMode bool
+
+// Log levels of --log-level, messages below logLevel are dropped
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevel = levelInfo
+
+// parseLogLevel parses a --log-level value
+func parseLogLevel(level string) (int, error) {
+	switch level {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s (expected debug, info, warn or error)", level)
+}
+
+// logOptions are the --log-level and --log-file flags, which the main
+// command and every subcommand take
+type logOptions struct {
+	level, file *string
+}
+
+func addLogFlags(fs *pflag.FlagSet) logOptions {
+	return logOptions{
+		level: fs.String("log-level", "info", "Least severe log messages shown: debug (adds SSH handshakes, SFTP sessions and retry decisions), info, warn or error"),
+		file:  fs.String("log-file", "", "Also append log messages with timestamps to this file"),
+	}
+}
+
+// apply sets the log level and opens the log file once the flags are parsed
+func (o logOptions) apply() error {
+	level, err := parseLogLevel(*o.level)
+	if err != nil {
+		return err
+	}
+	logLevel = level
+	if *o.file != "" {
+		return setupLogFile(*o.file)
+	}
+	return nil
+}
+
+// logFile receives a timestamped copy of every logged message when
+// --log-file is set, in addition to the log target
+var (
+	logFile   *os.File
+	logFileMu sync.Mutex
+)
+
+func setupLogFile(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	logFile = f
+	return nil
+}
+
+// writeLogFile appends a message to the log file, one line per message line
+// with time, level and host tag
+func writeLogFile(level, tag, format string, args ...interface{}) {
+	if logFile == nil {
+		return
+	}
+	prefix := time.Now().Format("2006-01-02T15:04:05.000Z07:00") + " " + level + " " + tag
+	var b strings.Builder
+	for _, line := range strings.Split(syslogMessage(format, args...), "\n") {
+		if line != "" {
+			b.WriteString(prefix + line + "\n")
+		}
+	}
+	logFileMu.Lock()
+	defer logFileMu.Unlock()
+	logFile.WriteString(b.String())
+}
+
+// setupLogTarget selects where log messages go: "stdout" (default) or "syslog"
+func setupLogTarget(target string) error {
+	switch target {
+	case "", "stdout":
+		return nil
+	case "syslog":
+		w, err := openSyslog("sftpsender")
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		sysLog = w
+		return nil
+	default:
+		return fmt.Errorf("unknown log target: %s (expected stdout or syslog)", target)
+	}
+}
+
+// syslogMessage strips the surrounding newlines used for terminal layout
+func syslogMessage(format string, args ...interface{}) string {
+	return strings.TrimSpace(fmt.Sprintf(format, args...))
+}
+
+// ciLine prints a single deterministic line, dropping the blank lines used for terminal layout
+func ciLine(prefix, format string, args ...interface{}) {
+	for _, line := range strings.Split(syslogMessage(format, args...), "\n") {
+		if line != "" {
+			fmt.Println(prefix + line)
+		}
+	}
+}
+
+// hostTag is the "[host] " prefix of the log lines about one host of a
+// parallel run: plain for syslog, CI output and the log file, colored on a
+// terminal
+type hostTag struct {
+	plain, colored string
+}
+
+// hostLogger logs the messages about one host, with its tag in front of
+// every line. The zero value logs without a tag, like logInfof and friends;
+// per-host code gets its logger from SftpSender.hostLog.
+type hostLogger struct {
+	tag *hostTag
+}
+
+// logf prints a log message with level prefix (such as "WARNING: ") after
+// the host tag, on each of its lines
+func (l hostLogger) logf(level, format string, args ...interface{}) {
+	if l.tag == nil {
+		fmt.Printf(level+format, args...)
+		return
+	}
+	lines := strings.SplitAfter(fmt.Sprintf(format, args...), "\n")
+	var b strings.Builder
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			b.WriteString(line)
+			continue
+		}
+		b.WriteString(l.tag.colored)
+		if first {
+			b.WriteString(level)
+			first = false
+		}
+		b.WriteString(line)
+	}
+	fmt.Print(b.String())
+}
+
+// plain returns the uncolored tag, empty without one
+func (l hostLogger) plain() string {
+	if l.tag == nil {
+		return ""
+	}
+	return l.tag.plain
+}
+
+// taggedFormat puts the plain host tag in front of format, for syslog messages
+func (l hostLogger) taggedFormat(format string) string {
+	if l.tag == nil {
+		return format
+	}
+	return strings.ReplaceAll(l.tag.plain, "%", "%%") + strings.TrimLeft(format, "\n")
+}
+
+// Debugf reports details for --log-level debug, such as the SSH handshake
+// of every connection
+func (l hostLogger) Debugf(format string, args ...interface{}) {
+	if logLevel > levelDebug {
+		return
+	}
+	writeLogFile("DEBUG", l.plain(), format, args...)
+	if activeDashboard.Load() != nil {
+		return
+	}
+	if sysLog != nil {
+		sysLog.Debug(syslogMessage(l.taggedFormat(format), args...))
+		return
+	}
+	if ciMode {
+		ciLine("::debug::"+l.plain(), format, args...)
+		return
+	}
+	l.logf("DEBUG: ", format, args...)
+}
+
+func (l hostLogger) Infof(format string, args ...interface{}) {
+	if logLevel > levelInfo {
+		return
+	}
+	writeLogFile("INFO", l.plain(), format, args...)
+	if activeDashboard.Load() != nil {
+		return
+	}
+	if sysLog != nil {
+		sysLog.Info(syslogMessage(l.taggedFormat(format), args...))
+		return
+	}
+	if ciMode {
+		ciLine(l.plain(), format, args...)
+		return
+	}
+	l.logf("", format, args...)
+}
+
+func (l hostLogger) Warnf(format string, args ...interface{}) {
+	if logLevel > levelWarn {
+		return
+	}
+	writeLogFile("WARN", l.plain(), format, args...)
+	if d := activeDashboard.Load(); d != nil {
+		d.log("WARNING: ", format, args...)
+		return
+	}
+	if sysLog != nil {
+		sysLog.Warning(syslogMessage(l.taggedFormat(format), args...))
+		return
+	}
+	if ciMode {
+		ciLine("::warning::"+l.plain(), format, args...)
+		return
+	}
+	l.logf("WARNING: ", format, args...)
+}
+
+func (l hostLogger) Errorf(format string, args ...interface{}) {
+	writeLogFile("ERROR", l.plain(), format, args...)
+	if d := activeDashboard.Load(); d != nil {
+		d.log("ERROR: ", format, args...)
+		return
+	}
+	if sysLog != nil {
+		sysLog.Err(syslogMessage(l.taggedFormat(format), args...))
+		return
+	}
+	if ciMode {
+		ciLine("::error::"+l.plain(), format, args...)
+		return
+	}
+	l.logf("ERROR: ", format, args...)
+}
+
+// tagHosts makes the loggers of hostLog put the name of each of hosts,
+// padded to the longest one, in front of their lines. The returned function
+// restores the previous tags once the hosts are done.
+func (s *SftpSender) tagHosts(hosts []string) func() {
+	width := 0
+	for _, h := range hosts {
+		width = max(width, len(h))
+	}
+	color := useColor()
+
+	s.logTagsMu.Lock()
+	defer s.logTagsMu.Unlock()
+	prev := s.logTags
+	tags := make(map[string]*hostTag, len(prev)+len(hosts))
+	maps.Copy(tags, prev)
+	for _, h := range hosts {
+		tags[h] = &hostTag{plain: hostPrefix(h, width, false), colored: hostPrefix(h, width, color)}
+	}
+	s.logTags = tags
+	return func() {
+		s.logTagsMu.Lock()
+		defer s.logTagsMu.Unlock()
+		s.logTags = prev
+	}
+}
+
+// hostLog returns the logger for messages about host, tagged while host is
+// part of a parallel run
+func (s *SftpSender) hostLog(host string) hostLogger {
+	s.logTagsMu.Lock()
+	defer s.logTagsMu.Unlock()
+	return hostLogger{tag: s.logTags[host]}
+}
+
+// logDebugf, logInfof, logWarnf and logErrorf log messages that are not
+// about one host of a parallel run
+func logDebugf(format string, args ...interface{}) { hostLogger{}.Debugf(format, args...) }
+func logInfof(format string, args ...interface{})  { hostLogger{}.Infof(format, args...) }
+func logWarnf(format string, args ...interface{})  { hostLogger{}.Warnf(format, args...) }
+func logErrorf(format string, args ...interface{}) { hostLogger{}.Errorf(format, args...) }
+
+func logFatalf(format string, args ...interface{}) {
+	writeLogFile("FATAL", "", format, args...)
+	if d := activeDashboard.Load(); d != nil {
+		d.close()
+	}
+	if sysLog != nil {
+		sysLog.Crit(syslogMessage(format, args...))
+		os.Exit(1)
+	}
+	if ciMode {
+		ciLine("::error::", format, args...)
+		os.Exit(1)
+	}
+	log.Fatalf(format, args...)
+}
+
+// logGroupStart opens a collapsible output group in CI mode
+func logGroupStart(name string) {
+	if ciMode && sysLog == nil {
+		fmt.Printf("::group::%s\n", name)
+	}
+}
+
+// logGroupEnd closes the group opened by logGroupStart
+func logGroupEnd() {
+	if ciMode && sysLog == nil {
+		fmt.Println("::endgroup::")
+	}
+}
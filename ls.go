@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+)
+
+// RemoteEntry is one file of a remote listing
+type RemoteEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	Dir     bool      `json:"dir,omitempty"`
+	Link    string    `json:"link,omitempty"` // target of a symlink
+}
+
+// RemoteListing is the content of one remote path on one host
+type RemoteListing struct {
+	Host    string        `json:"host"`
+	Path    string        `json:"path"`
+	Entries []RemoteEntry `json:"entries"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// runLs implements the "ls" subcommand, which lists remote paths on each host
+// with their size, modification time and permissions
+func runLs(args []string) error {
+	fs := pflag.NewFlagSet("ls", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to list")
+	group := fs.String("group", "", "List on every host of this group")
+	asJSON := fs.Bool("json", false, "Print the listings as JSON")
+	parallel := fs.Int("parallel", 16, "Number of hosts listed at the same time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: sftpsender ls (--ip hosts | --group name) [--json] PATH...")
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	results := make([][]RemoteListing, len(hosts))
+	s.forEachHost(hosts, *parallel, func(i int) {
+		results[i] = s.listHost(hosts[i], fs.Args())
+	})
+	listings := slices.Concat(results...)
+
+	if *asJSON {
+		data, err := json.MarshalIndent(listings, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+
+	failed := 0
+	for i, l := range listings {
+		target := l.Host + ":" + l.Path
+		if l.Error != "" {
+			failed++
+			logErrorf("%s: %s\n", target, l.Error)
+			continue
+		}
+		if *asJSON {
+			continue
+		}
+		// Like ls, a header tells the listings apart when there are several
+		if len(listings) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Println(target + ":")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, e := range l.Entries {
+			name := e.Name
+			if e.Dir {
+				name += "/"
+			}
+			if e.Link != "" {
+				name += " -> " + e.Link
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Mode, formatBytes(e.Size), e.ModTime.Local().Format("2006-01-02 15:04"), name)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not list %d of %d paths", failed, len(listings))
+	}
+	return nil
+}
+
+// listHost lists each of paths on a host over one SFTP session
+func (s *SftpSender) listHost(host string, paths []string) []RemoteListing {
+	listings := make([]RemoteListing, len(paths))
+	for i, p := range paths {
+		listings[i] = RemoteListing{Host: host, Path: p}
+	}
+	fail := func(err error) []RemoteListing {
+		for i := range listings {
+			listings[i].Error = err.Error()
+		}
+		return listings
+	}
+
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return fail(err)
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return fail(err)
+	}
+	defer client.Close()
+	sftpClient, err := s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket})
+	if err != nil {
+		if isNoSFTPSubsystem(err) {
+			return fail(fmt.Errorf("no SFTP subsystem, use sftpsender exec -- ls -l"))
+		}
+		return fail(err)
+	}
+	defer sftpClient.Close()
+
+	for i, p := range paths {
+		entries, err := listRemote(sftpClient, p)
+		if err != nil {
+			listings[i].Error = err.Error()
+			continue
+		}
+		listings[i].Entries = entries
+	}
+	return listings
+}
+
+// listRemote returns the files of a remote directory sorted by name, or the
+// file itself when remotePath is not a directory. A symlink is shown as the
+// link, unless it points to a directory, which is listed.
+func listRemote(c *sftp.Client, remotePath string) ([]RemoteEntry, error) {
+	info, err := c.Lstat(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat remote path: %w", err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err := c.Stat(remotePath); err == nil && target.IsDir() {
+			info = target
+		}
+	}
+	dir, infos := path.Dir(remotePath), []os.FileInfo{info}
+	if info.IsDir() {
+		dir = remotePath
+		if infos, err = c.ReadDir(remotePath); err != nil {
+			return nil, fmt.Errorf("failed to read remote directory: %w", err)
+		}
+		slices.SortFunc(infos, func(a, b os.FileInfo) int { return strings.Compare(a.Name(), b.Name()) })
+	}
+
+	entries := make([]RemoteEntry, 0, len(infos))
+	for _, fi := range infos {
+		e := RemoteEntry{Name: fi.Name(), Size: fi.Size(), Mode: fi.Mode().String(), ModTime: fi.ModTime(), Dir: fi.IsDir()}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			e.Link, _ = c.ReadLink(path.Join(dir, fi.Name()))
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
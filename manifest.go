@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+)
+
+// manifestName is the file --manifest writes into an uploaded directory. It
+// lists the SHA-256 of every file below it in sha256sum format, so it can
+// also be checked on the host with sha256sum -c.
+const manifestName = "SHA256SUMS"
+
+// writeManifest hashes the files of the local directory and writes the list
+// into the uploaded remote directory
+func (s *SftpSender) writeManifest(c *sftp.Client, host, localPath, remotePath string) error {
+	hashes, err := localTreeHashes(localPath)
+	if err != nil {
+		return err
+	}
+	delete(hashes, manifestName)
+	for p := range hashes {
+		if s.filter.excludes(p, false) {
+			delete(hashes, p)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, p := range slices.Sorted(maps.Keys(hashes)) {
+		fmt.Fprintf(&buf, "%s  %s\n", hashes[p], p)
+	}
+	f, err := c.Create(path.Join(remotePath, manifestName))
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	s.hostLog(host).Infof("Wrote %s with %d files to %s\n", manifestName, len(hashes), remotePath)
+	return nil
+}
+
+// manifestReport is the result of checking one remote directory against its
+// manifest
+type manifestReport struct {
+	files     int
+	corrupted []string
+	missing   []string
+}
+
+// checkManifest reads the manifest of a remote directory and hashes the files
+// it lists on the host
+func (s *SftpSender) checkManifest(host, dir string) (*manifestReport, error) {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	sftpClient, err := s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket})
+	if err != nil {
+		return nil, err
+	}
+	f, err := sftpClient.Open(path.Join(dir, manifestName))
+	if err != nil {
+		sftpClient.Close()
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	sftpClient.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	want, err := parseHashList(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", manifestName, err)
+	}
+
+	got, err := s.clientTreeHashes(client, dir)
+	if err != nil {
+		return nil, err
+	}
+	// Files added since the upload are not in the manifest and not reported
+	changed, missing, _ := got.diff(want)
+	return &manifestReport{files: len(want), corrupted: changed, missing: missing}, nil
+}
+
+// runVerify implements the "verify" subcommand: it re-checks remote
+// directories against the SHA256SUMS manifest written by --manifest
+func runVerify(args []string) error {
+	fs := pflag.NewFlagSet("verify", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	parallel := fs.Int("parallel", 16, "Number of hosts checked at the same time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: sftpsender verify HOST:DIR...")
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	hosts := make([]string, fs.NArg())
+	dirs := make([]string, fs.NArg())
+	for i, target := range fs.Args() {
+		if hosts[i], dirs[i], err = s.resolveTarget(target); err != nil {
+			return err
+		}
+		if dirs[i] == "" {
+			return fmt.Errorf("%s has no directory, use HOST:DIR", target)
+		}
+	}
+
+	var mu sync.Mutex
+	failed := 0
+	s.forEachHost(hosts, *parallel, func(i int) {
+		report, err := s.checkManifest(hosts[i], dirs[i])
+
+		mu.Lock()
+		defer mu.Unlock()
+		target := hosts[i] + ":" + dirs[i]
+		switch {
+		case err != nil:
+			failed++
+			s.hostLog(hosts[i]).Errorf("✗ %s: %v\n", target, err)
+		case len(report.corrupted)+len(report.missing) > 0:
+			failed++
+			var lines []string
+			for _, p := range report.corrupted {
+				lines = append(lines, "  corrupted "+p)
+			}
+			for _, p := range report.missing {
+				lines = append(lines, "  missing "+p)
+			}
+			s.hostLog(hosts[i]).Errorf("✗ %s: %d corrupted, %d missing of %d files\n%s\n", target,
+				len(report.corrupted), len(report.missing), report.files, strings.Join(lines, "\n"))
+		default:
+			s.hostLog(hosts[i]).Infof("✓ %s: %d files OK\n", target, report.files)
+		}
+	})
+	if failed > 0 {
+		return fmt.Errorf("%d of %d directories failed verification", failed, len(hosts))
+	}
+	return nil
+}
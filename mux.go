@@ -0,0 +1,550 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+)
+
+// The mux agent keeps authenticated connections open between runs, like
+// OpenSSH's ControlPersist. It listens on a unix socket in the state
+// directory and speaks SSH there: a run logs in with user@ip of a host as
+// user name and gets a client whose channels the agent relays over its own
+// connection to that host, saving the TCP, key exchange and authentication
+// round trips. Runs use it whenever it is running and fall back to
+// connecting directly for hosts it can't reach.
+
+// muxControlUser is the user name of connections that manage the agent
+const muxControlUser = "sftpsender-control"
+
+// Global requests understood on control connections
+const (
+	muxStatusRequest = "status@sftpsender"
+	muxStopRequest   = "stop@sftpsender"
+)
+
+var errMuxNotRunning = errors.New("the mux agent is not running")
+
+func muxSocketPath() string {
+	return stateFile("mux.sock")
+}
+
+func runMux(args []string) error {
+	const usage = "usage: sftpsender mux (start | stop | status) [--persist 10m] [--foreground]"
+	fs := pflag.NewFlagSet("mux", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	persist := fs.Duration("persist", 10*time.Minute, "Close connections unused for this long, and stop the agent once none are left")
+	foreground := fs.Bool("foreground", false, "Run the agent in the foreground instead of detaching it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+
+	switch fs.Arg(0) {
+	case "start":
+		if _, err := muxControl(muxStatusRequest); err == nil {
+			return fmt.Errorf("the mux agent is already running on %s", muxSocketPath())
+		}
+		if *foreground {
+			return serveMux(*configPath, *persist)
+		}
+		return startMuxAgent(*configPath, *persist)
+	case "stop":
+		if _, err := muxControl(muxStopRequest); err != nil {
+			return err
+		}
+		logInfof("Mux agent stopped\n")
+		return nil
+	case "status":
+		reply, err := muxControl(muxStatusRequest)
+		if err != nil {
+			return err
+		}
+		logInfof("Mux agent running on %s\n", muxSocketPath())
+		if len(reply) == 0 {
+			logInfof("No open connections\n")
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(reply)), "\n") {
+			if line != "" {
+				logInfof("  %s\n", line)
+			}
+		}
+		return nil
+	}
+	return errors.New(usage)
+}
+
+// startMuxAgent runs the agent in a detached copy of this process, logging to
+// mux.log in the state directory, and waits until it answers
+func startMuxAgent(configPath string, persist time.Duration) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logPath := stateFile("mux.log")
+	if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open mux log: %w", err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(self, "mux", "start", "--foreground", "--config", configPath, "--persist", persist.String())
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start the mux agent: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		select {
+		case <-exited:
+			return fmt.Errorf("the mux agent exited, see %s", logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if _, err := muxControl(muxStatusRequest); err == nil {
+			logInfof("Mux agent started (pid %d) on %s\n", cmd.Process.Pid, muxSocketPath())
+			return nil
+		}
+	}
+	return fmt.Errorf("the mux agent did not answer, see %s", logPath)
+}
+
+// muxControl sends a control request to the running agent
+func muxControl(request string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", muxSocketPath(), time.Second)
+	if err != nil {
+		return nil, errMuxNotRunning
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, "mux", muxClientConfig(muxControlUser))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to talk to the mux agent: %w", err)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	defer client.Close()
+	ok, reply, err := client.SendRequest(request, true, nil)
+	if err != nil && request != muxStopRequest {
+		return nil, fmt.Errorf("failed to talk to the mux agent: %w", err)
+	}
+	if err == nil && !ok {
+		return nil, fmt.Errorf("the mux agent refused %s", request)
+	}
+	return reply, nil
+}
+
+// muxClientConfig logs in to the agent as user. The socket is only accessible
+// to this user, so the agent needs no authentication and no host key check;
+// it checks the keys of the hosts itself.
+func muxClientConfig(user string) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+}
+
+// muxClient returns a client for the host of cred relayed by the mux agent,
+// or nil when no agent is running or it has no connection to the host
+func (s *SftpSender) muxClient(cred *Credential) *ssh.Client {
+	conn, err := net.DialTimeout("unix", muxSocketPath(), time.Second)
+	if err != nil {
+		return nil
+	}
+	c, chans, reqs, err := ssh.NewClientConn(s.wrapConn(cred, conn), "mux", muxClientConfig(cred.Username+"@"+cred.IP))
+	if err != nil {
+		conn.Close()
+		s.warnOnce("mux "+cred.IP, "The mux agent has no connection to %s, connecting directly (see %s)\n", cred.IP, stateFile("mux.log"))
+		return nil
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	s.forwardAgent(client, cred)
+	return client
+}
+
+// connectHost returns a connection to the host of cred, through the mux agent
+// when one is running
+func (s *SftpSender) connectHost(cred *Credential) (*ssh.Client, error) {
+	if client := s.muxClient(cred); client != nil {
+		return client, nil
+	}
+	return s.dialSSH(cred)
+}
+
+// muxAgent is the state of a running agent
+type muxAgent struct {
+	s        *SftpSender
+	persist  time.Duration
+	listener net.Listener
+
+	mu         sync.Mutex
+	hosts      map[string]*muxUpstream // by user@ip of the credential
+	lastActive time.Time
+	stopping   bool
+}
+
+// muxUpstream is the agent's connection to one host
+type muxUpstream struct {
+	client   *ssh.Client
+	runs     []ssh.Conn // connected runs using it, newest last
+	lastUsed time.Time
+	closed   atomic.Bool
+}
+
+// serveMux runs the agent until it is stopped or has been idle for persist
+func serveMux(configPath string, persist time.Duration) error {
+	s, err := NewSftpSender(configPath)
+	if err != nil {
+		return err
+	}
+	// Runs apply their own rate limits to the relayed traffic and forward
+	// their own ssh-agent, see relayAgent
+	s.schedule, s.limiter = nil, nil
+	for i := range s.config.Credentials {
+		s.config.Credentials[i].maxRate = 0
+		s.config.Credentials[i].ForwardAgent = false
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return err
+	}
+
+	socket := muxSocketPath()
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	// A socket left by an agent that died is in the way
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	defer os.Remove(socket)
+
+	a := &muxAgent{s: s, persist: persist, listener: listener, hosts: make(map[string]*muxUpstream), lastActive: time.Now()}
+	config := &ssh.ServerConfig{NoClientAuth: true, NoClientAuthCallback: a.authorize}
+	config.AddHostKey(signer)
+
+	go a.reap()
+	logInfof("Mux agent listening on %s (pid %d, persist %s)\n", socket, os.Getpid(), persist)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			a.mu.Lock()
+			stopping := a.stopping
+			a.mu.Unlock()
+			if stopping {
+				a.closeAll()
+				logInfof("Mux agent stopped\n")
+				return nil
+			}
+			return err
+		}
+		go a.serveConn(conn, config)
+	}
+}
+
+// authorize admits control connections and runs for hosts the agent is, or
+// can get, connected to
+func (a *muxAgent) authorize(meta ssh.ConnMetadata) (*ssh.Permissions, error) {
+	if meta.User() == muxControlUser {
+		return nil, nil
+	}
+	if _, err := a.upstream(meta.User()); err != nil {
+		logWarnf("%s: %v\n", meta.User(), err)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// upstream returns the open connection for key, dialing it first if needed
+func (a *muxAgent) upstream(key string) (*muxUpstream, error) {
+	a.mu.Lock()
+	up := a.hosts[key]
+	a.mu.Unlock()
+	if up != nil && !up.closed.Load() {
+		return up, nil
+	}
+
+	var cred *Credential
+	for i := range a.s.config.Credentials {
+		c := a.s.config.Credentials[i]
+		if c.Username+"@"+c.IP == key {
+			cred = &c
+			break
+		}
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("not in the agent's config")
+	}
+	client, err := a.s.dialSSH(cred)
+	if err != nil {
+		return nil, err
+	}
+	logInfof("Connected to %s\n", key)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Another run may have connected meanwhile
+	if up := a.hosts[key]; up != nil && !up.closed.Load() {
+		client.Close()
+		return up, nil
+	}
+	up = &muxUpstream{client: client, lastUsed: time.Now()}
+	go func() {
+		client.Wait()
+		up.closed.Store(true)
+	}()
+	go func() {
+		for ch := range client.HandleChannelOpen("auth-agent@openssh.com") {
+			go a.relayAgent(up, ch)
+		}
+	}()
+	a.hosts[key] = up
+	return up, nil
+}
+
+// relayAgent passes an agent channel the host opened for a forwarding
+// session on to the newest run connected to it, which answers it from its
+// own ssh-agent
+func (a *muxAgent) relayAgent(up *muxUpstream, ch ssh.NewChannel) {
+	a.mu.Lock()
+	var run ssh.Conn
+	if n := len(up.runs); n > 0 {
+		run = up.runs[n-1]
+	}
+	a.mu.Unlock()
+	if run == nil {
+		ch.Reject(ssh.Prohibited, "no run connected to forward the agent of")
+		return
+	}
+	relayChannel(run, ch)
+}
+
+// serveConn relays the channels and requests of one run
+func (a *muxAgent) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		// Runs for hosts the agent could not connect to end up here as well,
+		// authorize logged why
+		return
+	}
+	defer sconn.Close()
+	a.touch()
+	if sconn.User() == muxControlUser {
+		go rejectChannels(chans)
+		a.serveControl(reqs)
+		return
+	}
+
+	up, err := a.upstream(sconn.User())
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	up.runs = append(up.runs, sconn)
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		up.runs = slices.DeleteFunc(up.runs, func(c ssh.Conn) bool { return c == sconn })
+		up.lastUsed = time.Now()
+		a.mu.Unlock()
+		a.touch()
+	}()
+
+	// Keepalives and other global requests go to the host, so round trip
+	// measurements of --auto-tune still see the real link
+	go func() {
+		for req := range reqs {
+			ok, reply, err := up.client.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				req.Reply(ok && err == nil, reply)
+			}
+		}
+	}()
+	for newChannel := range chans {
+		go relayChannel(up.client, newChannel)
+	}
+}
+
+// rejectChannels refuses the channels of a control connection
+func rejectChannels(chans <-chan ssh.NewChannel) {
+	for ch := range chans {
+		ch.Reject(ssh.Prohibited, "control connections have no channels")
+	}
+}
+
+// serveControl answers status and stop requests
+func (a *muxAgent) serveControl(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case muxStatusRequest:
+			req.Reply(true, []byte(a.status()))
+		case muxStopRequest:
+			req.Reply(true, nil)
+			a.stop()
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// status lists the open connections, one per line
+func (a *muxAgent) status() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var lines []string
+	for key, up := range a.hosts {
+		if up.closed.Load() {
+			continue
+		}
+		state := fmt.Sprintf("idle for %s", time.Since(up.lastUsed).Round(time.Second))
+		if len(up.runs) > 0 {
+			state = fmt.Sprintf("used by %d runs", len(up.runs))
+		}
+		lines = append(lines, key+"  "+state)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func (a *muxAgent) touch() {
+	a.mu.Lock()
+	a.lastActive = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *muxAgent) stop() {
+	a.mu.Lock()
+	a.stopping = true
+	a.mu.Unlock()
+	a.listener.Close()
+}
+
+func (a *muxAgent) closeAll() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, up := range a.hosts {
+		up.client.Close()
+		delete(a.hosts, key)
+	}
+}
+
+// reap closes connections no run used for the persist time, and stops the
+// agent once it has none left and nothing connected for as long
+func (a *muxAgent) reap() {
+	interval := min(a.persist/4, 30*time.Second)
+	for range time.Tick(max(interval, time.Second)) {
+		a.mu.Lock()
+		for key, up := range a.hosts {
+			if up.closed.Load() {
+				logInfof("Connection to %s dropped\n", key)
+				delete(a.hosts, key)
+			} else if len(up.runs) == 0 && time.Since(up.lastUsed) > a.persist {
+				logInfof("Closing connection to %s, unused for %s\n", key, a.persist)
+				up.client.Close()
+				delete(a.hosts, key)
+			}
+		}
+		idle := len(a.hosts) == 0 && time.Since(a.lastActive) > a.persist
+		a.mu.Unlock()
+		if idle {
+			logInfof("Idle for %s, stopping\n", a.persist)
+			a.stop()
+			return
+		}
+	}
+}
+
+// relayChannel opens the channel a run asked for on the host connection, or
+// an agent channel of the host on the run connection, and copies data, stderr
+// and requests both ways until the channel closes
+func relayChannel(to ssh.Conn, newChannel ssh.NewChannel) {
+	upstream, upstreamReqs, err := to.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			newChannel.Reject(openErr.Reason, openErr.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	downstream, downstreamReqs, err := newChannel.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	go func() {
+		io.Copy(upstream, downstream)
+		upstream.CloseWrite()
+	}()
+	go func() {
+		relayRequests(downstreamReqs, upstream)
+		// The run closed the channel
+		upstream.Close()
+	}()
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		io.Copy(downstream, upstream)
+	}()
+	go func() {
+		defer output.Done()
+		io.Copy(downstream.Stderr(), upstream.Stderr())
+	}()
+	// Exit statuses and signals arrive here until the host closes the channel
+	relayRequests(upstreamReqs, downstream)
+	output.Wait()
+	downstream.CloseWrite()
+	downstream.Close()
+}
+
+func relayRequests(reqs <-chan *ssh.Request, to ssh.Channel) {
+	for req := range reqs {
+		ok, err := to.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// netProfile bundles transfer settings suited to a class of network link
+type netProfile struct {
+	bufferSize    int
+	maxConcurrent int
+	streams       int
+	threads       int
+	keepAlive     time.Duration
+}
+
+// netProfiles are the presets selectable with --net-profile. Packet size is left
+// at the 32KB every server accepts; use --max-packet to raise it for OpenSSH.
+var netProfiles = map[string]netProfile{
+	// Low latency, high bandwidth: the defaults with a few files in parallel
+	"lan": {bufferSize: 256 * 1024, maxConcurrent: 64, streams: 1, threads: 4, keepAlive: 30 * time.Second},
+	// Internet links with tens of milliseconds of latency
+	"wan": {bufferSize: 1024 * 1024, maxConcurrent: 256, streams: 2, threads: 4, keepAlive: 15 * time.Second},
+	// Very high latency links where a full window and many streams matter most
+	"satellite": {bufferSize: 4 * 1024 * 1024, maxConcurrent: 512, streams: 4, threads: 8, keepAlive: 10 * time.Second},
+}
+
+// applyNetProfile applies a preset, leaving alone any setting whose flag was
+// given explicitly on the command line
+func (s *SftpSender) applyNetProfile(name string, changed func(flag string) bool) error {
+	p, ok := netProfiles[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(netProfiles))
+		for n := range netProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown network profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	if !changed("buffer-size") {
+		s.bufferSize = p.bufferSize
+	}
+	if !changed("streams") {
+		s.streams = p.streams
+	}
+	if !changed("threads") {
+		s.threads = p.threads
+	}
+	s.maxConcurrent = p.maxConcurrent
+	s.keepAlive = p.keepAlive
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier describes a notification channel that receives the run report
+type Notifier struct {
+	Name string `yaml:"name"` // optional, used to select the notifier with --notify
+	Type string `yaml:"type"` // webhook, slack, telegram, discord, ntfy or email
+	URL  string `yaml:"url"`
+	On   string `yaml:"on"` // always (default), success, failure or manual
+
+	// Telegram settings
+	BotToken string `yaml:"bot_token"`
+	ChatID   string `yaml:"chat_id"`
+
+	// Email (SMTP) settings
+	SMTPHost     string   `yaml:"smtp_host"`
+	SMTPPort     int      `yaml:"smtp_port"`
+	SMTPUsername string   `yaml:"smtp_username"`
+	SMTPPassword string   `yaml:"smtp_password"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+}
+
+// RunReport summarizes a finished upload, download or autosend run
+type RunReport struct {
+	Operation  string    `json:"operation"`
+	Status     string    `json:"status"`
+	Hosts      []string  `json:"hosts"`
+	Files      int       `json:"files"`
+	Bytes      int64     `json:"bytes"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   string    `json:"duration"`
+	Errors     []string  `json:"errors,omitempty"`
+	Paused     []string  `json:"paused,omitempty"` // hosts whose circuit breaker opened
+}
+
+func newRunReport(operation string) *RunReport {
+	return &RunReport{
+		Operation: operation,
+		StartedAt: time.Now(),
+	}
+}
+
+// finish fills in the final status, counters and timing of the report
+func (r *RunReport) finish(s *SftpSender) {
+	r.FinishedAt = time.Now()
+	r.Duration = r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond).String()
+	r.Files = s.filesTransferred
+	r.Bytes = s.bytesTransferred
+	r.Paused = s.trippedHosts()
+	r.Status = "success"
+	if len(r.Errors) > 0 {
+		r.Status = "failure"
+	}
+}
+
+// summaryText renders the report as a short human-readable message
+func (r *RunReport) summaryText() string {
+	var b strings.Builder
+	icon := "✓"
+	if r.Status == "failure" {
+		icon = "✗"
+	}
+	fmt.Fprintf(&b, "%s sftpsender %s %s\n", icon, r.Operation, r.Status)
+	fmt.Fprintf(&b, "Hosts: %s\n", strings.Join(r.Hosts, ", "))
+	fmt.Fprintf(&b, "Files: %d, Bytes: %d, Duration: %s\n", r.Files, r.Bytes, r.Duration)
+	if len(r.Paused) > 0 {
+		fmt.Fprintf(&b, "Paused by circuit breaker: %s\n", strings.Join(r.Paused, ", "))
+	}
+	if len(r.Errors) > 0 {
+		b.WriteString("Errors:\n")
+		for _, e := range r.Errors {
+			fmt.Fprintf(&b, "  - %s\n", e)
+		}
+	}
+	return b.String()
+}
+
+// shouldNotify checks the notifier's "on" condition against the run status.
+// Notifiers selected by name or type with --notify always fire.
+func (n Notifier) shouldNotify(report *RunReport, selected []string) bool {
+	for _, sel := range selected {
+		if sel == n.Type || (n.Name != "" && sel == n.Name) {
+			return true
+		}
+	}
+	switch n.On {
+	case "", "always":
+		return true
+	case "manual":
+		return false
+	default:
+		return n.On == report.Status
+	}
+}
+
+// notify sends the run report to every configured notifier plus any given on the command line
+func (s *SftpSender) notify(report *RunReport) {
+	notifiers := append(append([]Notifier{}, s.config.Notifiers...), s.extraNotifiers...)
+	for _, n := range notifiers {
+		if !n.shouldNotify(report, s.selectedNotifiers) {
+			continue
+		}
+		if err := n.send(report); err != nil {
+			logWarnf("failed to send %s notification: %v\n", n.Type, err)
+		}
+	}
+}
+
+func (n Notifier) send(report *RunReport) error {
+	switch n.Type {
+	case "webhook":
+		return postJSON(n.URL, report)
+	case "slack":
+		return postJSON(n.URL, map[string]string{"text": report.summaryText()})
+	case "telegram":
+		if n.BotToken == "" || n.ChatID == "" {
+			return fmt.Errorf("bot_token and chat_id are required")
+		}
+		// Telegram rejects messages longer than 4096 characters
+		text := report.summaryText()
+		if len(text) > 4000 {
+			text = text[:4000] + "\n..."
+		}
+		url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.BotToken)
+		return postJSON(url, map[string]string{"chat_id": n.ChatID, "text": text})
+	case "discord":
+		return postJSON(n.URL, report.discordPayload())
+	case "ntfy":
+		return n.sendNtfy(report)
+	case "email":
+		return n.sendEmail(report)
+	default:
+		return fmt.Errorf("unknown notifier type: %s", n.Type)
+	}
+}
+
+// discordPayload builds a Discord webhook message with the report as an embed
+func (r *RunReport) discordPayload() map[string]interface{} {
+	color := 0x2ecc71 // green
+	if r.Status == "failure" {
+		color = 0xe74c3c // red
+	}
+
+	fields := []map[string]interface{}{
+		{"name": "Hosts", "value": strings.Join(r.Hosts, ", "), "inline": false},
+		{"name": "Files", "value": strconv.Itoa(r.Files), "inline": true},
+		{"name": "Bytes", "value": strconv.FormatInt(r.Bytes, 10), "inline": true},
+		{"name": "Duration", "value": r.Duration, "inline": true},
+	}
+
+	embed := map[string]interface{}{
+		"title":     fmt.Sprintf("sftpsender %s %s", r.Operation, r.Status),
+		"color":     color,
+		"fields":    fields,
+		"timestamp": r.FinishedAt.Format(time.RFC3339),
+	}
+	if len(r.Errors) > 0 {
+		// Discord limits embed descriptions to 4096 characters
+		desc := "- " + strings.Join(r.Errors, "\n- ")
+		if len(desc) > 4000 {
+			desc = desc[:4000] + "\n..."
+		}
+		embed["description"] = desc
+	}
+
+	return map[string]interface{}{"embeds": []interface{}{embed}}
+}
+
+// sendNtfy publishes the summary to an ntfy topic URL (e.g. https://ntfy.sh/mytopic)
+func (n Notifier) sendNtfy(report *RunReport) error {
+	if n.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL, strings.NewReader(report.summaryText()))
+	if err != nil {
+		return redactURL(err)
+	}
+	req.Header.Set("Title", fmt.Sprintf("sftpsender %s %s", report.Operation, report.Status))
+	if report.Status == "failure" {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "x")
+	} else {
+		req.Header.Set("Tags", "white_check_mark")
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactURL(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendEmail mails the run report through the configured SMTP server.
+// Port 465 uses implicit TLS, any other port upgrades with STARTTLS when offered.
+func (n Notifier) sendEmail(report *RunReport) error {
+	if n.SMTPHost == "" || n.From == "" || len(n.To) == 0 {
+		return fmt.Errorf("smtp_host, from and to are required")
+	}
+	port := n.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	address := net.JoinHostPort(n.SMTPHost, strconv.Itoa(port))
+
+	subject := fmt.Sprintf("sftpsender %s %s", report.Operation, report.Status)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", report.FinishedAt.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(report.summaryText(), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", n.SMTPUsername, n.SMTPPassword, n.SMTPHost)
+	}
+
+	if port != 465 {
+		return smtp.SendMail(address, auth, n.From, n.To, []byte(msg.String()))
+	}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: n.SMTPHost})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, n.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// parseNotifyFlag splits --notify values into ad-hoc notifiers (ntfy://topic or
+// ntfy://server/topic) and names/types selecting notifiers from the config
+func parseNotifyFlag(values []string) (extra []Notifier, selected []string) {
+	for _, v := range values {
+		if strings.HasPrefix(v, "ntfy://") {
+			target := strings.TrimPrefix(v, "ntfy://")
+			if !strings.Contains(target, "/") {
+				target = "ntfy.sh/" + target
+			}
+			extra = append(extra, Notifier{Type: "ntfy", URL: "https://" + target})
+			continue
+		}
+		selected = append(selected, v)
+	}
+	return extra, selected
+}
+
+// redactURL drops the request URL from an HTTP client error, since webhook
+// URLs and the Telegram bot token are secrets that must not reach the logs
+func redactURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s failed: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// postJSON POSTs the payload as JSON and treats any non-2xx response as an error
+func postJSON(url string, payload interface{}) error {
+	if url == "" {
+		return fmt.Errorf("url is required")
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return redactURL(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
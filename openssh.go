@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// With --transport openssh, uploads and downloads run over the system ssh
+// binary (ssh -s host sftp) instead of the built-in SSH client, so everything
+// ssh itself can authenticate with works: ~/.ssh/config, agents, PKCS#11
+// tokens, GSSAPI and certificates. Host keys are checked by ssh against its
+// own known_hosts, and passwords from the config are not used.
+const (
+	transportBuiltin = "builtin"
+	transportOpenSSH = "openssh"
+)
+
+// openSSHArgs returns the ssh options that reach the host of cred, ending
+// with the destination
+func (s *SftpSender) openSSHArgs(cred *Credential) ([]string, error) {
+	var args []string
+	if s.keepAlive >= time.Second {
+		args = append(args, "-o", fmt.Sprintf("ServerAliveInterval=%d", int(s.keepAlive.Seconds())))
+	}
+	if cred.IdentityFile != "" {
+		args = append(args, "-i", expandHomeDir(cred.IdentityFile))
+	}
+	if cred.ForwardAgent {
+		args = append(args, "-A")
+	}
+
+	// ssh -J takes the whole chain of jump hosts, the first one first
+	var jumps []string
+	hop := cred
+	for i := 0; hop.JumpHost != ""; i++ {
+		if i == maxJumps {
+			return nil, fmt.Errorf("jump_host of %s loops or is longer than %d hops", cred.JumpHost, maxJumps)
+		}
+		next, err := s.findCredential(hop.JumpHost)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump_host: %w", err)
+		}
+		jumps = append([]string{openSSHDestination(next)}, jumps...)
+		hop = next
+	}
+	if len(jumps) > 0 {
+		args = append(args, "-J", strings.Join(jumps, ","))
+	}
+	if proxy := cmp.Or(cred.Proxy, s.config.Proxy); proxy != "" && proxy != "direct" {
+		s.warnOnce("openssh proxy", "proxy is not used with --transport openssh, set ProxyCommand or ProxyJump in ~/.ssh/config instead\n")
+	}
+
+	host, port, err := net.SplitHostPort(cred.IP)
+	if err != nil {
+		host, port = cred.IP, ""
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if cred.Username != "" {
+		args = append(args, "-l", cred.Username)
+	}
+	return append(args, host), nil
+}
+
+// openSSHDestination formats cred as [user@]host[:port] for ssh -J
+func openSSHDestination(cred *Credential) string {
+	if cred.Username != "" {
+		return cred.Username + "@" + cred.IP
+	}
+	return cred.IP
+}
+
+// openSSHSFTP starts the SFTP subsystem on the host of cred through ssh
+func (s *SftpSender) openSSHSFTP(cred *Credential) (*sftp.Client, error) {
+	args, err := s.openSSHArgs(cred)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("ssh", append([]string{"-s"}, append(args, "sftp")...)...)
+	conn, err := startSSHProcess(cmd)
+	if err != nil {
+		return nil, err
+	}
+	tuning := linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket, threads: s.threads}
+	wrapped := s.wrapConn(cred, conn)
+	client, err := sftp.NewClientPipe(wrapped, wrapped, sftpClientOptions(tuning)...)
+	if err != nil {
+		conn.Close()
+		if msg := conn.stderrLine(); msg != "" {
+			err := fmt.Errorf("ssh to %s failed: %s", cred.IP, msg)
+			for _, class := range openSSHErrorClasses(msg) {
+				err = &classifiedError{class: class, err: err}
+			}
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to start SFTP through ssh on %s: %w", cred.IP, err)
+	}
+	return client, nil
+}
+
+// openSSHErrorClasses returns the error classes of an ssh error message.
+// Connection failures also get their errno, which makes them retryable like
+// the dial errors of the builtin client.
+func openSSHErrorClasses(msg string) []error {
+	switch {
+	case strings.Contains(msg, "Permission denied ("):
+		return []error{ErrAuthFailed}
+	case strings.Contains(msg, "Host key verification failed"):
+		return []error{ErrHostKeyMismatch}
+	case strings.Contains(msg, "Connection refused"):
+		return []error{syscall.ECONNREFUSED, ErrHostUnreachable}
+	case strings.Contains(msg, "Connection timed out"):
+		return []error{syscall.ETIMEDOUT, ErrHostUnreachable}
+	case strings.Contains(msg, "No route to host"):
+		return []error{syscall.EHOSTUNREACH, ErrHostUnreachable}
+	case strings.Contains(msg, "Network is unreachable"):
+		return []error{syscall.ENETUNREACH, ErrHostUnreachable}
+	case strings.Contains(msg, "Could not resolve hostname"):
+		return []error{ErrHostUnreachable}
+	}
+	return nil
+}
+
+// openSSHRun runs a command on the host of cred through ssh
+func (s *SftpSender) openSSHRun(cred *Credential, host, command string, stdout, stderr io.Writer) error {
+	args, err := s.openSSHArgs(cred)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("ssh", append(args, command)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	entry := AuditEntry{Type: "command", Host: host, Command: command, Status: "success"}
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = err.Error()
+	}
+	s.audit(entry)
+	return err
+}
+
+// uploadOpenSSH is the part of Upload after the local checks for --transport
+// openssh
+func (s *SftpSender) uploadOpenSSH(cred *Credential, ip, localPath, remotePath, pathToDisplay string, info os.FileInfo) error {
+	client, err := s.openSSHSFTP(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := s.preflightUpload(ip, cred, client, localPath, remotePath, info); err != nil {
+		return err
+	}
+
+	stopWatch := s.watchTransfer(cred)
+	switch {
+	case info.IsDir():
+		err = s.uploadDirectorySFTP([]*sftp.Client{client}, ip, localPath, remotePath, s.threads)
+	case s.skipExisting && remoteFileMatches(client, remotePath, info.Size()):
+		s.hostLog(ip).Infof("Skipping %s, already present on the remote with the same size\n", pathToDisplay)
+	case s.sync && s.syncMatches(info, remoteStat(client, remotePath), localPath, func() (string, bool) {
+		sum, err := sftpChecksum(client, remotePath)
+		return sum, err == nil
+	}):
+		s.hostLog(ip).Infof("Skipping %s, already in sync on the remote\n", pathToDisplay)
+	default:
+		err = s.uploadFileSFTP(client, ip, localPath, remotePath, true)
+	}
+	if timeoutErr := stopWatch(); timeoutErr != nil {
+		return timeoutErr
+	}
+	if err != nil {
+		return err
+	}
+	if s.manifest && info.IsDir() {
+		if err := s.writeManifest(client, ip, localPath, remotePath); err != nil {
+			return err
+		}
+	}
+
+	if cred.PostUploadCmd != "" {
+		s.hostLog(ip).Infof("Running post-upload command on %s: %s\n", ip, cred.PostUploadCmd)
+		stdout, stderr := io.Writer(os.Stdout), io.Writer(os.Stderr)
+		if s.dashboard != nil {
+			stdout, stderr = io.Discard, io.Discard
+		}
+		if err := s.openSSHRun(cred, ip, cred.PostUploadCmd, stdout, stderr); err != nil {
+			return fmt.Errorf("post-upload command failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// downloadOpenSSH is the part of Download after the local checks for
+// --transport openssh
+func (s *SftpSender) downloadOpenSSH(cred *Credential, ip, remotePath, localPath string) error {
+	client, err := s.openSSHSFTP(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stopWatch := s.watchTransfer(cred)
+	err = s.downloadSFTP([]*sftp.Client{client}, s.threads, ip, remotePath, localPath)
+	if timeoutErr := stopWatch(); timeoutErr != nil {
+		return timeoutErr
+	}
+	return err
+}
+
+// sshProcessConn is the stdin and stdout of an ssh process as a net.Conn, so
+// the wrappers of wrapConn apply to it like to a TCP connection
+type sshProcessConn struct {
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *os.File
+	stderr *lockedBuffer
+	once   sync.Once
+	done   chan struct{}
+}
+
+// startSSHProcess starts cmd with its stdin and stdout connected to the
+// returned conn. Plain pipes rather than cmd.StdoutPipe let the process be
+// waited for while its last output is still being read.
+func startSSHProcess(cmd *exec.Cmd) (*sshProcessConn, error) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	c := &sshProcessConn{cmd: cmd, stdin: inW, stdout: outR, stderr: &lockedBuffer{}, done: make(chan struct{})}
+	cmd.Stdin, cmd.Stdout = inR, outW
+	// Passphrase and PIN prompts go to the terminal, only errors land here
+	cmd.Stderr = c.stderr
+	err = cmd.Start()
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, fmt.Errorf("failed to run ssh: %w", err)
+	}
+	go func() {
+		cmd.Wait()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+func (c *sshProcessConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *sshProcessConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+// Close ends the session by closing ssh's stdin and kills ssh if it does not
+// exit soon after, as when the watchdog cuts a stalled transfer
+func (c *sshProcessConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		select {
+		case <-c.done:
+		case <-time.After(5 * time.Second):
+			c.cmd.Process.Kill()
+			<-c.done
+		}
+		c.stdout.Close()
+	})
+	return nil
+}
+
+// stderrLine returns the last line ssh printed to stderr
+func (c *sshProcessConn) stderrLine() string {
+	lines := strings.Split(strings.TrimSpace(c.stderr.String()), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func (c *sshProcessConn) LocalAddr() net.Addr                { return sshProcessAddr{} }
+func (c *sshProcessConn) RemoteAddr() net.Addr               { return sshProcessAddr{} }
+func (c *sshProcessConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshProcessConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshProcessConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sshProcessAddr struct{}
+
+func (sshProcessAddr) Network() string { return "ssh" }
+func (sshProcessAddr) String() string  { return "ssh" }
+
+// lockedBuffer is a bytes.Buffer safe to write from exec's copying goroutine
+// while it is read
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
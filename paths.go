@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultConfigPath is the config file used without --config
+var defaultConfigPath = configFile("config.yaml")
+
+// legacyDir held both config and state before XDG base directories were
+// honored; files already there keep being used
+const legacyDir = "~/.config/sftpsender"
+
+// xdgDir returns $env/sftpsender, or fallback/sftpsender below the home
+// directory when the variable is unset or not absolute as the spec requires
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "sftpsender")
+	}
+	return filepath.Join(expandHomeDir(fallback), "sftpsender")
+}
+
+// xdgFile returns name in the XDG directory, unless only the legacy
+// ~/.config/sftpsender copy of it exists
+func xdgFile(env, fallback, name string) string {
+	path := filepath.Join(xdgDir(env, fallback), name)
+	legacy := filepath.Join(expandHomeDir(legacyDir), name)
+	if path == legacy {
+		return path
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(legacy); err == nil {
+			return legacy
+		}
+	}
+	return path
+}
+
+// configFile locates a configuration file in $XDG_CONFIG_HOME/sftpsender
+// (default ~/.config/sftpsender)
+func configFile(name string) string {
+	return xdgFile("XDG_CONFIG_HOME", "~/.config", name)
+}
+
+// stateFile locates a history, log or cache file in $XDG_STATE_HOME/sftpsender
+// (default ~/.local/state/sftpsender)
+func stateFile(name string) string {
+	return xdgFile("XDG_STATE_HOME", "~/.local/state", name)
+}
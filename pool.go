@@ -0,0 +1,65 @@
+package main
+
+import "sync"
+
+// transferPool runs file transfers on a fixed number of goroutines and keeps
+// the first error, after which no further jobs are started
+type transferPool struct {
+	jobs chan func() error
+	wg   sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newTransferPool(workers int) *transferPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &transferPool{jobs: make(chan func() error)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				if p.failed() != nil {
+					continue // drain remaining jobs after a failure
+				}
+				if err := job(); err != nil {
+					p.setErr(err)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a job and returns the first error seen so far, so callers can stop early
+func (p *transferPool) submit(job func() error) error {
+	if err := p.failed(); err != nil {
+		return err
+	}
+	p.jobs <- job
+	return nil
+}
+
+// wait blocks until all queued jobs are done and returns the first error
+func (p *transferPool) wait() error {
+	close(p.jobs)
+	p.wg.Wait()
+	return p.failed()
+}
+
+func (p *transferPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *transferPool) setErr(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+)
+
+// preflightMinSize is the size from which single-file uploads are checked
+// before they start; directories are always checked
+const preflightMinSize = 16 * 1024 * 1024
+
+// preflightUpload checks up front that an upload can be written to the host:
+// the destination must have room for it and, for large uploads, be writable
+func (s *SftpSender) preflightUpload(host string, cred *Credential, c *sftp.Client, localPath, remotePath string, info os.FileInfo) error {
+	if info.IsDir() || info.Size() >= preflightMinSize {
+		dir := remotePath
+		if !info.IsDir() {
+			dir = path.Dir(remotePath)
+		}
+		if err := checkWritable(c, dir, cred.Username); err != nil {
+			return err
+		}
+	}
+	return s.checkFreeSpace(host, c, remotePath, s.uploadNeeds(c, localPath, remotePath, info))
+}
+
+// probeSeq numbers the probe files of checkWritable
+var probeSeq atomic.Int64
+
+// checkWritable creates and removes a probe file in dir or, when dir does not
+// exist yet, in its nearest existing parent where it would be created
+func checkWritable(c *sftp.Client, dir, user string) error {
+	for {
+		info, err := c.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("remote path %s is not a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) || dir == "/" || dir == "." {
+			return fmt.Errorf("failed to stat %s: %w", dir, err)
+		}
+		dir = path.Dir(dir)
+	}
+
+	// Uploads of one run to the same directory probe at the same time, so
+	// the name is unique per probe, not just per process
+	probe := path.Join(dir, fmt.Sprintf(".sftpsender-probe-%d-%d", os.Getpid(), probeSeq.Add(1)))
+	f, err := c.OpenFile(probe, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w on %s for user %s", ErrPermissionDenied, dir, user)
+		}
+		return fmt.Errorf("cannot write to %s: %w", dir, err)
+	}
+	f.Close()
+	c.Remove(probe)
+	return nil
+}
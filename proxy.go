@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialTCP connects to address directly or through the proxy of cred. The
+// credential's proxy overrides the global one; "direct" disables it.
+func (s *SftpSender) dialTCP(cred *Credential, address string, timeout time.Duration) (net.Conn, error) {
+	proxy := s.config.Proxy
+	if cred.Proxy != "" {
+		proxy = cred.Proxy
+	}
+	if proxy == "" || proxy == "direct" {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: want socks5://host:port or http://host:port", proxy)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", u.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, u, address)
+	case "http":
+		conn, err = httpConnect(conn, u, address)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q: want socks5 or http", u.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect asks a SOCKS5 proxy (RFC 1928) to connect to address. The host
+// name is resolved by the proxy, so DNS queries go through it as well.
+func socks5Connect(conn net.Conn, u *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || len(host) > 255 {
+		return fmt.Errorf("invalid address %s", address)
+	}
+
+	methods := []byte{0x00}
+	if u.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		// Username/password authentication, RFC 1929
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		req := append([]byte{0x01, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("authentication rejected")
+		}
+	default:
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	req := append([]byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("connect to %s failed: %s", address, socks5Error(head[1]))
+	}
+	// Skip the bound address of the reply
+	var skip int
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("invalid reply address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func socks5Error(code byte) string {
+	switch code {
+	case 0x02:
+		return "not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	}
+	return fmt.Sprintf("error code %d", code)
+}
+
+// httpConnect opens a tunnel to address through an HTTP proxy with CONNECT
+func httpConnect(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("CONNECT to " + address + " failed: " + resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The server already sent its SSH banner, keep it for the handshake
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads bytes already buffered from the connection first
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
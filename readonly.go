@@ -0,0 +1,13 @@
+package main
+
+import "fmt"
+
+// refuseReadOnly returns ErrReadOnly when cred may not be modified, either
+// because it is marked read_only in the config or the run is --read-only.
+// Every operation that writes or deletes on a host checks it before connecting.
+func (s *SftpSender) refuseReadOnly(cred *Credential, action string) error {
+	if !s.readOnly && !cred.ReadOnly {
+		return nil
+	}
+	return fmt.Errorf("%s is %w, refusing to %s", credentialLabel(*cred), ErrReadOnly, action)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// isTransient reports whether a failed operation may succeed when repeated.
+// Timeouts, dropped connections and temporary DNS failures are transient;
+// authentication, host key, permission, disk space and missing file errors are
+// not, and retrying them only risks lockouts such as fail2ban bans.
+func isTransient(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrAuthFailed),
+		errors.Is(err, ErrHostKeyMismatch),
+		errors.Is(err, ErrNoSpace),
+		errors.Is(err, ErrPermissionDenied),
+		errors.Is(err, ErrCircuitOpen),
+		errors.Is(err, ErrInterrupted),
+		errors.Is(err, os.ErrNotExist):
+		return false
+	}
+
+	if errors.Is(err, ErrTransferTimeout) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, transient := range []error{
+		syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.EPIPE,
+		syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH,
+		io.EOF, io.ErrUnexpectedEOF,
+	} {
+		if errors.Is(err, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs op for host, repeating it up to s.retries times with doubling
+// delays while it fails with a transient error. Every attempt counts towards
+// the host's circuit breaker. Retries also end when the run's retry budget is
+// used up or the next attempt would start after --max-total-time.
+func (s *SftpSender) retry(host string, op func() error) error {
+	delay := s.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := s.guarded(host, op)
+		if err != nil {
+			s.hostLog(host).Debugf("%s: attempt %d failed (transient: %t): %v\n", host, attempt, isTransient(err), err)
+		}
+		if err == nil || attempt > s.retries || errors.Is(err, ErrCircuitOpen) || s.interrupted() {
+			return err
+		}
+		if !isTransient(err) {
+			if s.retries > 0 {
+				s.hostLog(host).Warnf("%s: not retrying permanent error: %v\n", host, err)
+			}
+			return err
+		}
+		if s.breakerAllow(host) != nil {
+			// This failure opened the breaker, the host gets no more attempts
+			return err
+		}
+		if deadline := s.interrupts.deadline; !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			s.hostLog(host).Warnf("%s: not retrying, --max-total-time ends before the next attempt: %v\n", host, err)
+			return err
+		}
+		if s.retryBudget > 0 && s.retriesUsed.Add(1) > int64(s.retryBudget) {
+			s.warnOnce("retry-budget", "Retry budget of %d used up, failing further transient errors right away\n", s.retryBudget)
+			return err
+		}
+		s.hostLog(host).Warnf("%s: attempt %d/%d failed, retrying in %s: %v\n", host, attempt, s.retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
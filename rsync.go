@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rsyncBridgeCommand is the hidden subcommand rsync runs as its remote shell.
+// It forwards the remote rsync command line and stdio over a unix socket to the
+// parent sftpsender, which executes it on the already established SSH connection.
+const rsyncBridgeCommand = "rsync-bridge"
+
+// rsyncOutPrefix marks the per-file lines rsync prints with --out-format
+const rsyncOutPrefix = "sftpsender-file:"
+
+// uploadRsync syncs a local directory to remotePath with rsync
+func (s *SftpSender) uploadRsync(client *ssh.Client, host, localPath, remotePath string) error {
+	if err := remoteRun(client, s.remoteUmask("mkdir -p "+shellQuote(path.Dir(remotePath)))); err != nil {
+		return fmt.Errorf("failed to create remote directory: %w", err)
+	}
+	return s.runRsync(client, "upload", host, localPath, remotePath,
+		filepath.Clean(localPath)+string(filepath.Separator), "sftpsender:"+strings.TrimSuffix(remotePath, "/")+"/")
+}
+
+// downloadRsync syncs a remote directory to localPath with rsync
+func (s *SftpSender) downloadRsync(client *ssh.Client, host, remotePath, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+	return s.runRsync(client, "download", host, localPath, remotePath,
+		"sftpsender:"+strings.TrimSuffix(remotePath, "/")+"/", filepath.Clean(localPath)+string(filepath.Separator))
+}
+
+func (s *SftpSender) runRsync(client *ssh.Client, direction, host, localPath, remotePath, src, dst string) error {
+	var filters []string
+	if direction == "download" {
+		filters = s.rsyncDepthFilter()
+		if err := s.reserveRsyncDownload(client, remotePath, filters, src, dst); err != nil {
+			return err
+		}
+	}
+	filters = append(filters, s.filter.rsyncArgs()...)
+	if s.rsyncDelete && s.trash {
+		// Deleted (and replaced) files are moved below the destination; the
+		// exclude keeps --delete away from earlier trash
+		filters = append(filters, "--exclude=/"+trashDir+"/", "--backup",
+			"--backup-dir="+trashDir+"/"+time.Now().Format(snapshotLayout))
+	}
+	if s.rsyncDelete {
+		target, local := remotePath, false
+		if direction == "download" {
+			target, local = localPath, true
+		}
+		if err := s.checkDeleteTarget(host, target, local); err != nil {
+			return err
+		}
+		if err := s.previewRsyncDeletions(client, host, filters, src, dst); err != nil {
+			return err
+		}
+	}
+
+	args := append([]string{"-a", "-s", "--out-format=" + rsyncOutPrefix + "%l:%n"}, filters...)
+	if s.resume {
+		// Keep partial files and append to them, checking the whole file after
+		args = append(args, "--partial", "--append-verify")
+	}
+	if s.xattrs {
+		args = append(args, "-X", "-A")
+	}
+	if s.fileMode != 0 && direction == "upload" {
+		args = append(args, fmt.Sprintf("--chmod=F%o", s.fileMode))
+	}
+	if s.sync && s.syncChecksum {
+		// rsync compares size and modification time itself
+		args = append(args, "--checksum")
+	}
+	if s.rsyncDelete {
+		args = append(args, "--delete")
+	}
+	cmd, cleanup, err := rsyncCommand(client, append(args, src, dst)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	defer s.onAbort("rsync bridge", func() error { cleanup(); return nil })()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start rsync: %w", err)
+	}
+
+	// Every transferred file is recorded like an SFTP transfer; rsync does not
+	// report checksums so none are stored
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, rsyncOutPrefix) {
+			fmt.Println(line)
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, rsyncOutPrefix), ":", 2)
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if len(parts) != 2 || err != nil || strings.HasSuffix(parts[1], "/") {
+			continue
+		}
+		s.addTransferred(size)
+		s.fileDone(direction, host, filepath.Join(localPath, filepath.FromSlash(parts[1])), path.Join(remotePath, parts[1]), size, "", start, nil)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("rsync failed: %w", err)
+	}
+	return nil
+}
+
+// previewRsyncDeletions runs rsync --delete in dry-run mode and prints the
+// files the real run is about to delete
+func (s *SftpSender) previewRsyncDeletions(client *ssh.Client, host string, filters []string, src, dst string) error {
+	args := append([]string{"-a", "-s", "--dry-run", "--delete", "--out-format=%i %n"}, filters...)
+	cmd, cleanup, err := rsyncCommand(client, append(args, src, dst)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("rsync dry run failed: %w", err)
+	}
+
+	var deletions []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, ok := strings.CutPrefix(line, "*deleting"); ok {
+			deletions = append(deletions, strings.TrimSpace(name))
+		}
+	}
+	if len(deletions) == 0 {
+		return nil
+	}
+	dir := strings.TrimPrefix(dst, "sftpsender:")
+	if s.trash {
+		s.hostLog(host).Infof("--delete will move %d files of %s to %s:\n", len(deletions), dir, trashDir)
+	} else {
+		s.hostLog(host).Infof("--delete will remove %d files from %s:\n", len(deletions), dir)
+	}
+	for _, name := range deletions {
+		s.hostLog(host).Infof("  (dry run) deleting %s\n", name)
+	}
+	return nil
+}
+
+// reserveRsyncDownload sizes a download with an rsync dry run and checks it
+// against --max-download-size before anything is written
+func (s *SftpSender) reserveRsyncDownload(client *ssh.Client, remotePath string, filters []string, src, dst string) error {
+	if s.caps.maxSize <= 0 {
+		return nil
+	}
+	args := append([]string{"-a", "-s", "--dry-run", "--out-format=%l:%n"}, filters...)
+	cmd, cleanup, err := rsyncCommand(client, append(args, src, dst)...)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("rsync dry run failed: %w", err)
+	}
+
+	var total int64
+	for _, line := range strings.Split(string(out), "\n") {
+		size, name, ok := strings.Cut(line, ":")
+		if n, err := strconv.ParseInt(size, 10, 64); ok && err == nil && !strings.HasSuffix(name, "/") {
+			total += n
+		}
+	}
+	return s.reserveDownload(remotePath, total)
+}
+
+// rsyncCommand prepares an rsync command whose remote shell is the bridge to
+// the SSH connection; cleanup removes the bridge once the command is done
+func rsyncCommand(client *ssh.Client, args ...string) (*exec.Cmd, func(), error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to locate sftpsender executable: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "sftpsender-rsync")
+	if err != nil {
+		return nil, nil, err
+	}
+	socketPath := filepath.Join(dir, "bridge.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, fmt.Errorf("failed to create rsync bridge: %w", err)
+	}
+	go serveRsyncBridge(listener, client)
+
+	shell := shellQuote(self) + " " + rsyncBridgeCommand + " " + shellQuote(socketPath)
+	cmd := exec.Command("rsync", append([]string{"-e", shell}, args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// serveRsyncBridge runs each command sent by a bridge process on the SSH
+// connection, splicing the connection to the session's stdio
+func serveRsyncBridge(listener net.Listener, client *ssh.Client) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			command, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			session, err := client.NewSession()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rsync bridge: failed to open SSH session: %v\n", err)
+				return
+			}
+			defer session.Close()
+			stdin, err := session.StdinPipe()
+			if err != nil {
+				return
+			}
+			session.Stdout = conn
+			session.Stderr = os.Stderr
+			if err := session.Start(strings.TrimSuffix(command, "\n")); err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stdin, reader)
+				stdin.Close()
+			}()
+			session.Wait()
+		}()
+	}
+}
+
+// runRsyncBridge implements the hidden rsync-bridge subcommand. rsync calls it
+// as "rsync-bridge <socket> <host> <command...>".
+func runRsyncBridge(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: sftpsender %s <socket> <host> <command>", rsyncBridgeCommand)
+	}
+	conn, err := net.Dial("unix", args[0])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, strings.Join(args[2:], " ")); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if uc, ok := conn.(*net.UnixConn); ok {
+			uc.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// checkDeleteTarget refuses destructive operations (rsync --delete) on
+// directories where a wrong path would be disastrous: the filesystem root,
+// home directories and their parents, and, when the host has delete_prefix
+// set, anything outside that prefix. --unsafe skips the checks.
+func (s *SftpSender) checkDeleteTarget(host, target string, local bool) error {
+	if s.unsafe {
+		return nil
+	}
+	refuse := func(reason string) error {
+		return fmt.Errorf("refusing to delete files in %s (%s), use --unsafe to override", target, reason)
+	}
+
+	var clean string
+	if local {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return err
+		}
+		clean = filepath.ToSlash(abs)
+		if home, err := os.UserHomeDir(); err == nil && clean == filepath.ToSlash(filepath.Clean(home)) {
+			return refuse("home directory")
+		}
+	} else {
+		clean = path.Clean(target)
+		if clean == "." || clean == "~" {
+			// Relative remote paths start in the login directory
+			return refuse("home directory")
+		}
+	}
+
+	if clean == "/" || strings.HasSuffix(clean, ":/") {
+		return refuse("filesystem root")
+	}
+	if isHomeRoot(clean) {
+		return refuse("home directory")
+	}
+
+	if local {
+		return nil
+	}
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	if cred.DeletePrefix != "" {
+		prefix := path.Clean(cred.DeletePrefix)
+		if clean != prefix && !strings.HasPrefix(clean, strings.TrimSuffix(prefix, "/")+"/") {
+			return refuse("outside delete_prefix " + prefix)
+		}
+	}
+	return nil
+}
+
+// checkRemotePrefix refuses to action remotePath when cred has
+// allowed_remote_prefixes and the path is below none of them. Paths are
+// compared after cleaning, so ".." cannot climb out of a prefix.
+func checkRemotePrefix(cred *Credential, remotePath, action string) error {
+	if len(cred.AllowedRemotePrefixes) == 0 {
+		return nil
+	}
+	clean := path.Clean(remotePath)
+	for _, prefix := range cred.AllowedRemotePrefixes {
+		prefix = path.Clean(prefix)
+		if clean == prefix || strings.HasPrefix(clean, strings.TrimSuffix(prefix, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("refusing to %s %s on %s: outside allowed_remote_prefixes %s",
+		action, remotePath, credentialLabel(*cred), strings.Join(cred.AllowedRemotePrefixes, ", "))
+}
+
+// isHomeRoot matches /root, /home, /Users and the home directories below them
+func isHomeRoot(p string) bool {
+	switch p {
+	case "/root", "/home", "/Users":
+		return true
+	}
+	for _, base := range []string{"/home/", "/Users/"} {
+		if rest, ok := strings.CutPrefix(p, base); ok && !strings.Contains(rest, "/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// isNoSFTPSubsystem reports whether the server refused to start the SFTP subsystem
+func isNoSFTPSubsystem(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "subsystem request failed")
+}
+
+// shellQuote quotes a value for a POSIX shell on the remote host
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// scpSession is one run of the remote scp program in sink (-t) or source (-f) mode
+type scpSession struct {
+	session *ssh.Session
+	in      io.WriteCloser
+	out     *bufio.Reader
+}
+
+func startSCP(client *ssh.Client, command string) (*scpSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start scp on the remote: %w", err)
+	}
+	return &scpSession{session: session, in: in, out: bufio.NewReader(out)}, nil
+}
+
+// readAck reads the status byte the remote scp sends after every message
+func (c *scpSession) readAck() error {
+	b, err := c.out.ReadByte()
+	if err != nil {
+		return fmt.Errorf("failed to read scp response: %w", err)
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := c.out.ReadString('\n')
+	return fmt.Errorf("remote scp: %s", strings.TrimSpace(msg))
+}
+
+func (c *scpSession) send(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(c.in, format, args...); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+func (c *scpSession) close() error {
+	c.in.Close()
+	defer c.session.Close()
+	return c.session.Wait()
+}
+
+// uploadSCP copies a local file or directory to remotePath with the SCP protocol,
+// for servers without an SFTP subsystem
+func (s *SftpSender) uploadSCP(client *ssh.Client, host, localPath, remotePath string) error {
+	if s.resume {
+		s.warnOnce("resume scp "+host, "SCP cannot resume transfers, sending whole files to %s\n", host)
+	}
+	if s.sync {
+		s.warnOnce("sync scp "+host, "SCP cannot compare files, sending every file to %s\n", host)
+	}
+	parent := path.Dir(remotePath)
+	c, err := startSCP(client, s.remoteUmask(fmt.Sprintf("mkdir -p %s && scp -r -t %s", shellQuote(parent), shellQuote(parent))))
+	if err != nil {
+		return err
+	}
+	if err := c.readAck(); err != nil {
+		c.close()
+		return err
+	}
+
+	err = s.scpSendEntry(c, host, localPath, remotePath, "")
+	if closeErr := c.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("remote scp failed: %v", closeErr)
+	}
+	return err
+}
+
+// scpSendEntry sends localPath, which is at the slash-separated path rel
+// below the uploaded directory
+func (s *SftpSender) scpSendEntry(c *scpSession, host, localPath, remotePath, rel string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat local path: %w", err)
+	}
+	name := path.Base(remotePath)
+
+	if !info.IsDir() {
+		start := time.Now()
+		n, checksum, err := s.scpSendFile(c, localPath, name, info)
+		return s.fileDone("upload", host, localPath, remotePath, n, checksum, start, err)
+	}
+
+	if err := c.send("D%04o 0 %s\n", info.Mode().Perm(), name); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			continue
+		}
+		if s.filter.excludes(path.Join(rel, entry.Name()), entry.IsDir()) {
+			continue
+		}
+		if err := s.scpSendEntry(c, host, filepath.Join(localPath, entry.Name()), path.Join(remotePath, entry.Name()),
+			path.Join(rel, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return c.send("E\n")
+}
+
+func (s *SftpSender) scpSendFile(c *scpSession, localPath, name string, info os.FileInfo) (int64, string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer f.Close()
+
+	mode := info.Mode().Perm()
+	if s.fileMode != 0 {
+		mode = s.fileMode
+	}
+	if err := c.send("C%04o %d %s\n", mode, info.Size(), name); err != nil {
+		return 0, "", err
+	}
+
+	buffer := s.getBuffer()
+	defer s.putBuffer(buffer)
+	hash := sha256.New()
+	n, err := io.CopyBuffer(c.in, io.TeeReader(io.LimitReader(f, info.Size()), hash), *buffer)
+	if err != nil {
+		return n, "", fmt.Errorf("failed to copy file content: %w", err)
+	}
+	if n != info.Size() {
+		return n, "", fmt.Errorf("file changed size during upload")
+	}
+	if err := c.send("\x00"); err != nil {
+		return n, "", err
+	}
+	s.addTransferred(n)
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// downloadSCP copies a remote file or directory to localPath with the SCP protocol
+func (s *SftpSender) downloadSCP(client *ssh.Client, host, remotePath, localPath string) error {
+	if s.resume {
+		s.warnOnce("resume scp "+host, "SCP cannot resume transfers, fetching whole files from %s\n", host)
+	}
+	if s.sync {
+		s.warnOnce("sync scp "+host, "SCP cannot compare files, fetching every file from %s\n", host)
+	}
+	if s.decompress {
+		s.warnOnce("decompress scp "+host, "SCP downloads from %s are not decompressed\n", host)
+	}
+	c, err := startSCP(client, "scp -r -f "+shellQuote(remotePath))
+	if err != nil {
+		return err
+	}
+
+	err = s.scpReceive(c, host, remotePath, localPath)
+	if closeErr := c.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("remote scp failed: %v", closeErr)
+	}
+	return err
+}
+
+// scpReceive reads the source stream. The top-level entry is written to
+// localPath whatever the server calls it, and nested names may not contain
+// path separators, so a malicious server cannot write outside the target.
+func (s *SftpSender) scpReceive(c *scpSession, host, remotePath, localPath string) error {
+	type dir struct{ local, remote string }
+	var stack []dir
+
+	target := func(name string) (string, string, error) {
+		if len(stack) == 0 {
+			return localPath, remotePath, nil
+		}
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", "", fmt.Errorf("remote scp sent invalid file name %q", name)
+		}
+		top := stack[len(stack)-1]
+		return filepath.Join(top.local, name), path.Join(top.remote, name), nil
+	}
+
+	if _, err := c.in.Write([]byte{0}); err != nil {
+		return err
+	}
+	for {
+		line, err := c.out.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read scp response: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("empty scp message")
+		}
+
+		switch line[0] {
+		case 1, 2:
+			return fmt.Errorf("remote scp: %s", strings.TrimSpace(line[1:]))
+		case 'T':
+			// Timestamps are not preserved
+		case 'E':
+			if len(stack) == 0 {
+				return fmt.Errorf("unexpected end of directory from remote scp")
+			}
+			stack = stack[:len(stack)-1]
+		case 'C', 'D':
+			mode, size, name, err := parseSCPHeader(line)
+			if err != nil {
+				return err
+			}
+			local, remote, err := target(name)
+			if err != nil {
+				return err
+			}
+			// The source sends excluded entries too; their files are skipped
+			rel := strings.TrimPrefix(strings.TrimPrefix(remote, remotePath), "/")
+			excluded := len(stack) > 0 && s.filter.excludes(rel, line[0] == 'D')
+			if line[0] == 'D' {
+				if !excluded {
+					if err := os.MkdirAll(local, mode|0700); err != nil {
+						return fmt.Errorf("failed to create local directory: %w", err)
+					}
+				}
+				stack = append(stack, dir{local, remote})
+				break
+			}
+			if excluded {
+				if err := scpSkipFile(c, size); err != nil {
+					return err
+				}
+				break
+			}
+			if s.caps.maxDepth > 0 && len(stack) > s.caps.maxDepth {
+				// Files are at the depth of their directory in the stack
+				if err := scpSkipFile(c, size); err != nil {
+					return err
+				}
+				break
+			}
+			if err := s.reserveDownload(remote, size); err != nil {
+				return err
+			}
+			start := time.Now()
+			n, checksum, err := s.scpReceiveFile(c, local, mode, size)
+			if err := s.fileDone("download", host, local, remote, n, checksum, start, err); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected scp message %q", line)
+		}
+
+		if _, err := c.in.Write([]byte{0}); err != nil {
+			return err
+		}
+		// Only one top-level entry was requested, anything after it is ignored
+		if len(stack) == 0 && (line[0] == 'C' || line[0] == 'E') {
+			return nil
+		}
+	}
+}
+
+func (s *SftpSender) scpReceiveFile(c *scpSession, localPath string, mode os.FileMode, size int64) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create local directory: %w", err)
+	}
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := c.in.Write([]byte{0}); err != nil {
+		return 0, "", err
+	}
+
+	buffer := s.getBuffer()
+	defer s.putBuffer(buffer)
+	hash := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(f, hash), io.LimitReader(c.out, size), *buffer)
+	if err != nil {
+		return n, "", fmt.Errorf("failed to copy file content: %w", err)
+	}
+	if n != size {
+		return n, "", fmt.Errorf("remote scp ended the file early")
+	}
+	if err := c.readAck(); err != nil {
+		return n, "", err
+	}
+	s.addTransferred(n)
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// scpSkipFile accepts a file from the remote scp and discards its content
+func scpSkipFile(c *scpSession, size int64) error {
+	if _, err := c.in.Write([]byte{0}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, c.out, size); err != nil {
+		return fmt.Errorf("failed to skip file content: %w", err)
+	}
+	return c.readAck()
+}
+
+// parseSCPHeader parses a "C0644 123 name" or "D0755 0 name" message
+func parseSCPHeader(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", fmt.Errorf("malformed scp message %q", line)
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("malformed scp mode %q", parts[0])
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("malformed scp size %q", parts[1])
+	}
+	return os.FileMode(mode).Perm(), size, parts[2], nil
+}
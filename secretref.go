@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A password of the form "<scheme>:<reference>" whose scheme has a resolver
+// is not the password itself but where to fetch it from at runtime, such as
+// "keyring:sftpsender/worker1" or "vault:secret/data/workers#password"
+type secretResolver func(ref string) (string, error)
+
+var secretResolvers = map[string]secretResolver{
+	"keyring": keyringResolve,
+	"vault":   vaultResolve,
+}
+
+// secretCache holds the passwords already resolved, so a reference shared by
+// many hosts is only fetched once per run
+var secretCache sync.Map
+
+// secretRef splits a password into the resolver and reference it names, if any
+func secretRef(value string) (secretResolver, string, bool) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, "", false
+	}
+	resolve, ok := secretResolvers[scheme]
+	return resolve, ref, ok
+}
+
+func isSecretRef(value string) bool {
+	_, _, ok := secretRef(value)
+	return ok
+}
+
+// resolvePassword returns the password of a credential, fetching it from its
+// secrets backend when the config holds a reference
+func resolvePassword(cred *Credential) (string, error) {
+	resolve, ref, ok := secretRef(cred.Password)
+	if !ok {
+		return cred.Password, nil
+	}
+	if password, ok := secretCache.Load(cred.Password); ok {
+		return password.(string), nil
+	}
+	password, err := resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the password of %s: %w", credentialLabel(*cred), err)
+	}
+	secretCache.Store(cred.Password, password)
+	return password, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// Encrypted config values are encPrefix followed by base64 of salt, nonce and
+// the AES-256-GCM ciphertext. The key is derived from the master passphrase
+// with scrypt; all values encrypted together share a salt, so the key is only
+// derived once per file.
+const (
+	encPrefix     = "enc:"
+	encSaltSize   = 16
+	passphraseEnv = "SFTPSENDER_PASSPHRASE"
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+)
+
+// secretFields are the credential fields encrypted by "config encrypt"
+var secretFields = []string{"password", "secret"}
+
+// masterKeys derives and caches the keys of one passphrase by salt
+type masterKeys struct {
+	passphrase []byte
+	mu         sync.Mutex
+	keys       map[string][]byte
+}
+
+func (m *masterKeys) key(salt []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key, ok := m.keys[string(salt)]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key(m.passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	if m.keys == nil {
+		m.keys = make(map[string][]byte)
+	}
+	m.keys[string(salt)] = key
+	return key, nil
+}
+
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encPrefix)
+}
+
+// encryptValue encrypts a config value with the key of salt
+func (m *masterKeys) encryptValue(plain string, salt []byte) (string, error) {
+	key, err := m.key(salt)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := append(append(append([]byte{}, salt...), nonce...), gcm.Seal(nil, nonce, []byte(plain), nil)...)
+	return encPrefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// decryptValue decrypts a value written by encryptValue
+func (m *masterKeys) decryptValue(value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encPrefix))
+	if err != nil || len(data) < encSaltSize {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	key, err := m.key(data[:encSaltSize])
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	data = data[encSaltSize:]
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong passphrase or corrupted value")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readPassphrase returns the master passphrase from $SFTPSENDER_PASSPHRASE or
+// asks for it on the terminal, twice when confirm is set
+func readPassphrase(confirm bool) ([]byte, error) {
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("the config has encrypted credentials, set %s or run on a terminal", passphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "Master passphrase: ")
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(again) != string(p) {
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+// decryptCredentials replaces the encrypted fields of the credentials with
+// their plain values, asking for the passphrase only if there are any
+func decryptCredentials(creds []Credential) error {
+	var m *masterKeys
+	for i := range creds {
+		for _, field := range []*string{&creds[i].Password, &creds[i].Secret} {
+			if !isEncrypted(*field) {
+				continue
+			}
+			if m == nil {
+				passphrase, err := readPassphrase(false)
+				if err != nil {
+					return err
+				}
+				m = &masterKeys{passphrase: passphrase}
+			}
+			plain, err := m.decryptValue(*field)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt credential %s: %w", credentialLabel(creds[i]), err)
+			}
+			*field = plain
+		}
+	}
+	return nil
+}
+
+func credentialLabel(cred Credential) string {
+	if cred.Name != "" {
+		return cred.Name
+	}
+	return cred.IP
+}
+
+// runConfig implements the "config" subcommand: "config encrypt" encrypts the
+// passwords and secrets of the config file in place, "config decrypt" turns
+// them back into plain text
+func runConfig(args []string) error {
+	fs := pflag.NewFlagSet("config", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (fs.Arg(0) != "encrypt" && fs.Arg(0) != "decrypt") {
+		return fmt.Errorf("usage: sftpsender config (encrypt | decrypt) [--config FILE]")
+	}
+	encrypt := fs.Arg(0) == "encrypt"
+	path := expandHomeDir(*configPath)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	passphrase, err := readPassphrase(encrypt)
+	if err != nil {
+		return err
+	}
+	m := &masterKeys{passphrase: passphrase}
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, item := range config {
+		if item.Key != "credentials" {
+			continue
+		}
+		entries, _ := item.Value.([]interface{})
+		for _, entry := range entries {
+			fields, ok := entry.(yaml.MapSlice)
+			if !ok {
+				continue
+			}
+			for i := range fields {
+				value, ok := fields[i].Value.(string)
+				if !ok || value == "" || isSecretRef(value) || !isSecretField(fields[i].Key) {
+					continue
+				}
+				switch {
+				case isEncrypted(value):
+					// Already encrypted values must use the same passphrase
+					plain, err := m.decryptValue(value)
+					if err != nil {
+						return err
+					}
+					if !encrypt {
+						fields[i].Value = plain
+						changed++
+					}
+				case encrypt:
+					if fields[i].Value, err = m.encryptValue(value, salt); err != nil {
+						return err
+					}
+					changed++
+				}
+			}
+		}
+	}
+	if changed == 0 {
+		logInfof("Nothing to %s in %s\n", fs.Arg(0), *configPath)
+		return nil
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode config file: %w", err)
+	}
+	// No backup is kept: it would hold the passwords in plain text
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if encrypt {
+		logInfof("Encrypted %d values in %s\n", changed, *configPath)
+	} else {
+		logInfof("Decrypted %d values in %s\n", changed, *configPath)
+	}
+	return nil
+}
+
+func isSecretField(key interface{}) bool {
+	for _, f := range secretFields {
+		if key == f {
+			return true
+		}
+	}
+	return false
+}
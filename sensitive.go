@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sensitiveNames are file names that usually hold secrets; patterns may use * as in filepath.Match
+var sensitiveNames = []string{
+	".env", ".env.*", "*.env",
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", "*.pem", "*.key", "*.p12", "*.pfx", "*.kdbx",
+	".netrc", ".pgpass", ".npmrc", ".pypirc", ".git-credentials",
+	"credentials.json", "application_default_credentials.json", "service-account*.json",
+}
+
+// sensitiveDirs are directories whose whole content is sensitive
+var sensitiveDirs = []string{".git", ".ssh", ".gnupg", ".aws", ".azure", ".kube", ".docker"}
+
+// findSensitive lists the sensitive files and directories among the upload
+// paths. Directories are searched; paths that do not exist are ignored.
+func findSensitive(paths []string) []string {
+	var found []string
+	for _, root := range paths {
+		filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if matchesAny(d.Name(), sensitiveDirs) {
+					found = append(found, p+string(filepath.Separator))
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if matchesAny(d.Name(), sensitiveNames) {
+				found = append(found, p)
+			}
+			return nil
+		})
+	}
+	return found
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// guardSensitive refuses to upload sensitive files unless the user confirms
+// it on a terminal. Without a terminal --allow-sensitive is the only way.
+func guardSensitive(paths []string) error {
+	found := findSensitive(paths)
+	if len(found) == 0 {
+		return nil
+	}
+	logWarnf("The upload contains %d files that may hold secrets:\n", len(found))
+	for i, p := range found {
+		if i == 10 {
+			logWarnf("  ... and %d more\n", len(found)-i)
+			break
+		}
+		logWarnf("  %s\n", p)
+	}
+
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 || ciMode {
+		return fmt.Errorf("refusing to upload sensitive files, use --allow-sensitive to upload them anyway")
+	}
+	fmt.Fprint(os.Stderr, "Upload them anyway? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return fmt.Errorf("upload cancelled, use --allow-sensitive to upload them without asking")
+	}
+	return nil
+}
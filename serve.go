@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+)
+
+var defaultServeHostKey = configFile("serve_host_key")
+
+// runServeSFTP implements the "serve-sftp" subcommand: a restricted SFTP-only
+// server confined to one directory, authenticated by public keys only
+func runServeSFTP(args []string) error {
+	fs := pflag.NewFlagSet("serve-sftp", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	listen := fs.String("listen", ":2022", "Address to listen on")
+	root := fs.String("root", ".", "Directory clients are confined to")
+	authorizedKeys := fs.String("authorized-keys", "", "authorized_keys file with the public keys allowed to connect (required)")
+	hostKeyPath := fs.String("host-key", defaultServeHostKey, "Server host key, generated on first use")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if *authorizedKeys == "" {
+		return fmt.Errorf("--authorized-keys is required")
+	}
+
+	allowed, err := loadAuthorizedKeys(expandHomeDir(*authorizedKeys))
+	if err != nil {
+		return err
+	}
+	hostKey, err := loadOrCreateHostKey(expandHomeDir(*hostKeyPath))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*root, 0755); err != nil {
+		return fmt.Errorf("failed to create root directory: %w", err)
+	}
+	rootDir, err := filepath.Abs(*root)
+	if err == nil {
+		rootDir, err = filepath.EvalSymlinks(rootDir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve root directory: %w", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if allowed[string(key.Marshal())] {
+				return &ssh.Permissions{Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)}}, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	logInfof("Serving SFTP on %s, root %s (host key %s)\n", listener.Addr(), rootDir, ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSFTPConn(conn, config, rootDir)
+	}
+}
+
+func serveSFTPConn(conn net.Conn, config *ssh.ServerConfig, root string) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		logWarnf("serve-sftp: handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	defer sconn.Close()
+	logInfof("serve-sftp: %s connected as %s (%s)\n", conn.RemoteAddr(), sconn.User(), sconn.Permissions.Extensions["fingerprint"])
+	go ssh.DiscardRequests(reqs)
+
+	handler := &rootHandler{root: root}
+	handlers := sftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler}
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are allowed")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		// Only the sftp subsystem is offered, no shell or exec
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				server := sftp.NewRequestServer(channel, handlers)
+				if err := server.Serve(); err != nil && err != io.EOF {
+					logWarnf("serve-sftp: session from %s ended: %v\n", conn.RemoteAddr(), err)
+				}
+				server.Close()
+				return
+			}
+		}()
+	}
+	logInfof("serve-sftp: %s disconnected\n", conn.RemoteAddr())
+}
+
+// rootHandler serves SFTP requests from a directory. Clients can read, list,
+// create directories, upload and rename; deleting and links are refused.
+type rootHandler struct {
+	root string
+}
+
+// resolve maps an SFTP path below the root, refusing paths that escape it
+// through symlinks
+func (h *rootHandler) resolve(p string) (string, error) {
+	full := filepath.Join(h.root, filepath.FromSlash(path.Clean("/"+p)))
+
+	existing := full
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if real != h.root && !strings.HasPrefix(real, h.root+string(filepath.Separator)) {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return full, nil
+}
+
+func (h *rootHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (h *rootHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	p, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	flags := os.O_WRONLY
+	pflags := r.Pflags()
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(p, flags, 0644)
+}
+
+func (h *rootHandler) Filecmd(r *sftp.Request) error {
+	p, err := h.resolve(r.Filepath)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case "Mkdir":
+		return os.Mkdir(p, 0755)
+	case "Rename":
+		target, err := h.resolve(r.Target)
+		if err != nil {
+			return err
+		}
+		return os.Rename(p, target)
+	case "Setstat":
+		attrs := r.Attributes()
+		if r.AttrFlags().Size {
+			if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+				return err
+			}
+		}
+		if r.AttrFlags().Permissions {
+			return os.Chmod(p, attrs.FileMode().Perm())
+		}
+		return nil
+	default:
+		return sftp.ErrSSHFxPermissionDenied
+	}
+}
+
+func (h *rootHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := h.resolve(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// listerAt serves a fixed list of file infos
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dst, l[offset:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// loadAuthorizedKeys reads an authorized_keys file into a set of marshaled keys
+func loadAuthorizedKeys(file string) (map[string]bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized keys: %w", err)
+	}
+	keys := make(map[string]bool)
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", file)
+	}
+	return keys, nil
+}
+
+// loadOrCreateHostKey loads the server host key, generating an ed25519 key on first use
+func loadOrCreateHostKey(file string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(priv, "sftpsender serve-sftp")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write host key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read host key: %w", err)
+	}
+	return ssh.ParsePrivateKey(data)
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -26,6 +30,49 @@ import (
 type Config struct {
 	Credentials           []Credential `yaml:"credentials"`
 	DefaultRemoteLocation string       `yaml:"default_remote_location"`
+	Notifiers             []Notifier   `yaml:"notifiers"`
+	Hooks                 Hooks        `yaml:"hooks"`
+
+	// Transfer tuning, sizes accept K/M suffixes (e.g. 256K)
+	BufferSize string `yaml:"buffer_size"`
+	MaxPacket  string `yaml:"max_packet"`
+
+	// AuditLog enables the hash-chained audit log at this path
+	AuditLog string `yaml:"audit_log"`
+
+	// Local shell commands run before every upload / after every download
+	PreUpload    string `yaml:"pre_upload"`
+	PostDownload string `yaml:"post_download"`
+
+	// RemoteDirMode is the octal mode of remote directories created by uploads,
+	// e.g. "0750"; empty keeps the server default
+	RemoteDirMode string `yaml:"remote_dir_mode"`
+
+	// CheckUpdates opts in to a once-a-day check for new releases
+	CheckUpdates bool `yaml:"check_updates"`
+
+	// Proxy is a socks5:// or http:// proxy for all SSH connections, e.g.
+	// socks5://127.0.0.1:9050
+	Proxy string `yaml:"proxy"`
+
+	// BandwidthSchedule limits the transfer rate during time windows, e.g. to
+	// keep background syncs from competing with daytime work
+	BandwidthSchedule []BandwidthRule `yaml:"bandwidth_schedule"`
+
+	// HostKeyChecking is "tofu" (the default), pinning the key each host
+	// presents first and refusing later changes, or "off"
+	HostKeyChecking string `yaml:"host_key_checking"`
+
+	// GuardSensitive checks uploads for secrets such as .env files and private
+	// keys and asks before sending them, like --guard-sensitive
+	GuardSensitive bool `yaml:"guard_sensitive"`
+
+	// OnCollision decides what happens when several upload sources share a
+	// base name: "error" (the default), "suffix" or "keep-dirs"
+	OnCollision string `yaml:"on_collision"`
+
+	// Templates are named transfers for sftpsender run-template
+	Templates map[string]Template `yaml:"templates"`
 }
 
 type Credential struct {
@@ -34,10 +81,251 @@ type Credential struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	Secret   string `yaml:"secret"`
+
+	// IdentityFile is a private key to log in with, tried before the password
+	IdentityFile string     `yaml:"identity_file"`
+	signer       ssh.Signer // a key already in memory, used instead of IdentityFile
+
+	// Group tags the host so commands can target all hosts of a group with --group
+	Group string `yaml:"group"`
+
+	// Local shell commands run before uploads to / after downloads from this host
+	PreUpload    string `yaml:"pre_upload"`
+	PostDownload string `yaml:"post_download"`
+
+	// Remote command executed over SSH after any upload to this host completes
+	PostUploadCmd string `yaml:"post_upload_cmd"`
+
+	// DeletePrefix limits destructive operations such as rsync --delete to
+	// remote paths below this directory
+	DeletePrefix string `yaml:"delete_prefix"`
+
+	// AllowedRemotePrefixes confines uploads, deletions and exec --cwd on
+	// this host to paths below these directories
+	AllowedRemotePrefixes []string `yaml:"allowed_remote_prefixes"`
+
+	// MaxRate limits the transfer rate to this host in bytes per second, e.g. 5M
+	MaxRate string `yaml:"max_rate"`
+	maxRate int64
+
+	// Quota is the most a --split upload places on this host, e.g. 20G, in
+	// addition to what its free space allows
+	Quota string `yaml:"quota"`
+	quota int64
+
+	// ReadOnly refuses every operation that would write or delete on this host
+	ReadOnly bool `yaml:"read_only"`
+
+	// Proxy overrides the global proxy for this host, "direct" connects without one
+	Proxy string `yaml:"proxy"`
+
+	// JumpHost is the name of another credential to tunnel the connection
+	// through, like ssh -J
+	JumpHost string `yaml:"jump_host"`
+
+	// ForwardAgent makes the local ssh-agent available to remote commands on
+	// this host, so they can authenticate onward (e.g. git clone over SSH)
+	ForwardAgent bool `yaml:"forward_agent"`
 }
 
+// defaultBufferSize is 256KB = 8 packets of 32KB, optimal for SFTP
+const defaultBufferSize = 256 * 1024
+
+// Files up to smallFileThreshold bytes are uploaded in one write request on a
+// pool of smallFileConcurrency goroutines
+const (
+	smallFileThreshold   = 64 * 1024
+	smallFileConcurrency = 32
+)
+
+// mmapMinSize is the smallest file uploaded through a memory mapping with --mmap
+const mmapMinSize = 64 * 1024 * 1024
+
 type SftpSender struct {
 	config *Config
+
+	// historyPath is the transfer history file, empty disables recording
+	historyPath string
+
+	// auditPath is the tamper-evident audit log, empty disables auditing
+	auditPath string
+
+	// operation is the current run type (upload, download or autosend), passed to hooks
+	operation string
+
+	// Notifiers added or selected on the command line
+	extraNotifiers    []Notifier
+	selectedNotifiers []string
+
+	// threads is the number of files of a directory transferred concurrently
+	threads int
+
+	// bufferSize is the local copy buffer size, maxPacket the SFTP packet size (0 = library default)
+	bufferSize int
+	maxPacket  int
+
+	// streams is the number of parallel SSH connections per host
+	streams int
+
+	// maxConcurrent is the number of SFTP requests in flight per file
+	maxConcurrent int
+
+	// keepAlive is the TCP keepalive period of SSH connections
+	keepAlive time.Duration
+
+	// backend is the directory transfer backend, sftp, rsync or tar; rsyncDelete
+	// removes destination files missing from the source when using rsync
+	backend     string
+	rsyncDelete bool
+	trash       bool // move files --delete removes into trashDir instead
+
+	// Destinations are locked against concurrent runs, waiting up to lockWait;
+	// remoteLock also takes a lock directory on the host
+	lockWait   time.Duration
+	remoteLock bool
+
+	// execDir is the remote working directory of exec commands
+	execDir string
+
+	// readOnly treats every host as read_only and refuses --delete, which
+	// would remove local files when downloading
+	readOnly bool
+
+	// resume continues files a failed transfer left shorter than the source
+	// instead of sending them again from the start
+	resume bool
+
+	// xattrs copies extended attributes and POSIX ACLs along with the files
+	xattrs bool
+
+	// manifest writes a SHA256SUMS file into uploaded directories
+	manifest bool
+
+	// filter holds the --include and --exclude rules of directory transfers
+	filter transferFilter
+
+	// decompress writes downloaded .gz, .zst and .xz files decompressed
+	decompress bool
+
+	// dryRun prints what uploads and downloads would transfer instead
+	dryRun bool
+
+	// transport is "openssh" to transfer through the system ssh binary
+	transport string
+
+	// uploadNames maps upload sources to the names they get in the destination
+	// when their base names collide, see planUploadNames
+	uploadNames map[string]string
+
+	// suffixTimestamp gives downloads a timestamp suffix instead of
+	// overwriting an existing local file or directory
+	suffixTimestamp bool
+
+	// A transfer is aborted when no bytes move for stallTimeout or it runs
+	// longer than maxTime, 0 disables either limit; watches holds the
+	// *transferWatch of each host's *Credential
+	stallTimeout time.Duration
+	maxTime      time.Duration
+	watches      sync.Map
+
+	// interrupts handles Ctrl-C during a run
+	interrupts interruptState
+
+	// caps limits the size and depth of downloads
+	caps downloadCaps
+
+	// keepVersions is the number of previous copies kept of overwritten remote files
+	keepVersions int
+
+	// warned holds the keys of warnings already shown, see warnOnce
+	warned sync.Map
+
+	// uploadCache remembers uploaded content across runs for --if-changed, nil when disabled
+	uploadCache *uploadCache
+
+	// unsafe disables the safety checks of destructive operations
+	unsafe bool
+
+	// dirMode is given to remote directories created by uploads, 0 keeps the server default
+	dirMode os.FileMode
+
+	// fileMode is given to uploaded files, 0 keeps the mode the server gives them
+	fileMode os.FileMode
+
+	// useSCP falls back to the SCP protocol when the server has no SFTP subsystem
+	useSCP bool
+
+	// useMmap memory-maps local files of at least mmapMinSize bytes for uploads
+	useMmap bool
+
+	// skipExisting skips files whose destination already exists with the same size
+	skipExisting bool
+
+	// sync skips files whose destination has the same size and modification
+	// time, or the same SHA-256 with syncChecksum
+	sync         bool
+	syncChecksum bool
+
+	// autoTune derives per-connection settings from the measured round trip time
+	autoTune bool
+
+	// retries is the number of times a host operation failing with a transient
+	// error is repeated, waiting retryDelay (doubled each time) in between
+	retries    int
+	retryDelay time.Duration
+
+	// retryBudget caps the retries of all hosts of a run together, 0 is
+	// unlimited; maxTotalTime aborts the whole run after that long
+	retryBudget  int
+	retriesUsed  atomic.Int64
+	maxTotalTime time.Duration
+
+	// A host failing breakerThreshold consecutive operations gets no further
+	// work for breakerCooldown; 0 disables the breaker
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	breakerMu        sync.Mutex
+	breakers         map[string]*hostBreaker
+
+	// parallelHosts is the number of hosts autosend and broadcast upload to at once
+	parallelHosts int
+
+	// limiter throttles all SSH connections to the lower of the schedule's
+	// and limitRate's current limit, nil when there is neither;
+	// hostLimiters holds the limiter of each host with a max_rate
+	limiter      *rateLimiter
+	schedule     bandwidthSchedule
+	limitRate    int64
+	hostLimiters sync.Map
+
+	// conns keeps connections open across operations, nil dials every time
+	conns *connPool
+
+	// configPath is the config file the sender was created from
+	configPath string
+
+	// inline holds the hosts given on the command line instead of the config;
+	// saveHosts writes the ones logged in to back to the config at the end
+	inline    inlineHosts
+	saveHosts bool
+
+	// dashboard shows per-host progress of a parallel run, nil when not enabled
+	dashboard *dashboard
+
+	// logTags holds the log tags of the hosts of the parallel run in
+	// progress, see tagHosts
+	logTagsMu sync.Mutex
+	logTags   map[string]*hostTag
+
+	// Pools of copy buffers and buffered readers/writers shared by all transfers
+	bufPool    sync.Pool
+	readerPool sync.Pool
+	writerPool sync.Pool
+
+	// Transfer counters used for the run report, guarded by statsMu
+	statsMu          sync.Mutex
+	filesTransferred int
+	bytesTransferred int64
 }
 
 func expandHomeDir(path string) string {
@@ -63,16 +351,16 @@ func ensureConfigExists(configPath string) error {
 	// Create directory if it doesn't exist
 	configDir := filepath.Dir(configPath)
 	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return fmt.Errorf("failed to create config directory: %v", err)
+		return fmt.Errorf("failed to create config directory: %w", err)
 	}
 
 	// Download config file
-	fmt.Printf("Downloading config file to %s...\n", configPath)
+	logInfof("Downloading config file to %s...\n", configPath)
 	configURL := "https://raw.githubusercontent.com/rix4uni/sftpsender/refs/heads/main/config.yaml"
 
 	resp, err := http.Get(configURL)
 	if err != nil {
-		return fmt.Errorf("failed to download config file: %v", err)
+		return fmt.Errorf("failed to download config file: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -83,16 +371,16 @@ func ensureConfigExists(configPath string) error {
 	// Create config file
 	configFile, err := os.Create(configPath)
 	if err != nil {
-		return fmt.Errorf("failed to create config file: %v", err)
+		return fmt.Errorf("failed to create config file: %w", err)
 	}
 	defer configFile.Close()
 
 	// Copy content
 	if _, err := io.Copy(configFile, resp.Body); err != nil {
-		return fmt.Errorf("failed to write config file: %v", err)
+		return fmt.Errorf("failed to write config file: %w", err)
 	}
 
-	fmt.Println("Config file downloaded successfully!")
+	logInfof("Config file downloaded successfully!\n")
 	return nil
 }
 
@@ -104,18 +392,102 @@ func NewSftpSender(configPath string) (*SftpSender, error) {
 
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %v", err)
+		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	if err := yaml.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %v", err)
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if err := decryptCredentials(config.Credentials); err != nil {
+		return nil, err
+	}
+	return newSftpSender(config, configPath)
+}
+
+// newSftpSender creates a sender for a parsed config
+func newSftpSender(config *Config, configPath string) (*SftpSender, error) {
+	var err error
+	if config.HostKeyChecking != "" && config.HostKeyChecking != "tofu" && config.HostKeyChecking != "off" {
+		return nil, fmt.Errorf("invalid host_key_checking in config: %q, must be tofu or off", config.HostKeyChecking)
+	}
+	if config.OnCollision != "" && !validCollisionPolicy(config.OnCollision) {
+		return nil, fmt.Errorf("invalid on_collision in config: %q, must be error, suffix or keep-dirs", config.OnCollision)
 	}
 
 	if config.DefaultRemoteLocation == "" {
 		config.DefaultRemoteLocation = "/root"
 	}
 
-	return &SftpSender{config: config}, nil
+	s := &SftpSender{
+		config:        config,
+		configPath:    configPath,
+		threads:       1,
+		streams:       1,
+		bufferSize:    defaultBufferSize,
+		maxConcurrent: 64,
+		keepAlive:     30 * time.Second,
+		retryDelay:    5 * time.Second,
+
+		breakerThreshold: 5,
+		breakerCooldown:  5 * time.Minute,
+	}
+	if config.BufferSize != "" {
+		if s.bufferSize, err = parseSize(config.BufferSize); err != nil {
+			return nil, fmt.Errorf("invalid buffer_size in config: %w", err)
+		}
+	}
+	if config.RemoteDirMode != "" {
+		if s.dirMode, err = parseDirMode(config.RemoteDirMode); err != nil {
+			return nil, fmt.Errorf("invalid remote_dir_mode in config: %w", err)
+		}
+	}
+	if config.MaxPacket != "" {
+		if s.maxPacket, err = parseSize(config.MaxPacket); err != nil {
+			return nil, fmt.Errorf("invalid max_packet in config: %w", err)
+		}
+	}
+	if len(config.BandwidthSchedule) > 0 {
+		if s.schedule, err = parseBandwidthSchedule(config.BandwidthSchedule); err != nil {
+			return nil, fmt.Errorf("invalid bandwidth_schedule in config: %w", err)
+		}
+		s.limiter = &rateLimiter{rate: s.bandwidthLimit}
+	}
+	for i := range config.Credentials {
+		if err := parseCredentialLimits(&config.Credentials[i], "config"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// parseCredentialLimits parses the quota and max_rate sizes of a credential
+// from source, which names it in errors
+func parseCredentialLimits(cred *Credential, source string) error {
+	if cred.Quota != "" {
+		quota, err := parseSize(cred.Quota)
+		if err != nil {
+			return fmt.Errorf("invalid quota of %s in %s: %w", credentialLabel(*cred), source, err)
+		}
+		cred.quota = int64(quota)
+	}
+	if cred.MaxRate != "" {
+		rate, err := parseSize(cred.MaxRate)
+		if err != nil {
+			return fmt.Errorf("invalid max_rate of %s in %s: %w", credentialLabel(*cred), source, err)
+		}
+		cred.maxRate = int64(rate)
+	}
+	return nil
+}
+
+// addTransferred counts a completed file transfer of n bytes
+func (s *SftpSender) addTransferred(n int64) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.filesTransferred++
+	s.bytesTransferred += n
 }
 
 func (s *SftpSender) findCredential(ip string) (*Credential, error) {
@@ -134,32 +506,97 @@ func (s *SftpSender) findCredential(ip string) (*Credential, error) {
 	return nil, fmt.Errorf("no credentials found for IP or VPS name: %s", ip)
 }
 
-func (s *SftpSender) Upload(localPath, ip, remoteLocation string, displayPath ...string) error {
+// selectHosts returns the hosts named by a comma-separated --ip list plus every
+// host of the --group, identified by name or, for unnamed entries, IP
+func (s *SftpSender) selectHosts(ips, group string) ([]string, error) {
+	var hosts []string
+	for _, ip := range strings.Split(ips, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			hosts = append(hosts, ip)
+		}
+	}
+	if group != "" {
+		found := false
+		for _, cred := range s.config.Credentials {
+			if cred.Group != group {
+				continue
+			}
+			found = true
+			if cred.Name != "" {
+				hosts = append(hosts, cred.Name)
+			} else {
+				hosts = append(hosts, cred.IP)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no hosts in group %q", group)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts given, use --ip or --group")
+	}
+	return hosts, nil
+}
+
+// Upload copies a local file or directory to the host. Errors wrap one of the
+// Err* classes when the cause is known.
+func (s *SftpSender) Upload(localPath, ip, remoteLocation string, displayPath ...string) (err error) {
+	defer func() { err = classifyError(err) }()
 	cred, err := s.findCredential(ip)
 	if err != nil {
 		return err
 	}
+	if err := s.refuseReadOnly(cred, "upload"); err != nil {
+		return err
+	}
+
+	if err := s.runHook(HookEvent{Event: "pre_host", Operation: s.operation, Host: ip, Direction: "upload", LocalPath: localPath}); err != nil {
+		return err
+	}
 
 	if remoteLocation == "" {
 		remoteLocation = s.config.DefaultRemoteLocation
 	}
 
-	// Get just the filename/dirname for remote path
-	baseName := filepath.Base(localPath)
-	remotePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(remoteLocation, "/"), baseName)
+	remotePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(remoteLocation, "/"), s.remoteName(localPath))
+	if err := checkRemotePrefix(cred, remotePath, "upload to"); err != nil {
+		return err
+	}
 
 	// Use displayPath if provided, otherwise use localPath
 	pathToDisplay := localPath
 	if len(displayPath) > 0 && displayPath[0] != "" {
 		pathToDisplay = displayPath[0]
 	}
+	if s.dryRun {
+		return s.dryRunUpload(ip, localPath, remotePath, pathToDisplay)
+	}
+
+	if err := s.runLocalCommands("pre_upload", []string{s.config.PreUpload, cred.PreUpload}, ip, localPath, remotePath); err != nil {
+		return err
+	}
+
+	s.hostLog(ip).Infof("Uploading %s to %s:%s\n", pathToDisplay, ip, remotePath)
 
-	fmt.Printf("Uploading %s to %s:%s\n", pathToDisplay, ip, remotePath)
+	unlock, err := s.lockDestination(cred.IP + ":" + remotePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	// Check if local path is directory
 	info, err := os.Stat(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to stat local path: %v", err)
+		return fmt.Errorf("failed to stat local path: %w", err)
+	}
+	defer s.saveUploadCache()
+	if !info.IsDir() && s.skipUnchanged(ip, localPath, remotePath, info) {
+		s.hostLog(ip).Infof("Skipping %s, unchanged since it was last uploaded\n", pathToDisplay)
+		return nil
+	}
+
+	if s.transport == transportOpenSSH {
+		return s.uploadOpenSSH(cred, ip, localPath, remotePath, pathToDisplay, info)
 	}
 
 	client, err := s.getSSHClient(cred)
@@ -168,18 +605,110 @@ func (s *SftpSender) Upload(localPath, ip, remoteLocation string, displayPath ..
 	}
 	defer client.Close()
 
-	if info.IsDir() {
-		return s.uploadDirectorySFTP(client, localPath, remotePath)
+	if s.remoteLock {
+		release, err := s.remoteLockDir(client, remotePath)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	// One SFTP session per stream is shared by every file of the upload
+	var clients []*sftp.Client
+	var tuning linkTuning
+	if info.IsDir() && s.keepVersions > 0 && s.backend != "sftp" {
+		s.hostLog(ip).Warnf("--keep-versions rotates files over SFTP, not using the %s backend\n", s.backend)
+	}
+	execBackend := info.IsDir() && s.keepVersions == 0 && s.useExecBackend(client, ip, "")
+	if !execBackend {
+		tuning = s.tuneLink(client, ip)
+		var closeStreams func()
+		clients, closeStreams, err = s.openStreams(cred, client, tuning)
+		switch {
+		case err == nil:
+			defer closeStreams()
+		case s.useSCP && isNoSFTPSubsystem(err):
+			s.hostLog(ip).Warnf("%s has no SFTP subsystem, falling back to SCP\n", ip)
+		default:
+			return err
+		}
+	}
+
+	if clients != nil {
+		if err := s.preflightUpload(ip, cred, clients[0], localPath, remotePath, info); err != nil {
+			return err
+		}
+	}
+
+	stopWatch := s.watchTransfer(cred)
+	switch {
+	case execBackend:
+		err = s.uploadExec(client, ip, localPath, remotePath)
+	case clients == nil:
+		err = s.uploadSCP(client, ip, localPath, remotePath)
+	case info.IsDir():
+		err = s.uploadDirectorySFTP(clients, ip, localPath, remotePath, tuning.threads)
+	case len(clients) > 1 && info.Size() >= stripeMinSize && !s.resume:
+		err = s.uploadFileStriped(clients, ip, localPath, remotePath, info.Size())
+	case s.skipExisting && remoteFileMatches(clients[0], remotePath, info.Size()):
+		s.hostLog(ip).Infof("Skipping %s, already present on the remote with the same size\n", pathToDisplay)
+	case s.sync && s.syncMatches(info, remoteStat(clients[0], remotePath), localPath, func() (string, bool) {
+		sum, err := execChecksum(client, remotePath)
+		return sum, err == nil
+	}):
+		s.hostLog(ip).Infof("Skipping %s, already in sync on the remote\n", pathToDisplay)
+	default:
+		err = s.uploadFileSFTP(clients[0], ip, localPath, remotePath, true)
+	}
+	if timeoutErr := stopWatch(); timeoutErr != nil {
+		return timeoutErr
+	}
+	if err != nil {
+		return err
+	}
+	// rsync copies the attributes itself
+	if s.xattrs && !(execBackend && s.backend == "rsync") {
+		if err := s.uploadXattrs(client, ip, localPath, remotePath); err != nil {
+			return err
+		}
+	}
+	if s.manifest && info.IsDir() {
+		manifestClient := clients
+		if manifestClient == nil {
+			c, err := s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket})
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			manifestClient = []*sftp.Client{c}
+		}
+		if err := s.writeManifest(manifestClient[0], ip, localPath, remotePath); err != nil {
+			return err
+		}
+	}
+
+	if cred.PostUploadCmd != "" {
+		s.hostLog(ip).Infof("Running post-upload command on %s: %s\n", ip, cred.PostUploadCmd)
+		if err := s.runRemoteCommand(client, ip, cred.PostUploadCmd); err != nil {
+			return fmt.Errorf("post-upload command failed: %w", err)
+		}
 	}
-	return s.uploadFileSFTP(client, localPath, remotePath)
+	return nil
 }
 
-func (s *SftpSender) Download(remotePath, ip, localLocation string) error {
+// Download copies a remote file or directory from the host. Errors wrap one of
+// the Err* classes when the cause is known.
+func (s *SftpSender) Download(remotePath, ip, localLocation string) (err error) {
+	defer func() { err = classifyError(err) }()
 	cred, err := s.findCredential(ip)
 	if err != nil {
 		return err
 	}
 
+	if err := s.runHook(HookEvent{Event: "pre_host", Operation: s.operation, Host: ip, Direction: "download", RemotePath: remotePath}); err != nil {
+		return err
+	}
+
 	if localLocation == "" {
 		localLocation = "."
 	}
@@ -187,8 +716,31 @@ func (s *SftpSender) Download(remotePath, ip, localLocation string) error {
 	// Get just the filename/dirname for local path
 	baseName := filepath.Base(remotePath)
 	localPath := filepath.Join(localLocation, baseName)
+	if s.suffixTimestamp {
+		localPath = timestampedPath(localPath, time.Now())
+	}
+	if s.dryRun {
+		return s.dryRunDownload(cred, ip, remotePath, localPath)
+	}
 
-	fmt.Printf("Downloading %s:%s to %s\n", ip, remotePath, localPath)
+	s.hostLog(ip).Infof("Downloading %s:%s to %s\n", ip, remotePath, localPath)
+
+	absLocal, err := filepath.Abs(localPath)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lockDestination("local:" + absLocal)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if s.transport == transportOpenSSH {
+		if err := s.downloadOpenSSH(cred, ip, remotePath, localPath); err != nil {
+			return err
+		}
+		return s.runLocalCommands("post_download", []string{s.config.PostDownload, cred.PostDownload}, ip, localPath, remotePath)
+	}
 
 	client, err := s.getSSHClient(cred)
 	if err != nil {
@@ -196,228 +748,846 @@ func (s *SftpSender) Download(remotePath, ip, localLocation string) error {
 	}
 	defer client.Close()
 
-	// Use SFTP to check if it's a directory and download accordingly
-	return s.downloadSFTP(client, remotePath, localPath)
+	stopWatch := s.watchTransfer(cred)
+	execBackend := s.useExecBackend(client, ip, "test -d "+shellQuote(remotePath))
+	if execBackend {
+		err = s.downloadExec(client, ip, remotePath, localPath)
+	} else {
+		err = s.downloadOverSFTP(cred, client, ip, remotePath, localPath)
+	}
+	if timeoutErr := stopWatch(); timeoutErr != nil {
+		return timeoutErr
+	}
+	if err != nil {
+		return err
+	}
+	if s.xattrs && !(execBackend && s.backend == "rsync") {
+		if err := s.downloadXattrs(client, ip, remotePath, localPath); err != nil {
+			return err
+		}
+	}
+
+	return s.runLocalCommands("post_download", []string{s.config.PostDownload, cred.PostDownload}, ip, localPath, remotePath)
 }
 
-// SFTP-based implementations
-func (s *SftpSender) uploadFileSFTP(client *ssh.Client, localPath, remotePath string) error {
-	sftpClient, err := s.getSFTPClient(client)
-	if err != nil {
+// threadsAlias makes --concurrency another name for --threads
+func threadsAlias(f *pflag.FlagSet, name string) pflag.NormalizedName {
+	if name == "concurrency" {
+		name = "threads"
+	}
+	return pflag.NormalizedName(name)
+}
+
+// timestampedPath returns localPath if nothing exists there yet, otherwise the
+// same name with a -YYYYMMDD-HHMMSS suffix before the extension, numbered
+// further if that is taken as well
+func timestampedPath(localPath string, now time.Time) string {
+	if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+		return localPath
+	}
+	ext := filepath.Ext(localPath)
+	stem := strings.TrimSuffix(localPath, ext) + "-" + now.Format("20060102-150405")
+	candidate := stem + ext
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+}
+
+// downloadOverSFTP downloads through SFTP streams, or SCP when enabled and the
+// server has no SFTP subsystem
+func (s *SftpSender) downloadOverSFTP(cred *Credential, client *ssh.Client, host, remotePath, localPath string) error {
+	tuning := s.tuneLink(client, host)
+	clients, closeStreams, err := s.openStreams(cred, client, tuning)
+	switch {
+	case err == nil:
+		defer closeStreams()
+		// Use SFTP to check if it's a directory and download accordingly
+		return s.downloadSFTP(clients, tuning.threads, host, remotePath, localPath)
+	case s.useSCP && isNoSFTPSubsystem(err):
+		s.hostLog(host).Warnf("%s has no SFTP subsystem, falling back to SCP\n", host)
+		return s.downloadSCP(client, host, remotePath, localPath)
+	default:
 		return err
 	}
-	defer sftpClient.Close()
+}
+
+// SFTP-based implementations
+// uploadFileSFTP uploads a single file. createParent creates the remote parent
+// directory first; directory walks create directories themselves and skip it.
+func (s *SftpSender) uploadFileSFTP(sftpClient *sftp.Client, host, localPath, remotePath string, createParent bool) error {
+	if s.interrupted() {
+		return ErrInterrupted
+	}
+	start := time.Now()
+	n, checksum, err := s.uploadFileContent(sftpClient, host, localPath, remotePath, createParent)
+	if err == nil {
+		err = s.chmodUpload(sftpClient, remotePath)
+	}
+	if err == nil {
+		err = s.keepUploadTime(sftpClient, localPath, remotePath)
+	}
+	return s.fileDone("upload", host, localPath, remotePath, n, checksum, start, err)
+}
 
+// fileDone records a finished file transfer and runs the post_file hooks on success
+func (s *SftpSender) fileDone(direction, host, localPath, remotePath string, n int64, checksum string, start time.Time, err error) error {
+	s.recordTransfer(direction, host, localPath, remotePath, n, checksum, start, err)
+	if err == nil && direction == "upload" {
+		s.rememberUpload(host, localPath, remotePath, checksum)
+	}
+	if err == nil {
+		s.runHook(HookEvent{Event: "post_file", Operation: s.operation, Host: host, Direction: direction, LocalPath: localPath, RemotePath: remotePath, Size: n})
+	}
+	return err
+}
+
+// uploadFileContent copies a single local file to the remote path and returns
+// the number of bytes written and their SHA-256 checksum
+func (s *SftpSender) uploadFileContent(sftpClient *sftp.Client, host, localPath, remotePath string, createParent bool) (int64, string, error) {
 	// Create parent directories if they don't exist
 	remoteDir := path.Dir(remotePath)
-	if remoteDir != "." && remoteDir != "/" {
-		if err := sftpClient.MkdirAll(remoteDir); err != nil {
-			return fmt.Errorf("failed to create remote directory: %v", err)
+	if createParent && remoteDir != "." && remoteDir != "/" {
+		if err := s.mkdirAllRemote(sftpClient, remoteDir); err != nil {
+			return 0, "", fmt.Errorf("failed to create remote directory: %w", err)
 		}
 	}
 
 	// Open local file
 	localFile, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to open local file: %v", err)
+		return 0, "", fmt.Errorf("failed to open local file: %w", err)
 	}
 	defer localFile.Close()
 
-	// Create remote file
-	remoteFile, err := sftpClient.Create(remotePath)
+	localInfo, err := localFile.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to create remote file: %v", err)
+		return 0, "", fmt.Errorf("failed to stat local file: %w", err)
+	}
+
+	// With --resume a shorter remote file is the part an earlier transfer
+	// wrote; it is kept and only the rest of the local file is sent
+	var offset int64
+	if s.resume {
+		if remoteInfo, err := sftpClient.Stat(remotePath); err == nil && remoteInfo.Mode().IsRegular() && remoteInfo.Size() <= localInfo.Size() {
+			offset = max(remoteInfo.Size()-s.inFlightWindow(), 0)
+		}
+	}
+
+	var remoteFile *sftp.File
+	if offset > 0 {
+		if remoteFile, err = sftpClient.OpenFile(remotePath, os.O_WRONLY); err != nil {
+			return 0, "", fmt.Errorf("failed to open remote file: %w", err)
+		}
+		if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+			remoteFile.Close()
+			return 0, "", fmt.Errorf("failed to seek remote file: %w", err)
+		}
+	} else {
+		if err := s.rotateVersions(sftpClient, remotePath); err != nil {
+			return 0, "", err
+		}
+		if remoteFile, err = sftpClient.Create(remotePath); err != nil {
+			return 0, "", fmt.Errorf("failed to create remote file: %w", err)
+		}
 	}
 	defer remoteFile.Close()
+	if !s.resume {
+		// Resumable runs keep partial files for the next attempt
+		defer s.onAbort("partial file "+remotePath, func() error { return sftpClient.Remove(remotePath) })()
+	}
 
-	// Use io.CopyBuffer with optimal buffer size (256KB = 8x 32KB packet size)
+	// The checksum covers the whole file, so the part already sent is hashed
+	// from the local file, which also moves it to the resume offset
+	hash := sha256.New()
+	if offset > 0 {
+		if _, err := io.CopyN(hash, localFile, offset); err != nil {
+			return 0, "", fmt.Errorf("failed to read local file: %w", err)
+		}
+		s.hostLog(host).Infof("Resuming %s at %s of %s\n", remotePath, formatBytes(offset), formatBytes(localInfo.Size()))
+	}
+	finish := func(n int64) (int64, string, error) {
+		s.addTransferred(n)
+		if s.resume {
+			if err := checkResumedSize(sftpClient.Stat, remotePath, localInfo.Size()); err != nil {
+				return offset + n, "", err
+			}
+		}
+		return offset + n, hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	// Small files are read whole and sent as a single write request
+	if localInfo.Size() <= smallFileThreshold {
+		data, err := io.ReadAll(localFile)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to read local file: %w", err)
+		}
+		n, err := remoteFile.Write(data)
+		if err != nil {
+			return int64(n), "", fmt.Errorf("failed to copy file content: %w", err)
+		}
+		hash.Write(data)
+		return finish(int64(n))
+	}
+
+	// Large files can be memory-mapped and sent straight from the page cache,
+	// skipping the read syscalls and the copy into our own buffers
+	if s.useMmap && localInfo.Size() >= mmapMinSize {
+		data, unmap, err := mmapFile(localFile, localInfo.Size())
+		if err == nil {
+			defer unmap()
+			n, err := remoteFile.ReadFrom(bytes.NewReader(data[offset:]))
+			if err != nil {
+				return n, "", fmt.Errorf("failed to copy file content: %w", err)
+			}
+			hash.Write(data[offset:])
+			return finish(n)
+		}
+		s.hostLog(host).Warnf("mmap of %s failed, falling back to buffered reads: %v\n", localPath, err)
+	}
+
+	// Use io.CopyBuffer with optimal buffer size (256KB = 8x 32KB packet size by default)
 	// This allows the SFTP library to optimize packet batching internally
 	// Buffer size is a multiple of packet size for better alignment
-	buffer := make([]byte, 256*1024) // 256KB = 8 packets, optimal for SFTP
-	_, err = io.CopyBuffer(remoteFile, localFile, buffer)
+	buffer := s.getBuffer()
+	defer s.putBuffer(buffer)
+	bufReader := s.getReader(localFile)
+	defer s.putReader(bufReader)
+
+	reader := sizedReader{
+		Reader: io.TeeReader(bufReader, hash),
+		size:   localInfo.Size() - offset,
+	}
+	n, err := io.CopyBuffer(remoteFile, reader, *buffer)
 	if err != nil {
-		return fmt.Errorf("failed to copy file content: %v", err)
+		return n, "", fmt.Errorf("failed to copy file content: %w", err)
 	}
-
-	return nil
+	return finish(n)
 }
 
-func (s *SftpSender) uploadDirectorySFTP(client *ssh.Client, localPath, remotePath string) error {
-	sftpClient, err := s.getSFTPClient(client)
+func (s *SftpSender) uploadDirectorySFTP(clients []*sftp.Client, host, localPath, remotePath string, threads int) error {
+	sftpClient := clients[0]
+
+	// Build the full transfer list up front
+	scan, err := scanLocalTree(localPath, s.filter)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to scan local directory: %w", err)
 	}
-	defer sftpClient.Close()
+	s.hostLog(host).Infof("Found %d files (%d bytes) in %d directories\n", len(scan.files), scan.totalSize, len(scan.dirs)+1)
 
 	// Create remote directory
-	err = sftpClient.MkdirAll(remotePath)
-	if err != nil {
-		return fmt.Errorf("failed to create remote directory: %v", err)
+	if err := s.mkdirAllRemote(sftpClient, remotePath); err != nil {
+		return fmt.Errorf("failed to create remote directory: %w", err)
 	}
 
-	return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	// Directories are sorted parents first, so a single Mkdir is enough for
+	// each; only fall back to a Stat when it already exists
+	for _, dir := range scan.dirs {
+		if err := s.mkdirRemote(sftpClient, path.Join(remotePath, filepath.ToSlash(dir.rel))); err != nil {
 			return err
 		}
+	}
 
-		relPath, err := filepath.Rel(localPath, path)
-		if err != nil {
-			return err
+	// Small files are dominated by open/write/close round trips rather than
+	// bandwidth, so they get a much wider pool to keep many requests in flight.
+	pool := newTransferPool(threads * len(clients))
+	smallPool := newTransferPool(smallFileConcurrency)
+	listing := newRemoteListing(sftpClient)
+	hashes := s.syncHashes(sftpClient, host, remotePath)
+	skipped, unchanged, inSync := 0, 0, 0
+	for i, file := range scan.files {
+		localFilePath := file.path
+		remoteFilePath := path.Join(remotePath, filepath.ToSlash(file.rel))
+
+		if s.skipExisting {
+			if remoteInfo, ok := listing.lookup(remoteFilePath); ok && remoteInfo.Size() == file.info.Size() {
+				skipped++
+				continue
+			}
+		}
+		if s.sync {
+			if remoteInfo, ok := listing.lookup(remoteFilePath); ok &&
+				s.syncMatches(file.info, remoteInfo, localFilePath, lookupHash(hashes, filepath.ToSlash(file.rel))) {
+				inSync++
+				continue
+			}
+		}
+		if s.skipUnchanged(host, localFilePath, remoteFilePath, file.info) {
+			unchanged++
+			continue
 		}
 
-		remoteFilePath := filepath.Join(remotePath, relPath)
-
-		if info.IsDir() {
-			return sftpClient.MkdirAll(remoteFilePath)
+		target := pool
+		if file.info.Size() <= smallFileThreshold {
+			target = smallPool
+		}
+		stream := clients[i%len(clients)] // files are spread round-robin over the streams
+		err := target.submit(func() error {
+			return s.uploadFileSFTP(stream, host, localFilePath, remoteFilePath, false)
+		})
+		if err != nil {
+			break
 		}
+	}
 
-		return s.uploadFileSFTP(client, path, remoteFilePath)
-	})
+	poolErr := pool.wait()
+	smallErr := smallPool.wait()
+	if skipped > 0 {
+		s.hostLog(host).Infof("Skipped %d files already present on the remote with the same size\n", skipped)
+	}
+	if unchanged > 0 {
+		s.hostLog(host).Infof("Skipped %d files unchanged since they were last uploaded\n", unchanged)
+	}
+	if inSync > 0 {
+		s.hostLog(host).Infof("Skipped %d files already in sync on the remote\n", inSync)
+	}
+	if poolErr != nil {
+		return poolErr
+	}
+	return smallErr
 }
 
-func (s *SftpSender) downloadSFTP(client *ssh.Client, remotePath, localPath string) error {
-	sftpClient, err := s.getSFTPClient(client)
-	if err != nil {
-		return err
+// remoteFileMatches reports whether a remote file exists with the given size
+func remoteFileMatches(sftpClient *sftp.Client, remotePath string, size int64) bool {
+	info, err := sftpClient.Stat(remotePath)
+	return err == nil && !info.IsDir() && info.Size() == size
+}
+
+// mkdirRemote creates a directory whose parent exists, accepting an existing directory
+func (s *SftpSender) mkdirRemote(sftpClient *sftp.Client, remoteDir string) error {
+	if err := sftpClient.Mkdir(remoteDir); err != nil {
+		if info, statErr := sftpClient.Stat(remoteDir); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return fmt.Errorf("failed to create remote directory %s: %w", remoteDir, err)
 	}
-	defer sftpClient.Close()
+	if s.dirMode != 0 {
+		if err := sftpClient.Chmod(remoteDir, s.dirMode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", remoteDir, err)
+		}
+	}
+	return nil
+}
 
+func (s *SftpSender) downloadSFTP(clients []*sftp.Client, threads int, host, remotePath, localPath string) error {
 	// Check if remote path is file or directory
-	remoteInfo, err := sftpClient.Stat(remotePath)
+	remoteInfo, err := clients[0].Stat(remotePath)
 	if err != nil {
-		return fmt.Errorf("failed to stat remote path: %v", err)
+		return fmt.Errorf("failed to stat remote path: %w", err)
 	}
 
 	if remoteInfo.IsDir() {
-		return s.downloadDirectorySFTP(sftpClient, remotePath, localPath)
+		return s.downloadDirectorySFTP(clients, host, remotePath, localPath, threads)
+	}
+	if s.skipExisting {
+		if localInfo, err := os.Stat(localPath); err == nil && !localInfo.IsDir() && localInfo.Size() == remoteInfo.Size() {
+			s.hostLog(host).Infof("Skipping %s, already present locally with the same size\n", localPath)
+			return nil
+		}
+	}
+	if s.sync {
+		localInfo, _ := os.Stat(localPath)
+		if s.syncMatches(localInfo, remoteInfo, localPath, func() (string, bool) {
+			sum, err := s.remoteChecksum(host, remotePath)
+			return sum, err == nil
+		}) {
+			s.hostLog(host).Infof("Skipping %s, already in sync locally\n", localPath)
+			return nil
+		}
+	}
+	if err := s.reserveDownload(remotePath, remoteInfo.Size()); err != nil {
+		return err
 	}
-	return s.downloadFileSFTP(sftpClient, remotePath, localPath)
+	// Decompressed files are read in order, by one stream
+	_, ext := s.decompressTarget(remotePath, localPath)
+	if len(clients) > 1 && remoteInfo.Size() >= stripeMinSize && !s.resume && ext == "" {
+		return s.downloadFileStriped(clients, host, remotePath, localPath, remoteInfo.Size())
+	}
+	return s.downloadFileSFTP(clients[0], host, remotePath, localPath)
 }
 
-func (s *SftpSender) downloadFileSFTP(sftpClient *sftp.Client, remotePath, localPath string) error {
+func (s *SftpSender) downloadFileSFTP(sftpClient *sftp.Client, host, remotePath, localPath string) error {
+	if s.interrupted() {
+		return ErrInterrupted
+	}
+	start := time.Now()
+	var n int64
+	var checksum string
+	var err error
+	if target, ext := s.decompressTarget(remotePath, localPath); ext != "" {
+		localPath = target
+		n, checksum, err = s.downloadDecompressed(sftpClient, remotePath, localPath, ext)
+	} else {
+		n, checksum, err = s.downloadFileContent(sftpClient, host, remotePath, localPath)
+	}
+	if err == nil {
+		err = s.keepDownloadTime(sftpClient, remotePath, localPath)
+	}
+	return s.fileDone("download", host, localPath, remotePath, n, checksum, start, err)
+}
+
+// downloadFileContent copies a single remote file to the local path and returns
+// the number of bytes written and their SHA-256 checksum
+func (s *SftpSender) downloadFileContent(sftpClient *sftp.Client, host, remotePath, localPath string) (int64, string, error) {
 	// Create local directory if needed
 	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-		return fmt.Errorf("failed to create local directory: %v", err)
+		return 0, "", fmt.Errorf("failed to create local directory: %w", err)
 	}
 
 	// Open remote file
 	remoteFile, err := sftpClient.Open(remotePath)
 	if err != nil {
-		return fmt.Errorf("failed to open remote file: %v", err)
+		return 0, "", fmt.Errorf("failed to open remote file: %w", err)
 	}
 	defer remoteFile.Close()
 
-	// Create local file
-	localFile, err := os.Create(localPath)
+	// With --resume a shorter local file is the part an earlier transfer
+	// wrote; it is kept and only the rest of the remote file is fetched
+	var offset, size int64
+	if s.resume {
+		remoteInfo, err := remoteFile.Stat()
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to stat remote file: %w", err)
+		}
+		size = remoteInfo.Size()
+		if info, err := os.Stat(localPath); err == nil && info.Mode().IsRegular() && info.Size() <= size {
+			offset = info.Size()
+		}
+	}
+
+	var localFile *os.File
+	if offset > 0 {
+		localFile, err = os.OpenFile(localPath, os.O_RDWR, 0)
+	} else {
+		localFile, err = os.Create(localPath)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
+		return 0, "", fmt.Errorf("failed to create local file: %w", err)
 	}
 	defer localFile.Close()
+	if !s.resume {
+		// Resumable runs keep partial files for the next attempt
+		defer s.onAbort("partial file "+localPath, func() error { return os.Remove(localPath) })()
+	}
+
+	// The checksum covers the whole file, so the part already fetched is
+	// hashed from the local file, which also moves it to the resume offset
+	hash := sha256.New()
+	if offset > 0 {
+		if _, err := io.CopyN(hash, localFile, offset); err != nil {
+			return 0, "", fmt.Errorf("failed to read local file: %w", err)
+		}
+		if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+			return 0, "", fmt.Errorf("failed to seek remote file: %w", err)
+		}
+		s.hostLog(host).Infof("Resuming %s at %s of %s\n", localPath, formatBytes(offset), formatBytes(size))
+	}
 
 	// Use buffered writer for local file writes (helps with disk I/O)
-	writer := bufio.NewWriterSize(localFile, 256*1024)
+	writer := s.getWriter(localFile)
+	defer s.putWriter(writer)
 	defer writer.Flush()
 
-	// Use io.CopyBuffer with optimal buffer size (256KB = 8x 32KB packet size)
+	// Use io.CopyBuffer with optimal buffer size (256KB = 8x 32KB packet size by default)
 	// This allows the SFTP library to optimize packet batching internally
-	buffer := make([]byte, 256*1024) // 256KB = 8 packets, optimal for SFTP
-	_, err = io.CopyBuffer(writer, remoteFile, buffer)
+	buffer := s.getBuffer()
+	defer s.putBuffer(buffer)
+	n, err := io.CopyBuffer(io.MultiWriter(writer, hash), remoteFile, *buffer)
 	if err != nil {
-		return fmt.Errorf("failed to copy file content: %v", err)
+		return n, "", fmt.Errorf("failed to copy file content: %w", err)
+	}
+
+	s.addTransferred(n)
+	if s.resume {
+		if err := writer.Flush(); err != nil {
+			return offset + n, "", fmt.Errorf("failed to write local file: %w", err)
+		}
+		if err := checkResumedSize(os.Stat, localPath, size); err != nil {
+			return offset + n, "", err
+		}
+	}
+	return offset + n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// inFlightWindow is the most data concurrent SFTP writes can have in flight
+// for one file. The writes of an interrupted upload may have landed out of
+// order, leaving holes within this window below the end of the partial file,
+// so resumed uploads send it again.
+func (s *SftpSender) inFlightWindow() int64 {
+	concurrent, packet := s.maxConcurrent, s.maxPacket
+	if s.autoTune {
+		concurrent = max(concurrent, autoTuneMaxConcurrent)
+	}
+	if packet == 0 {
+		packet = 32 * 1024
+	}
+	if s.autoTune {
+		packet = max(packet, 256*1024)
 	}
+	return int64(concurrent) * int64(packet)
+}
 
+// checkResumedSize verifies that a resumed transfer produced a file of the
+// expected size, which catches sources that changed between the attempts
+func checkResumedSize(stat func(string) (os.FileInfo, error), path string, want int64) error {
+	info, err := stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s after resuming: %w", path, err)
+	}
+	if info.Size() != want {
+		return fmt.Errorf("%s is %d bytes after resuming, expected %d; remove it and transfer again", path, info.Size(), want)
+	}
 	return nil
 }
 
-func (s *SftpSender) downloadDirectorySFTP(sftpClient *sftp.Client, remotePath, localPath string) error {
+func (s *SftpSender) downloadDirectorySFTP(clients []*sftp.Client, host, remotePath, localPath string, threads int) error {
+	sftpClient := clients[0]
+
 	// Create local directory
 	if err := os.MkdirAll(localPath, 0755); err != nil {
-		return fmt.Errorf("failed to create local directory: %v", err)
+		return fmt.Errorf("failed to create local directory: %w", err)
 	}
 
-	// Walk remote directory
+	// Walk remote directory, downloading files on the transfer pool
+	pool := newTransferPool(threads * len(clients))
+	hashes := s.syncHashes(sftpClient, host, remotePath)
+	skipped, beyond, inSync := 0, 0, 0
+	next := 0 // files are spread round-robin over the streams
 	walker := sftpClient.Walk(remotePath)
 	for walker.Step() {
 		if err := walker.Err(); err != nil {
+			pool.wait()
 			return err
 		}
 
 		relPath, err := filepath.Rel(remotePath, walker.Path())
 		if err != nil {
+			pool.wait()
 			return err
 		}
 
 		localFilePath := filepath.Join(localPath, relPath)
 
+		if s.beyondDepth(filepath.ToSlash(relPath)) {
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			beyond++
+			continue
+		}
+		if s.filter.excludes(filepath.ToSlash(relPath), walker.Stat().IsDir()) {
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+
 		if walker.Stat().IsDir() {
 			if err := os.MkdirAll(localFilePath, 0755); err != nil {
+				pool.wait()
 				return err
 			}
 		} else {
-			if err := s.downloadFileSFTP(sftpClient, walker.Path(), localFilePath); err != nil {
+			if s.skipExisting {
+				if localInfo, err := os.Stat(localFilePath); err == nil && localInfo.Size() == walker.Stat().Size() {
+					skipped++
+					continue
+				}
+			}
+			if s.sync {
+				if localInfo, err := os.Stat(localFilePath); err == nil &&
+					s.syncMatches(localInfo, walker.Stat(), localFilePath, lookupHash(hashes, filepath.ToSlash(relPath))) {
+					inSync++
+					continue
+				}
+			}
+
+			remoteFilePath := walker.Path()
+			if err := s.reserveDownload(remoteFilePath, walker.Stat().Size()); err != nil {
+				pool.wait()
 				return err
 			}
+			stream := clients[next%len(clients)]
+			next++
+			err := pool.submit(func() error {
+				return s.downloadFileSFTP(stream, host, remoteFilePath, localFilePath)
+			})
+			if err != nil {
+				break
+			}
 		}
 	}
 
-	return nil
+	if skipped > 0 {
+		s.hostLog(host).Infof("Skipped %d files already present locally with the same size\n", skipped)
+	}
+	if inSync > 0 {
+		s.hostLog(host).Infof("Skipped %d files already in sync locally\n", inSync)
+	}
+	if beyond > 0 {
+		s.hostLog(host).Warnf("Skipped %d entries deeper than --max-depth %d\n", beyond, s.caps.maxDepth)
+	}
+	return pool.wait()
 }
 
 // SSH and SFTP client helpers
+
+// authMethods returns the ways to log in with a credential: its key, if any,
+// then its password, which may be read from the OS keyring
+func authMethods(cred *Credential) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	signer := cred.signer
+	if signer == nil && cred.IdentityFile != "" {
+		data, err := os.ReadFile(expandHomeDir(cred.IdentityFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity_file: %w", err)
+		}
+		if signer, err = ssh.ParsePrivateKey(data); err != nil {
+			return nil, fmt.Errorf("failed to parse identity_file %s: %w", cred.IdentityFile, err)
+		}
+	}
+	if signer != nil {
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	password, err := resolvePassword(cred)
+	if err != nil {
+		return nil, err
+	}
+	// Without a password or key the keys of a running ssh-agent are used
+	if password == "" && len(methods) == 0 && os.Getenv("SSH_AUTH_SOCK") != "" {
+		method, err := agentAuth()
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+	if password != "" || len(methods) == 0 {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods, nil
+}
+
+// getSSHClient connects to the host of cred, or returns its pooled connection
+// when connections are pooled
 func (s *SftpSender) getSSHClient(cred *Credential) (*ssh.Client, error) {
-	config := &ssh.ClientConfig{
-		User: cred.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(cred.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		// Optimize connection timeouts
-		Timeout: 30 * time.Second,
+	var client *ssh.Client
+	var err error
+	if s.conns != nil {
+		client, err = s.pooledClient(cred)
+	} else {
+		client, err = s.connectHost(cred)
 	}
+	if err == nil {
+		s.inline.loggedIn(cred)
+	}
+	return client, err
+}
+
+// dialSSH opens a new SSH connection to the host of cred
+func (s *SftpSender) dialSSH(cred *Credential) (*ssh.Client, error) {
+	return s.dialSSHWith(cred, s.hostKeyCallback(cred), true)
+}
 
+// sshAddress returns the host:port of a credential's IP, which may omit the port
+func sshAddress(ip string) string {
 	// Parse IP and port - if IP already contains port, use it; otherwise default to 22
-	host, port, err := net.SplitHostPort(cred.IP)
+	host, port, err := net.SplitHostPort(ip)
 	if err != nil {
 		// IP doesn't contain a port, use IP as-is with default port 22
-		host = cred.IP
+		host = ip
 		port = "22"
 	}
-	address := net.JoinHostPort(host, port)
+	return net.JoinHostPort(host, port)
+}
+
+// dialSSHWith opens a new SSH connection verifying the host key with hostKey.
+// With pinAlgorithms, only the key types pinned for the host are negotiated.
+func (s *SftpSender) dialSSHWith(cred *Credential, hostKey ssh.HostKeyCallback, pinAlgorithms bool) (*ssh.Client, error) {
+	auth, err := authMethods(cred)
+	if err != nil {
+		return nil, err
+	}
+	address := sshAddress(cred.IP)
+	label := credentialLabel(*cred)
+	config := &ssh.ClientConfig{
+		User: cred.Username,
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			logDebugf("%s: server host key %s %s\n", label, key.Type(), ssh.FingerprintSHA256(key))
+			return hostKey(hostname, remote, key)
+		},
+		BannerCallback: func(message string) error {
+			logDebugf("%s: server banner: %s\n", label, message)
+			return nil
+		},
+		// Optimize connection timeouts
+		Timeout: 30 * time.Second,
+	}
+	if pinAlgorithms && s.config.HostKeyChecking != "off" {
+		config.HostKeyAlgorithms = hostKeyAlgorithms(address)
+	}
+	switch {
+	case cred.JumpHost != "":
+		logDebugf("%s: connecting to %s as %s through jump host %s\n", label, address, cred.Username, cred.JumpHost)
+	default:
+		logDebugf("%s: connecting to %s as %s\n", label, address, cred.Username)
+	}
+	if len(config.HostKeyAlgorithms) > 0 {
+		logDebugf("%s: preferring host key algorithms of the pinned key: %s\n", label, strings.Join(config.HostKeyAlgorithms, ", "))
+	}
 
 	// Create TCP connection with keepalive for better network handling
 	// This helps maintain connection stability and reduces overhead
-	conn, err := net.DialTimeout("tcp", address, 30*time.Second)
+	var conn net.Conn
+	if cred.JumpHost != "" {
+		conn, err = s.dialJump(cred, address)
+	} else {
+		conn, err = s.dialTCP(cred, address, 30*time.Second)
+	}
 	if err != nil {
-		return nil, err
+		return nil, classifyError(err)
 	}
 
 	// Set TCP keepalive to maintain connection and detect dead connections faster
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(30 * time.Second)
+		tcpConn.SetKeepAlivePeriod(s.keepAlive)
 		// Set TCP no delay for lower latency (disable Nagle's algorithm)
 		tcpConn.SetNoDelay(true)
 	}
+	conn = s.wrapConn(cred, conn)
 
 	// Perform SSH handshake with optimized connection
+	start := time.Now()
 	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
 	if err != nil {
+		logDebugf("%s: SSH handshake failed after %s: %v\n", label, time.Since(start).Round(time.Millisecond), err)
 		conn.Close()
-		return nil, err
+		return nil, classifyError(err)
+	}
+	logDebugf("%s: SSH handshake done in %s, server %s, session %x\n",
+		label, time.Since(start).Round(time.Millisecond), c.ServerVersion(), c.SessionID()[:8])
+
+	client := ssh.NewClient(c, chans, reqs)
+	s.forwardAgent(client, cred)
+	return client, nil
+}
+
+// wrapConn applies the rate limits, dashboard counters and stall watch of the
+// run to a connection to the host of cred
+func (s *SftpSender) wrapConn(cred *Credential, conn net.Conn) net.Conn {
+	if s.limiter != nil {
+		conn = &limitedConn{Conn: conn, limiter: s.limiter}
+	}
+	if cred.maxRate > 0 {
+		conn = &limitedConn{Conn: conn, limiter: s.hostLimiter(cred)}
+	}
+	if s.dashboard != nil {
+		conn = s.dashboard.wrapConn(conn, cred)
+	}
+	if w := s.watchFor(cred); w != nil {
+		conn = w.track(conn)
+	}
+	return conn
+}
+
+// runRemoteCommand executes a command on the remote host, streaming its output to the terminal
+func (s *SftpSender) runRemoteCommand(client *ssh.Client, host, command string) error {
+	if s.dashboard != nil {
+		return s.runRemoteCommandOutput(client, host, command, io.Discard, io.Discard)
+	}
+	return s.runRemoteCommandOutput(client, host, command, os.Stdout, os.Stderr)
+}
+
+// runRemoteCommandOutput executes a command on the remote host with its output
+// sent to the given writers, and records it in the audit log
+func (s *SftpSender) runRemoteCommandOutput(client *ssh.Client, host, command string, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+	s.requestAgent(session, host)
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run(command)
+
+	entry := AuditEntry{Type: "command", Host: host, Command: command, Status: "success"}
+	if err != nil {
+		entry.Status = "failed"
+		entry.Error = err.Error()
 	}
+	s.audit(entry)
+	return err
+}
 
-	return ssh.NewClient(c, chans, reqs), nil
+func (s *SftpSender) getSFTPClient(sshClient *ssh.Client, tuning linkTuning) (*sftp.Client, error) {
+	c, err := sftp.NewClient(sshClient, sftpClientOptions(tuning)...)
+	if err != nil {
+		logDebugf("%s: SFTP session failed: %v\n", sshClient.RemoteAddr(), err)
+		return nil, err
+	}
+	packet := "32K"
+	if tuning.maxPacket > 0 {
+		packet = formatBytes(int64(tuning.maxPacket))
+	}
+	logDebugf("%s: SFTP session open, packets of %s, %d requests in flight per file\n", sshClient.RemoteAddr(), packet, tuning.maxConcurrent)
+	return c, nil
 }
 
-func (s *SftpSender) getSFTPClient(sshClient *ssh.Client) (*sftp.Client, error) {
+func sftpClientOptions(tuning linkTuning) []sftp.ClientOption {
 	// Create SFTP client with performance optimizations
 	// Enable concurrent writes and reads for better performance (like Termius)
 	// This allows multiple requests to be in flight simultaneously
-	return sftp.NewClient(sshClient,
-		sftp.UseConcurrentWrites(true),        // Enable concurrent writes - key for performance!
-		sftp.UseConcurrentReads(true),         // Enable concurrent reads for downloads
-		sftp.MaxConcurrentRequestsPerFile(64), // Allow up to 64 concurrent requests per file
-	)
+	opts := []sftp.ClientOption{
+		sftp.UseConcurrentWrites(true),                          // Enable concurrent writes - key for performance!
+		sftp.UseConcurrentReads(true),                           // Enable concurrent reads for downloads
+		sftp.MaxConcurrentRequestsPerFile(tuning.maxConcurrent), // Allow up to 64 concurrent requests per file by default
+	}
+	if tuning.maxPacket > 0 {
+		// Packets above 32KB are not guaranteed by the SFTP spec but OpenSSH accepts up to 256KB
+		opts = append(opts, sftp.MaxPacketUnchecked(tuning.maxPacket))
+	}
+	return opts
+}
+
+// sizedReader exposes the total size of a wrapped reader so the SFTP client can
+// still pipeline concurrent writes when the file is read through a hash/buffer chain
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+func (r sizedReader) Size() int64 { return r.size }
+
+// parseSize parses a byte size with an optional K, M, G or T suffix (powers of 1024)
+func parseSize(value string) (int, error) {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(v, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(v, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(v, "G"):
+		multiplier = 1024 * 1024 * 1024
+	case strings.HasSuffix(v, "T"):
+		multiplier = 1024 * 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return n * multiplier, nil
 }
 
 // parseWorkerNumbers parses autosend and ignore strings to return a sorted list of worker numbers
@@ -514,7 +1684,7 @@ func findFileSequence(basePath string, count int) ([]string, error) {
 	// Get absolute path
 	absPath, err := filepath.Abs(basePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get absolute path: %v", err)
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
 	// Check if base file exists
@@ -583,19 +1753,212 @@ func resolveWorkerName(workerNum int, ipTemplate string) string {
 }
 
 func main() {
+	// Subcommands are dispatched before the regular flags are parsed. cp takes
+	// the regular flags plus positional SOURCE and DEST arguments, run-template
+	// a template name and the paths to transfer.
+	copyMode, copyLocation, templateMode := false, "", false
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cp":
+			copyMode = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "run-template":
+			templateMode = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "history":
+			if err := runHistory(os.Args[2:]); err != nil {
+				logFatalf("History failed: %v", err)
+			}
+			return
+		case "audit":
+			if err := runAudit(os.Args[2:]); err != nil {
+				logFatalf("Audit failed: %v", err)
+			}
+			return
+		case "run":
+			if err := runJob(os.Args[2:]); err != nil {
+				logFatalf("Run failed: %v", err)
+			}
+			return
+		case "exec":
+			if err := runExec(os.Args[2:]); err != nil {
+				logFatalf("Exec failed: %v", err)
+			}
+			return
+		case "tail":
+			if err := runTail(os.Args[2:]); err != nil {
+				logFatalf("Tail failed: %v", err)
+			}
+			return
+		case "update":
+			if err := runUpdate(os.Args[2:]); err != nil {
+				logFatalf("Update failed: %v", err)
+			}
+			return
+		case "keygen":
+			if err := runKeygen(os.Args[2:]); err != nil {
+				logFatalf("Keygen failed: %v", err)
+			}
+			return
+		case "trash":
+			if err := runTrash(os.Args[2:]); err != nil {
+				logFatalf("Trash failed: %v", err)
+			}
+			return
+		case "batch":
+			if err := runBatch(os.Args[2:]); err != nil {
+				logFatalf("Batch failed: %v", err)
+			}
+			return
+		case "fingerprint":
+			if err := runFingerprint(os.Args[2:]); err != nil {
+				logFatalf("Fingerprint failed: %v", err)
+			}
+			return
+		case "config":
+			if err := runConfig(os.Args[2:]); err != nil {
+				logFatalf("Config failed: %v", err)
+			}
+			return
+		case "mux":
+			if err := runMux(os.Args[2:]); err != nil {
+				logFatalf("Mux failed: %v", err)
+			}
+			return
+		case "hostkey":
+			if err := runHostKey(os.Args[2:]); err != nil {
+				logFatalf("Hostkey failed: %v", err)
+			}
+			return
+		case "backup":
+			if err := runBackup(os.Args[2:]); err != nil {
+				logFatalf("Backup failed: %v", err)
+			}
+			return
+		case "verify":
+			if err := runVerify(os.Args[2:]); err != nil {
+				logFatalf("Verify failed: %v", err)
+			}
+			return
+		case "caps":
+			if err := runCaps(os.Args[2:]); err != nil {
+				logFatalf("Caps failed: %v", err)
+			}
+			return
+		case "ls":
+			if err := runLs(os.Args[2:]); err != nil {
+				logFatalf("Ls failed: %v", err)
+			}
+			return
+		case "serve-sftp":
+			if err := runServeSFTP(os.Args[2:]); err != nil {
+				logFatalf("serve-sftp failed: %v", err)
+			}
+			return
+		case rsyncBridgeCommand:
+			if err := runRsyncBridge(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "rsync bridge: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	pflag.CommandLine.SetNormalizeFunc(threadsAlias)
+
 	var (
 		upload     = pflag.String("upload", "", "Local file/directory to upload")
 		download   = pflag.String("download", "", "Remote file/directory to download")
-		ip         = pflag.String("ip", "", "VPS IP address or name (required). Optionally include path: IP:/path or name:/path")
-		configPath = pflag.String("config", "~/.config/sftpsender/config.yaml", "Path to config file")
+		ip         = pflag.String("ip", "", "VPS IP address or name (required). Optionally include path: IP:/path, name:/path, user:password@host:port:/path or sftp://user@host:port/path. Separate several hosts with commas to broadcast an upload")
+		userF      = pflag.String("user", "", "User name for --ip hosts that are not in the config (default: the local user)")
+		askPass    = pflag.Bool("ask-pass", false, "Prompt for the password of --ip hosts that are not in the config")
+		credsF     = pflag.String("credentials", "", "Read credentials for this run only from a YAML or JSON file, or - for stdin; they take precedence over the config")
+		saveHost   = pflag.Bool("save-host", false, "Add --ip hosts that are not in the config to it once logged in to")
+		configPath = pflag.String("config", defaultConfigPath, "Path to config file")
 		silent     = pflag.Bool("silent", false, "Silent mode.")
 		version    = pflag.Bool("version", false, "Print the version of the tool and exit.")
 		autosend   = pflag.String("autosend", "", "Automatically send files to workers. Accepts ranges (e.g., 21-27) or comma-separated numbers (e.g., 21,27)")
+		fanOut     = pflag.Int("fan-out", 0, "When broadcasting to several --ip hosts, upload to this many seeds and let hosts copy to each other")
+		verify     = pflag.Bool("verify", false, "After a broadcast, check the SHA-256 of the file on every host and report mismatches")
+		split      = pflag.Bool("split", false, "Spread the files of an upload over the --ip hosts by free space and quota instead of sending them to every host")
 		ignore     = pflag.String("ignore", "", "Comma-separated worker numbers to exclude from autosend range")
+		auditLog   = pflag.String("audit-log", "", "Append a hash-chained audit entry for every transfer and remote command to this file")
+		bufferSize = pflag.String("buffer-size", "", "Local copy buffer size, e.g. 256K or 1M (default 256K)")
+		maxPacket  = pflag.String("max-packet", "", "SFTP packet size, e.g. 32K (LAN) or 256K (high-latency links, OpenSSH servers)")
+		autoTune   = pflag.Bool("auto-tune", false, "Pick concurrency, packet size and threads per host from the measured round trip time")
+		netProfile = pflag.String("net-profile", "", "Preset for buffer size, concurrency, streams, threads and keepalive: lan, wan or satellite")
+		streams    = pflag.Int("streams", 1, "Number of parallel SSH connections per host; files (or chunks of large files) are striped across them")
+		backend    = pflag.String("backend", "sftp", "Directory transfer backend: sftp, rsync (installed on both ends) or tar (streamed over an exec channel)")
+		deleteF    = pflag.Bool("delete", false, "With --backend rsync, delete destination files that are not in the source")
+		trash      = pflag.Bool("trash", false, "With --delete, move deleted files into .sftpsender-trash/<time>/ in the destination instead")
+		dirMode    = pflag.String("dirmode", "", "Octal mode for remote directories created by uploads, e.g. 0750 (default: server default)")
+		chmod      = pflag.String("chmod", "", "Octal mode for uploaded files, e.g. 0600 (default: server default)")
+		lockWait   = pflag.Duration("lock-wait", 0, "Wait this long for another sftpsender run writing the same destination instead of failing")
+		remoteLock = pflag.Bool("remote-lock", false, "Also lock the destination on the host, guarding against runs from other machines")
+		readOnly   = pflag.Bool("read-only", false, "Refuse anything that writes or deletes on the hosts (uploads, commands) and --delete, for machines that must not be modified")
+		unsafe     = pflag.Bool("unsafe", false, "Allow --delete on /, home directories and paths outside the host's delete_prefix")
+		guardSens  = pflag.Bool("guard-sensitive", false, "Ask before uploading files that look like secrets (.env, private keys, .git, cloud credentials)")
+		allowSens  = pflag.Bool("allow-sensitive", false, "Upload files that look like secrets without asking, overriding guard_sensitive in the config")
+		limitRate  = pflag.String("limit-rate", "", "Limit the transfer rate of the whole run in bytes per second, e.g. 5M (see also max_rate per host)")
+		noSched    = pflag.Bool("ignore-bandwidth-schedule", false, "Transfer at full speed even inside a bandwidth_schedule window of the config")
+		useSCP     = pflag.Bool("scp", false, "Fall back to the SCP protocol for servers without an SFTP subsystem")
+		useMmap    = pflag.Bool("mmap", false, "Memory-map local files of 64MB or more during upload (Linux, macOS, BSD)")
+		keepVers   = pflag.Int("keep-versions", 0, "Keep this many previous copies of overwritten remote files as file.1, file.2, ... (SFTP uploads)")
+		maxDLSize  = pflag.String("max-download-size", "", "Fail the run before its downloads exceed this total size, e.g. 20G")
+		maxDepth   = pflag.Int("max-depth", 0, "Only download this many directory levels of a remote directory (1 = its files only, 0 = unlimited)")
+		stallTO    = pflag.Duration("stall-timeout", 0, "Abort a transfer when no data moves for this long, e.g. 60s (retried with --retries)")
+		maxTime    = pflag.Duration("max-time", 0, "Abort a transfer that takes longer than this, e.g. 30m")
+		suffixTS   = pflag.Bool("suffix-timestamp", false, "When a download target already exists locally, save it as name-YYYYMMDD-HHMMSS.ext instead of overwriting it")
+		ifChanged  = pflag.Bool("if-changed", false, "Skip files whose identical content was already uploaded to the same destination by an earlier run")
+		resume     = pflag.Bool("resume", false, "Continue partial files left by an interrupted transfer from where they end instead of starting over")
+		manifest   = pflag.Bool("manifest", false, "Write a SHA256SUMS manifest into uploaded directories, checked later with sftpsender verify")
+		xattrs     = pflag.Bool("xattrs", false, "Copy extended attributes and POSIX ACLs (needs getfattr/setfattr on the remote, or rsync -XA with --backend rsync)")
+		transport  = pflag.String("transport", transportBuiltin, "SSH implementation for uploads and downloads: builtin, or openssh to run the system ssh with its config, agents and tokens")
+		onCollide  = pflag.String("on-collision", "", "When upload sources share a file name: error (default), suffix (name-1.ext, ...) or keep-dirs (keep their directories)")
+		dryRun     = pflag.Bool("dry-run", false, "Print every file that would be uploaded or downloaded, with its destination and host, without transferring anything")
+		skipExist  = pflag.Bool("skip-existing", false, "Skip files that already exist at the destination with the same size")
+		decompress = pflag.Bool("decompress", false, "Decompress downloaded .gz, .zst and .xz files on the fly, writing them without the extension (.zst and .xz need zstd and xz)")
+		syncF      = pflag.Bool("sync", false, "Skip files whose destination has the same size and modification time, and keep the modification time of transferred files")
+		checksum   = pflag.Bool("checksum", false, "With --sync, compare the SHA-256 of files of the same size instead of their modification time")
+		threads    = pflag.Int("threads", 1, "Number of files of a directory to upload/download concurrently over one connection (also --concurrency)")
+		retries    = pflag.Int("retries", 0, "Retry a failed upload or download this many times on transient errors (timeouts, dropped connections)")
+		retryDelay = pflag.Duration("retry-delay", 5*time.Second, "Wait before the first retry, doubled for each further retry")
+		retryBudg  = pflag.Int("retry-budget", 0, "Retries allowed across all hosts of the run together, after which failures are final (0 = no limit)")
+		maxTotal   = pflag.Duration("max-total-time", 0, "Abort the whole run after this long and report what was done, e.g. 8h")
+		breakerMax = pflag.Int("breaker-threshold", 5, "Stop sending work to a host after this many consecutive failures (0 disables)")
+		breakerCD  = pflag.Duration("breaker-cooldown", 5*time.Minute, "How long a host stays paused once its circuit breaker opened")
+		parallel   = pflag.Int("parallel", 1, "Number of hosts to upload to at the same time with --autosend or a broadcast")
+		locationF  = pflag.String("location", "", "Destination directory, overriding the :path of --ip. May contain {host}, {n} (host number), {date} and {time}, e.g. ./results/{host}/{date}")
+		dashboardF = pflag.Bool("dashboard", false, "Show a full-screen per-host status view during --autosend and broadcasts instead of scrolling logs")
+		ci         = pflag.Bool("ci", false, "CI mode: no banner, line-oriented output with GitHub Actions annotations")
+		logTarget  = pflag.String("log-target", "stdout", "Where to send log messages: stdout or syslog")
+		webhook    = pflag.String("webhook", "", "POST a JSON run report to this URL when the run finishes")
+		history    = pflag.String("history-file", defaultHistoryPath, "Path to the transfer history file (JSON lines)")
+		noHistory  = pflag.Bool("no-history", false, "Do not record transfers in the history file")
+		notify     = pflag.StringSlice("notify", nil, "Notifiers to trigger for this run: config notifier name/type (e.g. discord) or ntfy://topic")
+		filter     transferFilter
 	)
+	pflag.Var(filterFlag{rules: &filter, include: true}, "include", "Transfer entries of a directory matching this rsync-style pattern even if a later --exclude matches (repeatable)")
+	pflag.Var(filterFlag{rules: &filter}, "exclude", "Skip entries of a directory matching this rsync-style pattern, e.g. .git/ or '*.log' (repeatable)")
+	logOpts := addLogFlags(pflag.CommandLine)
 
 	pflag.Parse()
 
+	if copyMode {
+		if pflag.NArg() != 2 || *upload != "" || *download != "" || *ip != "" {
+			logFatalf("usage: sftpsender cp [flags] SOURCE DEST, where one side is name:path")
+		}
+		var err error
+		if *upload, *download, *ip, copyLocation, err = parseCopyArgs(pflag.Arg(0), pflag.Arg(1)); err != nil {
+			logFatalf("%v", err)
+		}
+	}
+	if templateMode {
+		if err := applyTemplate(*configPath, pflag.Args()); err != nil {
+			logFatalf("%v", err)
+		}
+	}
+
 	// Print version and exit if -version flag is provided
 	if *version {
 		banner.PrintBanner()
@@ -603,32 +1966,263 @@ func main() {
 		return
 	}
 
+	ciMode = *ci
+	if err := setupLogTarget(*logTarget); err != nil {
+		logFatalf("%v", err)
+	}
+	if err := logOpts.apply(); err != nil {
+		logFatalf("%v", err)
+	}
+
 	// Don't Print banner if -silnet flag is provided
-	if !*silent {
+	if !*silent && !ciMode && sysLog == nil {
 		banner.PrintBanner()
 	}
 
 	// Validate autosend usage
 	if *autosend != "" && *download != "" {
-		log.Fatal("--autosend can only be used with --upload, not with --download")
+		logFatalf("--autosend can only be used with --upload, not with --download")
+	}
+	if *split {
+		switch {
+		case *upload == "" || *autosend != "" || !strings.Contains(*ip, ","):
+			logFatalf("--split needs --upload and several comma-separated hosts in --ip")
+		case *fanOut > 0:
+			logFatalf("--split does not work with --fan-out")
+		case *verify:
+			logFatalf("--split does not work with --verify, use --manifest and sftpsender verify instead")
+		}
 	}
 
 	if *ip == "" {
-		log.Fatal("IP address or VPS name is required. Use --ip flag")
+		logFatalf("IP address or VPS name is required. Use --ip flag")
 	}
 
 	if (*upload == "" && *download == "") || (*upload != "" && *download != "") {
-		log.Fatal("You must specify either --upload or --download (but not both)")
+		logFatalf("You must specify either --upload or --download (but not both)")
+	}
+
+	// Braces are expanded here as well, for quoted arguments and shells that
+	// don't expand them; autosend keeps its own worker* template
+	if *autosend == "" {
+		*ip = strings.Join(braceExpand(*ip), ",")
 	}
+	uploads, downloads := globExpand(braceExpand(*upload)), braceExpand(*download)
 
-	// Ensure config file exists
-	if err := ensureConfigExists(*configPath); err != nil {
-		log.Fatalf("Failed to ensure config file exists: %v", err)
+	var injected []Credential
+	if *credsF != "" {
+		var err error
+		if injected, err = readCredentials(*credsF); err != nil {
+			logFatalf("Invalid --credentials: %v", err)
+		}
 	}
 
-	sftpsender, err := NewSftpSender(*configPath)
+	// Credentials passed in for the run make the config file optional
+	var sftpsender *SftpSender
+	var err error
+	if _, statErr := os.Stat(expandHomeDir(*configPath)); injected != nil && os.IsNotExist(statErr) {
+		sftpsender, err = newSftpSender(&Config{}, expandHomeDir(*configPath))
+	} else {
+		// Ensure config file exists
+		if err := ensureConfigExists(*configPath); err != nil {
+			logFatalf("Failed to ensure config file exists: %v", err)
+		}
+		sftpsender, err = NewSftpSender(*configPath)
+	}
 	if err != nil {
-		log.Fatalf("Failed to initialize sftpsender: %v", err)
+		logFatalf("Failed to initialize sftpsender: %v", err)
+	}
+	// Ahead of the configured hosts, so they win for the same name or IP
+	sftpsender.config.Credentials = append(injected, sftpsender.config.Credentials...)
+	if sftpsender.config.CheckUpdates && !*silent && !ciMode && sysLog == nil {
+		versionHint()
+	}
+
+	if *userF != "" || *askPass {
+		if *autosend != "" {
+			logFatalf("--user and --ask-pass do not work with --autosend, its workers come from the config")
+		}
+		if err := sftpsender.addInlineHosts(*ip, *userF, *askPass); err != nil {
+			logFatalf("%v", err)
+		}
+	}
+	sftpsender.saveHosts = *saveHost
+	sftpsender.threads = *threads
+	sftpsender.autoTune = *autoTune
+	sftpsender.streams = *streams
+	sftpsender.skipExisting = *skipExist
+	if *checksum && !*syncF {
+		logFatalf("--checksum only applies to --sync")
+	}
+	sftpsender.sync, sftpsender.syncChecksum = *syncF, *checksum
+	if *resume && *backend == "tar" {
+		logFatalf("--resume does not apply to --backend tar")
+	}
+	sftpsender.resume = *resume
+	sftpsender.xattrs = *xattrs
+	sftpsender.manifest = *manifest
+	sftpsender.useMmap = *useMmap
+	sftpsender.useSCP = *useSCP
+	sftpsender.parallelHosts = *parallel
+	sftpsender.retries = *retries
+	sftpsender.retryDelay = *retryDelay
+	sftpsender.retryBudget = *retryBudg
+	sftpsender.maxTotalTime = *maxTotal
+	sftpsender.breakerThreshold = *breakerMax
+	sftpsender.breakerCooldown = *breakerCD
+	if *backend != "sftp" && *backend != "rsync" && *backend != "tar" {
+		logFatalf("Invalid --backend %q: must be sftp, rsync or tar", *backend)
+	}
+	sftpsender.backend = *backend
+	if *decompress {
+		if *download == "" {
+			logFatalf("--decompress only applies to --download")
+		}
+		if *backend != "sftp" {
+			logWarnf("--decompress downloads over SFTP, not using the %s backend\n", *backend)
+			sftpsender.backend = "sftp"
+		}
+	}
+	sftpsender.decompress = *decompress
+	if *dryRun {
+		if *dashboardF {
+			logFatalf("--dry-run does not work with --dashboard")
+		}
+		logInfof("Dry run, nothing is transferred\n")
+	}
+	sftpsender.dryRun = *dryRun
+	sftpsender.rsyncDelete = *deleteF
+	sftpsender.trash = *trash
+	if *trash && !*deleteF {
+		logFatalf("--trash only applies to --delete")
+	}
+	if *readOnly && *deleteF {
+		logFatalf("--read-only does not allow --delete")
+	}
+	sftpsender.readOnly = *readOnly
+	sftpsender.unsafe = *unsafe
+	if *noSched {
+		sftpsender.schedule = nil
+	}
+	if *limitRate != "" {
+		rate, err := parseSize(*limitRate)
+		if err != nil {
+			logFatalf("Invalid --limit-rate: %v", err)
+		}
+		sftpsender.limitRate = int64(rate)
+	}
+	if sftpsender.schedule == nil && sftpsender.limitRate == 0 {
+		sftpsender.limiter = nil
+	} else if sftpsender.limiter == nil {
+		sftpsender.limiter = &rateLimiter{rate: sftpsender.bandwidthLimit}
+	}
+	sftpsender.suffixTimestamp = *suffixTS
+	sftpsender.stallTimeout = *stallTO
+	sftpsender.maxTime = *maxTime
+	if *ifChanged {
+		sftpsender.uploadCache = loadUploadCache(stateFile("upload_cache.json"))
+	}
+	sftpsender.lockWait = *lockWait
+	sftpsender.remoteLock = *remoteLock
+	if *bufferSize != "" {
+		if sftpsender.bufferSize, err = parseSize(*bufferSize); err != nil {
+			logFatalf("Invalid --buffer-size: %v", err)
+		}
+	}
+	if *maxPacket != "" {
+		if sftpsender.maxPacket, err = parseSize(*maxPacket); err != nil {
+			logFatalf("Invalid --max-packet: %v", err)
+		}
+	}
+	if *maxDLSize != "" {
+		size, err := parseSize(*maxDLSize)
+		if err != nil {
+			logFatalf("Invalid --max-download-size: %v", err)
+		}
+		sftpsender.caps.maxSize = int64(size)
+	}
+	sftpsender.caps.maxDepth = *maxDepth
+	sftpsender.filter = filter
+	sftpsender.keepVersions = *keepVers
+	if *dirMode != "" {
+		if sftpsender.dirMode, err = parseDirMode(*dirMode); err != nil {
+			logFatalf("Invalid --dirmode: %v", err)
+		}
+	}
+	if *chmod != "" {
+		if *upload == "" {
+			logFatalf("--chmod only applies to --upload")
+		}
+		if sftpsender.fileMode, err = parseFileMode(*chmod); err != nil {
+			logFatalf("Invalid --chmod: %v", err)
+		}
+	}
+	if *netProfile != "" {
+		if err := sftpsender.applyNetProfile(*netProfile, pflag.CommandLine.Changed); err != nil {
+			logFatalf("Invalid --net-profile: %v", err)
+		}
+	}
+	switch *transport {
+	case transportBuiltin:
+	case transportOpenSSH:
+		// ssh only gives an SFTP session per run of it, not the exec channels
+		// and extra connections of these
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"--backend " + *backend, *backend != "sftp"},
+			{"--streams", *streams > 1},
+			{"--auto-tune", *autoTune},
+			{"--scp", *useSCP},
+			{"--xattrs", *xattrs},
+			{"--remote-lock", *remoteLock},
+			{"--fan-out", *fanOut > 0},
+		} {
+			if f.set {
+				logFatalf("%s does not work with --transport openssh", f.name)
+			}
+		}
+	default:
+		logFatalf("Invalid --transport %q: must be builtin or openssh", *transport)
+	}
+	sftpsender.transport = *transport
+	if !*noHistory {
+		sftpsender.historyPath = *history
+	}
+	sftpsender.auditPath = sftpsender.config.AuditLog
+	if *auditLog != "" {
+		sftpsender.auditPath = *auditLog
+	}
+
+	// Autosend gives every worker its own file, elsewhere the sources share
+	// one destination directory
+	if *onCollide != "" && !validCollisionPolicy(*onCollide) {
+		logFatalf("Invalid --on-collision %q, must be error, suffix or keep-dirs", *onCollide)
+	}
+	if *autosend == "" && len(uploads) > 1 {
+		policy := sftpsender.config.OnCollision
+		if *onCollide != "" {
+			policy = *onCollide
+		}
+		if policy == "" {
+			policy = collisionError
+		}
+		if uploads, err = sftpsender.planUploadNames(uploads, policy); err != nil {
+			logFatalf("%v", err)
+		}
+	}
+
+	if (*guardSens || sftpsender.config.GuardSensitive) && !*allowSens && *upload != "" {
+		if err := guardSensitive(uploads); err != nil {
+			logFatalf("%v", err)
+		}
+	}
+
+	// Notifiers given on the command line in addition to the config ones
+	sftpsender.extraNotifiers, sftpsender.selectedNotifiers = parseNotifyFlag(*notify)
+	if *webhook != "" {
+		sftpsender.extraNotifiers = append(sftpsender.extraNotifiers, Notifier{Type: "webhook", URL: *webhook})
 	}
 
 	// Handle autosend mode
@@ -636,22 +2230,25 @@ func main() {
 		// Parse worker numbers
 		workers, err := parseWorkerNumbers(*autosend, *ignore)
 		if err != nil {
-			log.Fatalf("Failed to parse worker numbers: %v", err)
+			logFatalf("Failed to parse worker numbers: %v", err)
 		}
 
-		// Find file sequence
-		files, err := findFileSequence(*upload, len(workers))
-		if err != nil {
-			log.Fatalf("Failed to find file sequence: %v", err)
+		// Find file sequence, unless the braces of --upload already list the files
+		files := uploads
+		if len(files) == 1 {
+			files, err = findFileSequence(*upload, len(workers))
+			if err != nil {
+				logFatalf("Failed to find file sequence: %v", err)
+			}
 		}
 
 		// Validate file count matches worker count
 		if len(files) != len(workers) {
-			log.Fatalf("File count (%d) does not match worker count (%d)", len(files), len(workers))
+			logFatalf("File count (%d) does not match worker count (%d)", len(files), len(workers))
 		}
 
 		// Get the original upload path's directory to preserve directory structure
-		originalUploadDir := filepath.Dir(*upload)
+		originalUploadDir := filepath.Dir(files[0])
 
 		// Parse IP template and location
 		ipParts := strings.SplitN(*ip, ":", 2)
@@ -662,69 +2259,286 @@ func main() {
 		}
 
 		// Upload files to workers
-		var errors []string
-		successCount := 0
+		report, err := sftpsender.startRun("autosend")
+		if err != nil {
+			logFatalf("Run aborted: %v", err)
+		}
+		hosts := make([]string, len(workers))
+		locations := make([]string, len(workers))
 		for i, workerNum := range workers {
 			// Resolve worker name from template
 			workerName := resolveWorkerName(workerNum, ipTemplate)
 
 			// Parse worker name and location
 			workerParts := strings.SplitN(workerName, ":", 2)
-			workerIPOrName := workerParts[0]
-			workerLocation := location
+			hosts[i] = workerParts[0]
+			locations[i] = location
 			if len(workerParts) > 1 {
-				workerLocation = workerParts[1]
+				locations[i] = workerParts[1]
+			}
+			if *locationF != "" {
+				locations[i] = *locationF
 			}
+			locations[i] = expandLocation(locations[i], hosts[i], workerNum, report.StartedAt)
+		}
+		report.Hosts = hosts
+		if *dashboardF {
+			sftpsender.startDashboard("autosend", hosts)
+		}
+
+		var mu sync.Mutex
+		errors := make([]string, len(workers))
+		timings := make([]hostTiming, len(workers))
+		successCount := 0
+		// Groups of hosts uploaded at the same time would interleave
+		grouped := sftpsender.parallelHosts <= 1 || len(hosts) == 1
+		sftpsender.forEachHost(hosts, sftpsender.parallelHosts, func(i int) {
+			workerNum, workerIPOrName := workers[i], hosts[i]
 
 			// Construct display path preserving original directory structure
 			// Use the original directory with the filename from the found file
 			displayPath := filepath.Join(originalUploadDir, filepath.Base(files[i]))
 
-			fmt.Printf("\n[%d/%d] Uploading to worker%d (%s)...\n", i+1, len(workers), workerNum, workerIPOrName)
-			if err := sftpsender.Upload(files[i], workerIPOrName, workerLocation, displayPath); err != nil {
-				errorMsg := fmt.Sprintf("Failed to upload to worker%d (%s): %v", workerNum, workerIPOrName, err)
-				errors = append(errors, errorMsg)
-				fmt.Printf("ERROR: %s\n", errorMsg)
+			if grouped {
+				logGroupStart(fmt.Sprintf("worker%d (%s)", workerNum, workerIPOrName))
+			}
+			sftpsender.hostLog(workerIPOrName).Infof("\n[%d/%d] Uploading to worker%d (%s)...\n", i+1, len(workers), workerNum, workerIPOrName)
+			started := time.Now()
+			err := sftpsender.uploadHost(files[i], workerIPOrName, locations[i], displayPath)
+			timings[i] = hostTiming{label: fmt.Sprintf("worker%d", workerNum), host: workerIPOrName, file: filepath.Base(files[i]),
+				size: localSize(files[i]), elapsed: time.Since(started), err: err}
+			mu.Lock()
+			if err != nil {
+				errors[i] = fmt.Sprintf("Failed to upload to worker%d (%s): %v", workerNum, workerIPOrName, err)
+				sftpsender.hostLog(workerIPOrName).Errorf("%s\n", errors[i])
+				sftpsender.hostFailed(workerIPOrName, err)
 			} else {
 				successCount++
-				fmt.Printf("✓ Successfully uploaded %s to worker%d\n", filepath.Base(files[i]), workerNum)
+				sftpsender.hostLog(workerIPOrName).Infof("✓ Successfully uploaded %s to worker%d\n", filepath.Base(files[i]), workerNum)
 			}
-		}
+			mu.Unlock()
+			if grouped {
+				logGroupEnd()
+			}
+		})
+		sftpsender.stopDashboard()
+		errors = slices.DeleteFunc(errors, func(e string) bool { return e == "" })
+
+		report.Errors = errors
+		sftpsender.finishRun(report)
 
 		// Print summary
-		fmt.Printf("\n=== Upload Summary ===\n")
-		fmt.Printf("Successful: %d/%d\n", successCount, len(workers))
+		logInfof("\n=== Upload Summary ===\n")
+		logTimings(timings)
+		logInfof("\nSuccessful: %d/%d in %s\n", successCount, len(workers), time.Since(report.StartedAt).Round(100*time.Millisecond))
+		sftpsender.logTrippedHosts()
 		if len(errors) > 0 {
-			fmt.Printf("Failed: %d/%d\n", len(errors), len(workers))
-			fmt.Printf("\nErrors:\n")
+			logInfof("Failed: %d/%d\n", len(errors), len(workers))
+			logInfof("\nErrors:\n")
 			for _, errMsg := range errors {
-				fmt.Printf("  - %s\n", errMsg)
+				logInfof("  - %s\n", errMsg)
+			}
+			logFatalf("Some uploads failed")
+		} else {
+			logInfof("All uploads completed successfully!\n")
+		}
+	} else if *upload != "" && strings.Contains(*ip, ",") {
+		// Broadcast the same upload to a comma-separated list of hosts
+		operation := "broadcast"
+		if *split {
+			operation = "split"
+		}
+		report, err := sftpsender.startRun(operation)
+		if err != nil {
+			logFatalf("Run aborted: %v", err)
+		}
+		var targets []broadcastTarget
+		for i, target := range strings.Split(*ip, ",") {
+			host, location, err := sftpsender.resolveTarget(strings.TrimSpace(target))
+			if err != nil {
+				logFatalf("%v", err)
+			}
+			if *locationF != "" {
+				location = *locationF
+			}
+			targets = append(targets, broadcastTarget{host: host, location: expandLocation(location, host, i+1, report.StartedAt)})
+		}
+
+		if *dashboardF {
+			var hosts []string
+			for _, t := range targets {
+				hosts = append(hosts, t.host)
+			}
+			sftpsender.startDashboard("broadcast", hosts)
+		}
+		// Each expanded file is broadcast in turn, a host keeps its first error
+		results := make(map[string]error)
+		if *split {
+			// Hosts receive many single files, so their connections are kept open
+			sftpsender.conns = &connPool{}
+			if results, err = sftpsender.splitUpload(uploads, targets); err != nil {
+				results = make(map[string]error)
+				for _, t := range targets {
+					results[t.host] = err
+				}
 			}
-			log.Fatal("Some uploads failed")
+			sftpsender.conns.closeAll()
 		} else {
-			fmt.Println("All uploads completed successfully!")
+			for _, localPath := range uploads {
+				fileResults := sftpsender.broadcast(localPath, targets, *fanOut)
+				if *verify && !*dryRun {
+					for host, err := range sftpsender.verifyFleet(localPath, targets, fileResults) {
+						fileResults[host] = err
+					}
+				}
+				for host, err := range fileResults {
+					if err != nil && results[host] == nil {
+						results[host] = err
+					}
+				}
+			}
+		}
+		sftpsender.stopDashboard()
+
+		var errors []string
+		for _, t := range targets {
+			report.Hosts = append(report.Hosts, t.host)
+			if err := results[t.host]; err != nil {
+				errorMsg := fmt.Sprintf("Failed to upload to %s: %v", t.host, err)
+				errors = append(errors, errorMsg)
+				logErrorf("%s\n", errorMsg)
+				sftpsender.hostFailed(t.host, err)
+			}
+		}
+		report.Errors = errors
+		sftpsender.finishRun(report)
+
+		if *split {
+			logInfof("\n=== Split Summary ===\n")
+		} else {
+			logInfof("\n=== Broadcast Summary ===\n")
+		}
+		logInfof("Successful: %d/%d\n", len(targets)-len(errors), len(targets))
+		sftpsender.logTrippedHosts()
+		if len(errors) > 0 {
+			logFatalf("Some uploads failed")
+		}
+		logInfof("All uploads completed successfully!\n")
+	} else if *download != "" && strings.Contains(*ip, ",") {
+		// Collect the same remote path from a comma-separated list of hosts,
+		// into one directory per host unless --location says otherwise
+		report, err := sftpsender.startRun("collect")
+		if err != nil {
+			logFatalf("Run aborted: %v", err)
+		}
+		var hosts, locations []string
+		for i, target := range strings.Split(*ip, ",") {
+			host, location, err := sftpsender.resolveTarget(strings.TrimSpace(target))
+			if err != nil {
+				logFatalf("%v", err)
+			}
+			switch {
+			case *locationF != "":
+				location = *locationF
+			case location == "":
+				location = "{host}"
+			}
+			hosts = append(hosts, host)
+			locations = append(locations, expandLocation(location, host, i+1, report.StartedAt))
+		}
+		report.Hosts = hosts
+		if *dashboardF {
+			sftpsender.startDashboard("collect", hosts)
+		}
+
+		var mu sync.Mutex
+		errors := make([]string, len(hosts))
+		sftpsender.forEachHost(hosts, sftpsender.parallelHosts, func(i int) {
+			sftpsender.hostLog(hosts[i]).Infof("\n[%d/%d] Downloading from %s...\n", i+1, len(hosts), hosts[i])
+			var err error
+			for _, remotePath := range downloads {
+				if err = sftpsender.downloadHost(remotePath, hosts[i], locations[i]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				errors[i] = fmt.Sprintf("Failed to download from %s: %v", hosts[i], err)
+				sftpsender.hostLog(hosts[i]).Errorf("%s\n", errors[i])
+				mu.Unlock()
+				sftpsender.hostFailed(hosts[i], err)
+			}
+		})
+		sftpsender.stopDashboard()
+		errors = slices.DeleteFunc(errors, func(e string) bool { return e == "" })
+		report.Errors = errors
+		sftpsender.finishRun(report)
+
+		logInfof("\n=== Download Summary ===\n")
+		logInfof("Successful: %d/%d\n", len(hosts)-len(errors), len(hosts))
+		sftpsender.logTrippedHosts()
+		if len(errors) > 0 {
+			logFatalf("Some downloads failed")
 		}
+		logInfof("All downloads completed successfully!\n")
 	} else {
 		// Original single-file upload/download logic
 		// Parse IP/name and optional location from --ip flag
-		// Format: IP or name:/path
-		ipParts := strings.SplitN(*ip, ":", 2)
-		ipOrName := ipParts[0]
-		var location string
-		if len(ipParts) > 1 {
-			location = ipParts[1]
+		// Format: IP, name, IP:/path, name:/path or sftp://user@host:port/path
+		ipOrName, location, err := sftpsender.resolveTarget(*ip)
+		if err != nil {
+			logFatalf("%v", err)
 		}
+		if copyLocation != "" {
+			location = copyLocation
+		}
+		if *locationF != "" {
+			location = *locationF
+		}
+		location = expandLocation(location, ipOrName, 1, time.Now())
 
 		if *upload != "" {
-			if err := sftpsender.Upload(*upload, ipOrName, location); err != nil {
-				log.Fatalf("Upload failed: %v", err)
+			report, err := sftpsender.startRun("upload")
+			if err != nil {
+				logFatalf("Run aborted: %v", err)
+			}
+			report.Hosts = []string{ipOrName}
+			for _, localPath := range uploads {
+				err = sftpsender.retry(ipOrName, func() error { return sftpsender.Upload(localPath, ipOrName, location) })
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				sftpsender.hostFailed(ipOrName, err)
+			}
+			sftpsender.finishRun(report)
+			if err != nil {
+				logFatalf("Upload failed: %v", err)
 			}
-			fmt.Println("Upload completed successfully!")
+			logInfof("Upload completed successfully!\n")
 		} else if *download != "" {
-			if err := sftpsender.Download(*download, ipOrName, location); err != nil {
-				log.Fatalf("Download failed: %v", err)
+			report, err := sftpsender.startRun("download")
+			if err != nil {
+				logFatalf("Run aborted: %v", err)
+			}
+			report.Hosts = []string{ipOrName}
+			for _, remotePath := range downloads {
+				err = sftpsender.retry(ipOrName, func() error { return sftpsender.Download(remotePath, ipOrName, location) })
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				sftpsender.hostFailed(ipOrName, err)
+			}
+			sftpsender.finishRun(report)
+			if err != nil {
+				logFatalf("Download failed: %v", err)
 			}
-			fmt.Println("Download completed successfully!")
+			logInfof("Download completed successfully!\n")
 		}
 	}
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// splitItem is one file of a --split upload
+type splitItem struct {
+	localPath string
+	subdir    string // slash-separated directory below the destination, empty for upload sources
+	size      int64
+}
+
+// splitHost is a host of a --split upload with the files placed on it
+type splitHost struct {
+	target   broadcastTarget
+	location string
+	capacity int64 // bytes the host can take, -1 if unknown
+	items    []splitItem
+	size     int64
+}
+
+// splitUpload spreads the upload sources over the targets instead of sending
+// all of them to every host. Files are placed largest first on the first host
+// with room left, so hosts fill up in the order given; directories are split
+// by file. The run fails up front when the files do not fit.
+func (s *SftpSender) splitUpload(uploads []string, targets []broadcastTarget) (map[string]error, error) {
+	items, err := s.splitItems(uploads)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := s.splitCapacities(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(items, func(a, b splitItem) int { return cmp.Compare(b.size, a.size) })
+	var unplaced []string
+	var total int64
+	for _, item := range items {
+		total += item.size
+		i := slices.IndexFunc(hosts, func(h *splitHost) bool { return h.capacity < 0 || h.size+item.size <= h.capacity })
+		if i < 0 {
+			unplaced = append(unplaced, fmt.Sprintf("%s (%s)", item.localPath, formatBytes(item.size)))
+			continue
+		}
+		hosts[i].items = append(hosts[i].items, item)
+		hosts[i].size += item.size
+	}
+	if len(unplaced) > 0 {
+		if len(unplaced) > 10 {
+			unplaced = append(unplaced[:10], fmt.Sprintf("and %d more", len(unplaced)-10))
+		}
+		return nil, fmt.Errorf("%w: %d of %d files do not fit on any host: %s",
+			ErrNoSpace, len(unplaced), len(items), strings.Join(unplaced, ", "))
+	}
+
+	logInfof("Splitting %d files (%s) across %d hosts:\n", len(items), formatBytes(total), len(hosts))
+	for _, h := range hosts {
+		room := "free space unknown"
+		if h.capacity >= 0 {
+			room = formatBytes(h.capacity) + " available"
+		}
+		logInfof("  %s: %d files, %s (%s)\n", h.target.host, len(h.items), formatBytes(h.size), room)
+		for _, item := range h.items {
+			logInfof("    %s\n", path.Join(item.subdir, s.remoteName(item.localPath)))
+		}
+	}
+
+	names := make([]string, len(hosts))
+	for i, h := range hosts {
+		names[i] = h.target.host
+	}
+	results := make(map[string]error)
+	var mu sync.Mutex
+	s.forEachHost(names, s.parallelHosts, func(i int) {
+		h := hosts[i]
+		if len(h.items) == 0 {
+			return
+		}
+		s.hostLog(h.target.host).Infof("\n[%d/%d] Uploading %d files to %s...\n", i+1, len(hosts), len(h.items), h.target.host)
+		var err error
+		for _, item := range h.items {
+			location := strings.TrimSuffix(h.location, "/")
+			if item.subdir != "" {
+				location += "/" + item.subdir
+			}
+			if err = s.uploadHost(item.localPath, h.target.host, location); err != nil {
+				break
+			}
+		}
+		mu.Lock()
+		results[h.target.host] = err
+		mu.Unlock()
+	})
+	return results, nil
+}
+
+// splitItems lists the files of the upload sources; the files of a directory
+// keep their place below a directory of its name
+func (s *SftpSender) splitItems(uploads []string) ([]splitItem, error) {
+	var items []splitItem
+	for _, source := range uploads {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat local path: %w", err)
+		}
+		if !info.IsDir() {
+			items = append(items, splitItem{localPath: source, size: info.Size()})
+			continue
+		}
+		scan, err := scanLocalTree(source, s.filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan local directory: %w", err)
+		}
+		for _, f := range scan.files {
+			if !f.info.Mode().IsRegular() {
+				continue
+			}
+			subdir := path.Join(s.remoteName(source), path.Dir(filepath.ToSlash(f.rel)))
+			items = append(items, splitItem{localPath: f.path, subdir: subdir, size: f.info.Size()})
+		}
+	}
+	return items, nil
+}
+
+// splitCapacities finds how much each target can take: its free space at the
+// destination, capped by the quota of the host
+func (s *SftpSender) splitCapacities(targets []broadcastTarget) ([]*splitHost, error) {
+	hosts := make([]*splitHost, len(targets))
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		hosts[i] = &splitHost{target: t, location: cmp.Or(t.location, s.config.DefaultRemoteLocation), capacity: -1}
+		names[i] = t.host
+	}
+	errs := make([]error, len(targets))
+	s.forEachHost(names, s.parallelHosts, func(i int) {
+		errs[i] = s.splitCapacity(hosts[i])
+	})
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to check the space on %s: %w", names[i], err)
+		}
+	}
+	return hosts, nil
+}
+
+func (s *SftpSender) splitCapacity(h *splitHost) error {
+	cred, err := s.findCredential(h.target.host)
+	if err != nil {
+		return err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	c, err := s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	free, ok := s.remoteFree(h.target.host, c, h.location, "only its quota limits what it receives")
+	if ok {
+		h.capacity = free
+	}
+	if cred.quota > 0 && (h.capacity < 0 || cred.quota < h.capacity) {
+		h.capacity = cred.quota
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Files of at least stripeMinSize bytes are split into one chunk per stream
+const stripeMinSize = 16 * 1024 * 1024
+
+// openStreams opens the SFTP sessions used for a transfer: one on the given
+// connection plus one per extra SSH connection requested with --streams.
+// The returned function closes everything except the original connection.
+func (s *SftpSender) openStreams(cred *Credential, client *ssh.Client, tuning linkTuning) ([]*sftp.Client, func(), error) {
+	var clients []*sftp.Client
+	var extraConns []*ssh.Client
+	closeAll := func() {
+		for _, c := range clients {
+			c.Close()
+		}
+		for _, c := range extraConns {
+			c.Close()
+		}
+	}
+
+	first, err := s.getSFTPClient(client, tuning)
+	if err != nil {
+		return nil, nil, err
+	}
+	clients = append(clients, first)
+
+	for i := 1; i < s.streams; i++ {
+		conn, err := s.dialSSH(cred)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open stream %d: %w", i+1, err)
+		}
+		extraConns = append(extraConns, conn)
+
+		sftpClient, err := s.getSFTPClient(conn, tuning)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to open stream %d: %w", i+1, err)
+		}
+		clients = append(clients, sftpClient)
+	}
+
+	return clients, closeAll, nil
+}
+
+// stripeRanges splits size bytes into one contiguous range per stream
+func stripeRanges(size int64, streams int) [][2]int64 {
+	chunk := size / int64(streams)
+	ranges := make([][2]int64, streams)
+	for i := range ranges {
+		start := int64(i) * chunk
+		end := start + chunk
+		if i == streams-1 {
+			end = size
+		}
+		ranges[i] = [2]int64{start, end}
+	}
+	return ranges
+}
+
+// uploadFileStriped uploads one large file with each stream writing its own
+// chunk of the remote file concurrently
+func (s *SftpSender) uploadFileStriped(clients []*sftp.Client, host, localPath, remotePath string, size int64) error {
+	if s.interrupted() {
+		return ErrInterrupted
+	}
+	start := time.Now()
+	n, checksum, err := s.uploadStripes(clients, localPath, remotePath, size)
+	if err == nil {
+		err = s.chmodUpload(clients[0], remotePath)
+	}
+	if err == nil {
+		err = s.keepUploadTime(clients[0], localPath, remotePath)
+	}
+	return s.fileDone("upload", host, localPath, remotePath, n, checksum, start, err)
+}
+
+func (s *SftpSender) uploadStripes(clients []*sftp.Client, localPath, remotePath string, size int64) (int64, string, error) {
+	remoteDir := path.Dir(remotePath)
+	if remoteDir != "." && remoteDir != "/" {
+		if err := s.mkdirAllRemote(clients[0], remoteDir); err != nil {
+			return 0, "", fmt.Errorf("failed to create remote directory: %w", err)
+		}
+	}
+
+	if err := s.rotateVersions(clients[0], remotePath); err != nil {
+		return 0, "", err
+	}
+
+	// Create (and truncate) the remote file once, streams then open it for writing
+	remoteFile, err := clients[0].Create(remotePath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create remote file: %w", err)
+	}
+	remoteFile.Close()
+	defer s.onAbort("partial file "+remotePath, func() error { return clients[0].Remove(remotePath) })()
+
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer localFile.Close()
+
+	pool := newTransferPool(len(clients))
+	for i, r := range stripeRanges(size, len(clients)) {
+		sftpClient, offset, length := clients[i], r[0], r[1]-r[0]
+		pool.submit(func() error {
+			f, err := sftpClient.OpenFile(remotePath, os.O_WRONLY)
+			if err != nil {
+				return fmt.Errorf("failed to open remote file: %w", err)
+			}
+			defer f.Close()
+
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek remote file: %w", err)
+			}
+			if _, err := f.ReadFrom(io.NewSectionReader(localFile, offset, length)); err != nil {
+				return fmt.Errorf("failed to copy file content: %w", err)
+			}
+			return nil
+		})
+	}
+	if err := pool.wait(); err != nil {
+		return 0, "", err
+	}
+
+	checksum, err := hashFile(localPath)
+	if err != nil {
+		return size, "", err
+	}
+	s.addTransferred(size)
+	return size, checksum, nil
+}
+
+// downloadFileStriped downloads one large file with each stream reading its own
+// chunk of the remote file concurrently
+func (s *SftpSender) downloadFileStriped(clients []*sftp.Client, host, remotePath, localPath string, size int64) error {
+	if s.interrupted() {
+		return ErrInterrupted
+	}
+	start := time.Now()
+	n, checksum, err := s.downloadStripes(clients, remotePath, localPath, size)
+	if err == nil {
+		err = s.keepDownloadTime(clients[0], remotePath, localPath)
+	}
+	return s.fileDone("download", host, localPath, remotePath, n, checksum, start, err)
+}
+
+func (s *SftpSender) downloadStripes(clients []*sftp.Client, remotePath, localPath string, size int64) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create local directory: %w", err)
+	}
+
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer localFile.Close()
+	defer s.onAbort("partial file "+localPath, func() error { return os.Remove(localPath) })()
+
+	pool := newTransferPool(len(clients))
+	for i, r := range stripeRanges(size, len(clients)) {
+		sftpClient, offset, length := clients[i], r[0], r[1]-r[0]
+		pool.submit(func() error {
+			f, err := sftpClient.Open(remotePath)
+			if err != nil {
+				return fmt.Errorf("failed to open remote file: %w", err)
+			}
+			defer f.Close()
+
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek remote file: %w", err)
+			}
+			buffer := s.getBuffer()
+			defer s.putBuffer(buffer)
+			if _, err := io.CopyBuffer(io.NewOffsetWriter(localFile, offset), io.LimitReader(f, length), *buffer); err != nil {
+				return fmt.Errorf("failed to copy file content: %w", err)
+			}
+			return nil
+		})
+	}
+	if err := pool.wait(); err != nil {
+		return 0, "", err
+	}
+
+	checksum, err := hashFile(localPath)
+	if err != nil {
+		return size, "", err
+	}
+	s.addTransferred(size)
+	return size, checksum, nil
+}
+
+// hashFile returns the hex SHA-256 of a local file
+func hashFile(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// With --sync, files whose destination already matches are not transferred
+// again. They match when size and modification time are equal or, with
+// --checksum, when size and SHA-256 are. Transferred files get the
+// modification time of their source so the next run can tell.
+
+// syncMatches reports whether the local and remote copies of a file are in
+// sync. remoteHash returns the SHA-256 of the remote copy and is only called
+// with --checksum once the sizes match.
+func (s *SftpSender) syncMatches(local, remote os.FileInfo, localPath string, remoteHash func() (string, bool)) bool {
+	if local == nil || remote == nil || !local.Mode().IsRegular() || !remote.Mode().IsRegular() || local.Size() != remote.Size() {
+		return false
+	}
+	if !s.syncChecksum {
+		// SFTP carries whole seconds
+		return local.ModTime().Unix() == remote.ModTime().Unix()
+	}
+	want, ok := remoteHash()
+	if !ok {
+		return false
+	}
+	got, err := hashFile(localPath)
+	return err == nil && got == want
+}
+
+// syncHashes returns the SHA-256 of the files below a remote directory for
+// --sync --checksum, or nil without --checksum or when the directory is new
+func (s *SftpSender) syncHashes(c *sftp.Client, host, dir string) treeHashes {
+	if !s.sync || !s.syncChecksum {
+		return nil
+	}
+	if _, err := c.Stat(dir); err != nil {
+		return nil
+	}
+	hashes, err := s.remoteTreeHashes(host, dir)
+	if err != nil {
+		s.hostLog(host).Warnf("%s: failed to hash %s, transferring every file: %v\n", host, dir, err)
+		return nil
+	}
+	return hashes
+}
+
+// lookupHash is the remoteHash of syncMatches for a file in hashes
+func lookupHash(hashes treeHashes, rel string) func() (string, bool) {
+	return func() (string, bool) {
+		sum, ok := hashes[rel]
+		return sum, ok
+	}
+}
+
+// remoteStat is the remote file info of syncMatches, nil if it cannot be read
+func remoteStat(c *sftp.Client, remotePath string) os.FileInfo {
+	info, err := c.Stat(remotePath)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// keepUploadTime gives an uploaded file the modification time of its source
+// under --sync
+func (s *SftpSender) keepUploadTime(c *sftp.Client, localPath, remotePath string) error {
+	if !s.sync {
+		return nil
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	return c.Chtimes(remotePath, time.Now(), info.ModTime())
+}
+
+// keepDownloadTime gives a downloaded file the modification time of its
+// source under --sync
+func (s *SftpSender) keepDownloadTime(c *sftp.Client, remotePath, localPath string) error {
+	if !s.sync {
+		return nil
+	}
+	info, err := c.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, time.Now(), info.ModTime())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+// hostColors are the ANSI colors of per-host line prefixes
+var hostColors = []string{"\033[36m", "\033[33m", "\033[35m", "\033[32m", "\033[34m", "\033[31m", "\033[96m", "\033[93m"}
+
+// useColor reports whether stdout is a terminal that should get ANSI colors
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" || ciMode {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// hostPrefix renders the "[host] " prefix of host, padded to width. The color
+// is picked from the host name, so a host keeps its color in every run.
+func hostPrefix(host string, width int, color bool) string {
+	prefix := fmt.Sprintf("[%-*s] ", width, host)
+	if !color {
+		return prefix
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return hostColors[h.Sum32()%uint32(len(hostColors))] + prefix + "\033[0m"
+}
+
+// runTail implements the "tail" subcommand: it follows the same file on many
+// hosts at once and interleaves their lines with a per-host prefix
+func runTail(args []string) error {
+	fs := pflag.NewFlagSet("tail", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names to read from")
+	group := fs.String("group", "", "Read from every host of this group")
+	follow := fs.BoolP("follow", "f", false, "Keep following the file as it grows")
+	lines := fs.IntP("lines", "n", 10, "Number of trailing lines to print first")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sftpsender tail [-f] [-n N] (--ip hosts | --group name) PATH")
+	}
+	remotePath := fs.Arg(0)
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	width := 0
+	for _, h := range hosts {
+		if len(h) > width {
+			width = len(h)
+		}
+	}
+	color := useColor()
+
+	command := "tail -n " + strconv.Itoa(*lines)
+	if *follow {
+		command += " -F"
+	}
+	command += " " + shellQuote(remotePath)
+
+	var outMu sync.Mutex
+	var wg sync.WaitGroup
+	failed := 0
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			prefix := hostPrefix(host, width, color)
+			err := s.streamRemoteLines(host, command, func(line string) {
+				outMu.Lock()
+				fmt.Println(prefix + line)
+				outMu.Unlock()
+			})
+			if err != nil {
+				outMu.Lock()
+				failed++
+				logErrorf("%s%v\n", prefix, err)
+				outMu.Unlock()
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(hosts))
+	}
+	return nil
+}
+
+// streamRemoteLines runs a command on a host and passes each line of its
+// combined output to emit as it arrives
+func (s *SftpSender) streamRemoteLines(host, command string, emit func(string)) error {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %v", err)
+	}
+	defer session.Close()
+
+	reader, writer := io.Pipe()
+	session.Stdout = writer
+	session.Stderr = writer
+	if err := session.Start(command); err != nil {
+		return err
+	}
+	go func() {
+		writer.CloseWithError(session.Wait())
+	}()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		emit(scanner.Text())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// uploadTar streams a local directory as a tar archive into "tar xf -" on the
+// remote host, avoiding one SFTP round trip per file for trees of small files
+func (s *SftpSender) uploadTar(client *ssh.Client, host, localPath, remotePath string) error {
+	scan, err := scanLocalTree(localPath, s.filter)
+	if err != nil {
+		return fmt.Errorf("failed to scan local directory: %w", err)
+	}
+	s.hostLog(host).Infof("Found %d files (%d bytes) in %d directories\n", len(scan.files), scan.totalSize, len(scan.dirs))
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	dir := shellQuote(remotePath)
+	command := "mkdir -p " + dir + " && tar xf - -C " + dir
+	if s.dirMode != 0 {
+		// Apply the umask of --dirmode even when extracting as root
+		command = "mkdir -p " + dir + " && tar xf - --no-same-permissions -C " + dir
+	}
+	if err := session.Start(s.remoteUmask(command)); err != nil {
+		return fmt.Errorf("failed to start remote tar: %w", err)
+	}
+
+	tw := tar.NewWriter(stdin)
+	err = s.writeTar(tw, host, scan, remotePath)
+	if err == nil {
+		err = tw.Close()
+	}
+	stdin.Close()
+	if waitErr := session.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("remote tar failed: %v", waitErr)
+	}
+	return err
+}
+
+func (s *SftpSender) writeTar(tw *tar.Writer, host string, scan *localScan, remotePath string) error {
+	for _, d := range scan.dirs {
+		hdr, err := tar.FileInfoHeader(d.info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(d.rel) + "/"
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write tar stream: %w", err)
+		}
+	}
+
+	buffer := s.getBuffer()
+	defer s.putBuffer(buffer)
+	for _, f := range scan.files {
+		if !f.info.Mode().IsRegular() {
+			continue
+		}
+		if s.skipUnchanged(host, f.path, path.Join(remotePath, filepath.ToSlash(f.rel)), f.info) {
+			continue
+		}
+		start := time.Now()
+		rel := filepath.ToSlash(f.rel)
+		n, checksum, err := s.writeTarFile(tw, f, rel, *buffer)
+		if err := s.fileDone("upload", host, f.path, path.Join(remotePath, rel), n, checksum, start, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SftpSender) writeTarFile(tw *tar.Writer, f localEntry, name string, buffer []byte) (int64, string, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer file.Close()
+
+	hdr, err := tar.FileInfoHeader(f.info, "")
+	if err != nil {
+		return 0, "", err
+	}
+	hdr.Name = name
+	if s.fileMode != 0 {
+		hdr.Mode = int64(s.fileMode)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return 0, "", fmt.Errorf("failed to write tar stream: %w", err)
+	}
+
+	// The header fixes the size, so copy exactly that many bytes even if the file changes
+	hash := sha256.New()
+	n, err := io.CopyBuffer(tw, io.TeeReader(io.LimitReader(file, f.info.Size()), hash), buffer)
+	if err != nil {
+		return n, "", fmt.Errorf("failed to copy file content: %w", err)
+	}
+	if n != f.info.Size() {
+		return n, "", fmt.Errorf("file changed size during upload")
+	}
+	s.addTransferred(n)
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// downloadTar reads "tar cf -" of a remote directory and extracts it into localPath
+func (s *SftpSender) downloadTar(client *ssh.Client, host, remotePath, localPath string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	session.Stderr = os.Stderr
+	if err := session.Start("tar cf - -C " + shellQuote(remotePath) + " ."); err != nil {
+		return fmt.Errorf("failed to start remote tar: %w", err)
+	}
+
+	err = s.extractTar(tar.NewReader(stdout), host, remotePath, localPath)
+	if err != nil {
+		// Drain the rest so the remote tar can exit
+		io.Copy(io.Discard, stdout)
+	}
+	if waitErr := session.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("remote tar failed: %v", waitErr)
+	}
+	return err
+}
+
+// extractTar writes directories and regular files of the archive below
+// localPath. Entries escaping localPath, links and devices are skipped.
+func (s *SftpSender) extractTar(tr *tar.Reader, host, remotePath, localPath string) error {
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return fmt.Errorf("failed to create local directory: %w", err)
+	}
+
+	buffer := s.getBuffer()
+	defer s.putBuffer(buffer)
+	beyond := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if beyond > 0 {
+				s.hostLog(host).Warnf("Skipped %d entries deeper than --max-depth %d\n", beyond, s.caps.maxDepth)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar stream: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			s.hostLog(host).Warnf("Skipping unsafe tar entry %q\n", hdr.Name)
+			continue
+		}
+		target := filepath.Join(localPath, filepath.FromSlash(name))
+		if s.beyondDepth(name) {
+			beyond++
+			continue
+		}
+		if s.filter.excludes(name, hdr.Typeflag == tar.TypeDir) {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, hdr.FileInfo().Mode().Perm()|0700); err != nil {
+				return fmt.Errorf("failed to create local directory: %w", err)
+			}
+		case tar.TypeReg:
+			if err := s.reserveDownload(path.Join(remotePath, name), hdr.Size); err != nil {
+				return err
+			}
+			start := time.Now()
+			n, checksum, err := s.extractTarFile(tr, target, hdr, *buffer)
+			if err := s.fileDone("download", host, target, path.Join(remotePath, name), n, checksum, start, err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *SftpSender) extractTarFile(tr *tar.Reader, target string, hdr *tar.Header, buffer []byte) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create local directory: %w", err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create local file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(f, hash), tr, buffer)
+	if err != nil {
+		return n, "", fmt.Errorf("failed to copy file content: %w", err)
+	}
+	s.addTransferred(n)
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolveTarget splits a --ip value into the host to look up in the config and
+// the optional location. Besides IP, name, IP:/path and name:/path it accepts
+// sftp://[user[:password]@]host[:port]/path URLs and their scp-style
+// user[:password]@host[:port][:path] form.
+func (s *SftpSender) resolveTarget(target string) (string, string, error) {
+	if u, location, ok := parseInlineTarget(target); ok {
+		return s.urlCredential(u), location, nil
+	}
+	if !strings.HasPrefix(target, "sftp://") {
+		parts := strings.SplitN(target, ":", 2)
+		if len(parts) > 1 {
+			return parts[0], parts[1], nil
+		}
+		return parts[0], "", nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid sftp URL: %v", err)
+	}
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid sftp URL %q: missing host", target)
+	}
+	return s.urlCredential(u), u.Path, nil
+}
+
+// expandLocation fills in the placeholders of a --location template for the
+// n-th host of a run: {host}, {n}, {date} (2006-01-02) and {time} (150405).
+// All hosts of a run share the same date and time.
+func expandLocation(template, host string, n int, runStart time.Time) string {
+	return strings.NewReplacer(
+		"{host}", host,
+		"{n}", strconv.Itoa(n),
+		"{date}", runStart.Format("2006-01-02"),
+		"{time}", runStart.Format("150405"),
+	).Replace(template)
+}
+
+// urlCredential returns the credential name for a URL's host. Pieces missing
+// from the URL are taken from a configured credential with the same IP or name;
+// the result is registered under the URL's user@host:port so Upload and
+// Download can look it up like any other host.
+func (s *SftpSender) urlCredential(u *url.URL) string {
+	host, port := u.Hostname(), u.Port()
+
+	var cred Credential
+	for _, c := range s.config.Credentials {
+		if c.Name == host || c.IP == host || (port != "" && c.IP == net.JoinHostPort(host, port)) ||
+			(port == "22" && c.IP == host) {
+			cred = c
+			break
+		}
+	}
+
+	if cred.IP == "" || port != "" {
+		cred.IP = host
+		if port != "" && port != "22" {
+			cred.IP = net.JoinHostPort(host, port)
+		}
+	}
+	if u.User != nil {
+		cred.Username = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			cred.Password = password
+		}
+	}
+	if cred.Username == "" {
+		// Like scp, fall back to the local user name
+		if current, err := user.Current(); err == nil {
+			cred.Username = current.Username
+		}
+	}
+
+	cred.Name = fmt.Sprintf("%s@%s", cred.Username, cred.IP)
+	if _, err := s.findCredential(cred.Name); err == nil {
+		return cred.Name
+	}
+	s.config.Credentials = append(s.config.Credentials, cred)
+	s.inline.add(cred)
+	return cred.Name
+}
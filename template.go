@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// Template is a named transfer in the templates section of the config, run
+// with "sftpsender run-template NAME PATH...". It stands for the flags it
+// sets; flags given on the command line take precedence.
+type Template struct {
+	Direction string            `yaml:"direction"` // upload or download
+	Hosts     string            `yaml:"hosts"`     // like --ip, comma-separated
+	Group     string            `yaml:"group"`     // every host of the group, in addition to hosts
+	Remote    string            `yaml:"remote"`    // destination of uploads, base of relative download paths
+	Local     string            `yaml:"local"`     // destination of downloads, like --location
+	Chmod     string            `yaml:"chmod"`     // like --chmod
+	Verify    bool              `yaml:"verify"`    // like --verify
+	Flags     map[string]string `yaml:"flags"`     // any other flag by its long name, e.g. threads: 4
+}
+
+// applyTemplate sets the flags of the template named by the first positional
+// argument. The remaining arguments are the paths to transfer.
+func applyTemplate(configPath string, args []string) error {
+	data, err := os.ReadFile(expandHomeDir(configPath))
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	// Only names and groups of the credentials are needed, so nothing is
+	// decrypted here
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: sftpsender run-template NAME PATH... [flags]%s", templateNames(config.Templates))
+	}
+	t, ok := config.Templates[args[0]]
+	if !ok {
+		return fmt.Errorf("no template %q in the config%s", args[0], templateNames(config.Templates))
+	}
+
+	set := func(name, value string) error {
+		if value == "" || pflag.CommandLine.Changed(name) {
+			return nil
+		}
+		if err := pflag.Set(name, value); err != nil {
+			return fmt.Errorf("template %s: invalid %s %q: %v", args[0], name, value, err)
+		}
+		return nil
+	}
+
+	paths := args[1:]
+	location := t.Local
+	switch t.Direction {
+	case "upload":
+		location = t.Remote
+	case "download":
+		if t.Remote != "" {
+			for i, p := range paths {
+				if !path.IsAbs(p) {
+					paths[i] = path.Join(t.Remote, p)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("template %s: direction must be upload or download, not %q", args[0], t.Direction)
+	}
+	source := paths[0]
+	if len(paths) > 1 {
+		source = "{" + strings.Join(paths, ",") + "}"
+	}
+
+	hosts := t.Hosts
+	if t.Group != "" {
+		s := &SftpSender{config: &config}
+		list, err := s.selectHosts(t.Hosts, t.Group)
+		if err != nil {
+			return fmt.Errorf("template %s: %w", args[0], err)
+		}
+		hosts = strings.Join(list, ",")
+	}
+
+	verify := ""
+	if t.Verify {
+		verify = "true"
+	}
+	for _, f := range []struct{ name, value string }{
+		{t.Direction, source},
+		{"ip", hosts},
+		{"location", location},
+		{"chmod", t.Chmod},
+		{"verify", verify},
+	} {
+		if err := set(f.name, f.value); err != nil {
+			return err
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(t.Flags)) {
+		if pflag.Lookup(name) == nil {
+			return fmt.Errorf("template %s: unknown flag %q", args[0], name)
+		}
+		if err := set(name, t.Flags[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateNames lists the defined templates for usage errors
+func templateNames(templates map[string]Template) string {
+	if len(templates) == 0 {
+		return ", no templates are defined in the config"
+	}
+	return ", templates: " + strings.Join(slices.Sorted(maps.Keys(templates)), ", ")
+}
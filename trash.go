@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/pflag"
+)
+
+// trashDir is where --trash moves files that --delete would remove, below the
+// synced directory, with one subdirectory per run named like a snapshot
+const trashDir = ".sftpsender-trash"
+
+// runTrash implements the "trash" subcommand with its list and empty actions
+func runTrash(args []string) error {
+	const usage = "usage: sftpsender trash (list | empty) (--ip hosts | --group name) --path DIR [--older-than 168h]"
+	if len(args) == 0 || (args[0] != "list" && args[0] != "empty") {
+		return errors.New(usage)
+	}
+	action := args[0]
+
+	fs := pflag.NewFlagSet("trash", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	configPath := fs.String("config", defaultConfigPath, "Path to config file")
+	ips := fs.String("ip", "", "Comma-separated IPs or VPS names")
+	group := fs.String("group", "", "Every host of this group")
+	dir := fs.String("path", "", "Remote directory that was synced with --delete --trash (required)")
+	olderThan := fs.Duration("older-than", 0, "Only empty trash from runs older than this, e.g. 168h")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New(usage)
+	}
+
+	s, err := NewSftpSender(*configPath)
+	if err != nil {
+		return err
+	}
+	s.auditPath = s.config.AuditLog
+	hosts, err := s.selectHosts(*ips, *group)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, host := range hosts {
+		if err := s.trashOnHost(host, action, path.Join(*dir, trashDir), *olderThan); err != nil {
+			logErrorf("%s: %v\n", host, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("trash %s failed on %d of %d hosts", action, failed, len(hosts))
+	}
+	return nil
+}
+
+// trashOnHost lists or empties the trash directory of one host
+func (s *SftpSender) trashOnHost(host, action, trash string, olderThan time.Duration) error {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return err
+	}
+	if action == "empty" {
+		if err := s.refuseReadOnly(cred, "empty the trash"); err != nil {
+			return err
+		}
+		if err := checkRemotePrefix(cred, trash, "empty the trash in"); err != nil {
+			return err
+		}
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	entries, err := sftpClient.ReadDir(trash)
+	if errors.Is(err, os.ErrNotExist) {
+		s.hostLog(host).Infof("%s: trash is empty\n", host)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", trash, err)
+	}
+	var runs []string
+	for _, e := range entries {
+		if _, err := time.ParseInLocation(snapshotLayout, e.Name(), time.Local); err == nil && e.IsDir() {
+			runs = append(runs, e.Name())
+		}
+	}
+	slices.Sort(runs)
+
+	for _, run := range runs {
+		dir := path.Join(trash, run)
+		if action == "list" {
+			files, size := 0, int64(0)
+			walker := sftpClient.Walk(dir)
+			for walker.Step() {
+				if walker.Err() == nil && !walker.Stat().IsDir() {
+					files++
+					size += walker.Stat().Size()
+				}
+			}
+			s.hostLog(host).Infof("%s: %s  %d files, %s\n", host, dir, files, formatBytes(size))
+			continue
+		}
+
+		taken, _ := time.ParseInLocation(snapshotLayout, run, time.Local)
+		if olderThan > 0 && time.Since(taken) < olderThan {
+			continue
+		}
+		if err := sftpClient.RemoveAll(dir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", dir, err)
+		}
+		s.audit(AuditEntry{Type: "trash", Host: host, RemotePath: dir, Status: "success"})
+		s.hostLog(host).Infof("%s: removed %s\n", host, dir)
+	}
+	if len(runs) == 0 {
+		s.hostLog(host).Infof("%s: trash is empty\n", host)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// linkTuning holds the transfer settings used for one connection
+type linkTuning struct {
+	maxConcurrent int // SFTP requests in flight per file
+	maxPacket     int // SFTP packet size, 0 = library default
+	threads       int // files of a directory transferred concurrently
+}
+
+// Auto-tuning sizes the in-flight window for this bandwidth assumption so long
+// fat links are kept full, within these request bounds
+const (
+	autoTuneBandwidth     = 125 * 1024 * 1024 // 1 Gbit/s in bytes per second
+	autoTuneMinConcurrent = 64
+	autoTuneMaxConcurrent = 512
+)
+
+// tuneLink returns the settings for a connection. Without --auto-tune these are
+// the configured values; with it they are derived from the measured round trip time.
+func (s *SftpSender) tuneLink(client *ssh.Client, host string) linkTuning {
+	t := linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket, threads: s.threads}
+	if !s.autoTune {
+		return t
+	}
+
+	rtt, err := measureRTT(client, 3)
+	if err != nil {
+		s.hostLog(host).Warnf("auto-tune: failed to measure round trip time to %s: %v\n", host, err)
+		return t
+	}
+
+	// Larger packets cut the number of round trips on slow links, but only
+	// OpenSSH is known to accept packets above the 32KB the spec guarantees
+	packet := 32 * 1024
+	if rtt > 50*time.Millisecond && strings.Contains(string(client.ServerVersion()), "OpenSSH") && s.maxPacket == 0 {
+		packet = 128 * 1024
+		t.maxPacket = packet
+	} else if s.maxPacket > 0 {
+		packet = s.maxPacket
+	}
+
+	// Enough requests in flight to cover the bandwidth-delay product
+	inFlight := int(int64(autoTuneBandwidth) * int64(rtt) / int64(time.Second))
+	t.maxConcurrent = inFlight/packet + 1
+	if t.maxConcurrent < autoTuneMinConcurrent {
+		t.maxConcurrent = autoTuneMinConcurrent
+	}
+	if t.maxConcurrent > autoTuneMaxConcurrent {
+		t.maxConcurrent = autoTuneMaxConcurrent
+	}
+
+	// Parallel files hide per-file round trips on high-latency links
+	switch {
+	case rtt > 150*time.Millisecond && t.threads < 8:
+		t.threads = 8
+	case rtt > 50*time.Millisecond && t.threads < 4:
+		t.threads = 4
+	}
+
+	s.hostLog(host).Infof("Auto-tune for %s: RTT %s -> %d requests in flight, %dKB packets, %d threads\n",
+		host, rtt.Round(time.Millisecond), t.maxConcurrent, packet/1024, t.threads)
+	return t
+}
+
+// measureRTT returns the smallest of several SSH global request round trips
+func measureRTT(client *ssh.Client, samples int) (time.Duration, error) {
+	var best time.Duration
+	for i := 0; i < samples; i++ {
+		start := time.Now()
+		// Servers answer unknown global requests with a failure reply, which is
+		// all that is needed to time the round trip
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			return 0, err
+		}
+		if rtt := time.Since(start); best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/rix4uni/sftpsender/banner"
+)
+
+const latestReleaseURL = "https://api.github.com/repos/rix4uni/sftpsender/releases/latest"
+
+// githubRelease is the part of the GitHub releases API response used here
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	HTMLURL string `json:"html_url"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// runUpdate implements the "update" subcommand: it replaces the running
+// binary with the latest release for this platform after checking its SHA-256
+// against the checksums published with the release. Both come from the same
+// GitHub release, so this catches corrupt downloads but is no proof of origin.
+func runUpdate(args []string) error {
+	fs := pflag.NewFlagSet("update", pflag.ContinueOnError)
+	logOpts := addLogFlags(fs)
+	check := fs.Bool("check", false, "Only report whether a newer version is available")
+	force := fs.Bool("force", false, "Reinstall even if the latest release is not newer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logOpts.apply(); err != nil {
+		return err
+	}
+
+	release, err := fetchLatestRelease(30 * time.Second)
+	if err != nil {
+		return err
+	}
+	current := banner.Version()
+	if compareVersions(release.TagName, current) <= 0 && !*force {
+		logInfof("sftpsender %s is up to date\n", current)
+		return nil
+	}
+	if *check {
+		logInfof("sftpsender %s is available (current %s): %s\n", release.TagName, current, release.HTMLURL)
+		return nil
+	}
+
+	asset, checksums := releaseAssets(release)
+	if asset == "" {
+		return fmt.Errorf("release %s has no binary for %s/%s", release.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if checksums == "" {
+		return fmt.Errorf("release %s publishes no checksums, refusing to install an unverified binary", release.TagName)
+	}
+
+	logInfof("Downloading sftpsender %s for %s/%s...\n", release.TagName, runtime.GOOS, runtime.GOARCH)
+	data, err := httpDownload(asset)
+	if err != nil {
+		return err
+	}
+	sums, err := httpDownload(checksums)
+	if err != nil {
+		return err
+	}
+	perAsset := path.Base(checksums) == path.Base(asset)+".sha256"
+	if err := verifyReleaseChecksum(path.Base(asset), data, sums, perAsset); err != nil {
+		return err
+	}
+	logInfof("Checksum matches %s (integrity only, releases are not signed)\n", path.Base(checksums))
+	binary, err := extractReleaseBinary(path.Base(asset), data)
+	if err != nil {
+		return err
+	}
+	if err := replaceExecutable(binary); err != nil {
+		return err
+	}
+	logInfof("Updated sftpsender %s -> %s\n", current, release.TagName)
+	return nil
+}
+
+// signatureSuffixes mark release assets that accompany an archive, such as
+// signatures and SBOMs, and are never the archive itself
+var signatureSuffixes = []string{".sig", ".asc", ".pem", ".sbom", ".sbom.json"}
+
+// releaseAssets picks the archive for this platform, named like
+// sftpsender-linux-amd64-0.0.5.tgz or sftpsender_0.0.5_linux_amd64.tar.gz, and
+// the checksums file covering it
+func releaseAssets(release *githubRelease) (asset, checksums string) {
+	platforms := []string{runtime.GOOS + "-" + runtime.GOARCH, runtime.GOOS + "_" + runtime.GOARCH}
+	assetName := ""
+	for _, a := range release.Assets {
+		name := strings.ToLower(a.Name)
+		if strings.Contains(name, "checksum") || strings.HasSuffix(name, ".sha256") {
+			continue
+		}
+		if slices.ContainsFunc(signatureSuffixes, func(suffix string) bool { return strings.HasSuffix(name, suffix) }) {
+			continue
+		}
+		for _, p := range platforms {
+			if strings.Contains(name, p) && asset == "" {
+				asset, assetName = a.URL, a.Name
+			}
+		}
+	}
+	for _, a := range release.Assets {
+		if a.Name == assetName+".sha256" || (checksums == "" && strings.Contains(strings.ToLower(a.Name), "checksum")) {
+			checksums = a.URL
+		}
+	}
+	return asset, checksums
+}
+
+func fetchLatestRelease(timeout time.Duration) (*githubRelease, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(latestReleaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check latest release: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to check latest release: HTTP %d", resp.StatusCode)
+	}
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to parse release metadata: %w", err)
+	}
+	return &release, nil
+}
+
+func httpDownload(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: HTTP %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verifyReleaseChecksum checks data against the "sha256  name" line for name,
+// or, when sums is the per-asset name.sha256 file, against its bare hash
+func verifyReleaseChecksum(name string, data, sums []byte, perAsset bool) error {
+	sum := sha256.Sum256(data)
+	actual := hex.EncodeToString(sum[:])
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (perAsset && len(fields) == 1) || (len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name) {
+			if !strings.EqualFold(fields[0], actual) {
+				return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, fields[0], actual)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no checksum published for %s", name)
+}
+
+// extractReleaseBinary returns the sftpsender executable from a release
+// asset, which is a .tar.gz, a .zip or the bare binary
+func extractReleaseBinary(name string, data []byte) ([]byte, error) {
+	isBinary := func(p string) bool {
+		base := path.Base(p)
+		return base == "sftpsender" || base == "sftpsender.exe"
+	}
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read release archive: %w", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read release archive: %w", err)
+			}
+			if hdr.Typeflag == tar.TypeReg && isBinary(hdr.Name) {
+				return io.ReadAll(tr)
+			}
+		}
+	case strings.HasSuffix(name, ".zip"):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read release archive: %w", err)
+		}
+		for _, f := range zr.File {
+			if isBinary(f.Name) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				return io.ReadAll(rc)
+			}
+		}
+	default:
+		return data, nil
+	}
+	return nil, fmt.Errorf("release archive %s contains no sftpsender binary", name)
+}
+
+// replaceExecutable writes binary next to the running executable and renames
+// it into place; the old binary is moved aside first so this works on Windows too
+func replaceExecutable(binary []byte) error {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to locate the running executable: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".sftpsender-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", exe, err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return fmt.Errorf("failed to replace %s: %w", exe, err)
+	}
+	// Windows keeps the running binary locked, it is removed on the next update
+	os.Remove(old)
+	return nil
+}
+
+// compareVersions compares two vMAJOR.MINOR.PATCH versions, returning -1, 0 or 1
+func compareVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			y, _ = strconv.Atoi(pb[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
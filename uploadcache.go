@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cachedUpload is a file uploaded by an earlier run
+type cachedUpload struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"` // local modification time when it was sent
+	Checksum string    `json:"sha256"`
+}
+
+// uploadCache remembers completed uploads by host and remote path so that
+// --if-changed can skip files whose content was already sent
+type uploadCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]cachedUpload
+	dirty   bool
+}
+
+func loadUploadCache(path string) *uploadCache {
+	c := &uploadCache{path: path, entries: make(map[string]cachedUpload)}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &c.entries)
+	}
+	return c
+}
+
+func uploadCacheKey(hostIP, remotePath string) string {
+	return hostIP + ":" + remotePath
+}
+
+// unchanged reports whether the local file was already uploaded to the
+// destination with the same content. Size and modification time are compared
+// first; only a file touched since then is hashed.
+func (c *uploadCache) unchanged(key, localPath string, info os.FileInfo) bool {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || entry.Size != info.Size() {
+		return false
+	}
+	if entry.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+	sum, err := hashFile(localPath)
+	if err != nil || sum != entry.Checksum {
+		return false
+	}
+	c.put(key, info, sum)
+	return true
+}
+
+func (c *uploadCache) put(key string, info os.FileInfo, checksum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cachedUpload{Size: info.Size(), ModTime: info.ModTime(), Checksum: checksum}
+	c.dirty = true
+}
+
+// save writes the cache back if it changed, through a temporary file so a
+// crash never leaves it truncated
+func (c *uploadCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	c.dirty = false
+	return os.Rename(tmp, c.path)
+}
+
+// skipUnchanged reports whether --if-changed lets an upload of localPath to
+// remotePath on host be skipped
+func (s *SftpSender) skipUnchanged(host, localPath, remotePath string, info os.FileInfo) bool {
+	if s.uploadCache == nil {
+		return false
+	}
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return false
+	}
+	return s.uploadCache.unchanged(uploadCacheKey(cred.IP, remotePath), localPath, info)
+}
+
+// saveUploadCache writes the --if-changed cache after an upload
+func (s *SftpSender) saveUploadCache() {
+	if s.uploadCache == nil {
+		return
+	}
+	if err := s.uploadCache.save(); err != nil {
+		logWarnf("failed to save upload cache: %v\n", err)
+	}
+}
+
+// rememberUpload adds a completed upload to the --if-changed cache
+func (s *SftpSender) rememberUpload(host, localPath, remotePath, checksum string) {
+	if s.uploadCache == nil || checksum == "" {
+		return
+	}
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return
+	}
+	if info, err := os.Stat(localPath); err == nil {
+		s.uploadCache.put(uploadCacheKey(cred.IP, remotePath), info, checksum)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultSecrets caches the secrets read from Vault by path, so several fields
+// of one secret cost a single request
+var vaultSecrets struct {
+	mu   sync.Mutex
+	data map[string]map[string]interface{}
+}
+
+// vaultResolve reads a "vault:<path>#<field>" password from HashiCorp Vault.
+// The server and token come from VAULT_ADDR and VAULT_TOKEN (or ~/.vault-token),
+// like the vault CLI; the field defaults to "password".
+func vaultResolve(ref string) (string, error) {
+	path, field, _ := strings.Cut(ref, "#")
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "", fmt.Errorf("vault references must look like vault:<path>#<field>")
+	}
+	if field == "" {
+		field = "password"
+	}
+
+	data, err := vaultRead(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %q", path, field)
+	}
+	password, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q of vault secret %s is not a string", field, path)
+	}
+	return password, nil
+}
+
+// vaultRead returns the fields of the secret at path, unwrapping the data of
+// KV version 2 engines
+func vaultRead(path string) (map[string]interface{}, error) {
+	vaultSecrets.mu.Lock()
+	defer vaultSecrets.mu.Unlock()
+	if data, ok := vaultSecrets.data[path]; ok {
+		return data, nil
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		data, err := os.ReadFile(expandHomeDir("~/.vault-token"))
+		if err != nil {
+			return nil, fmt.Errorf("set VAULT_TOKEN or log in with vault login")
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault secret %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("failed to decode vault secret %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(body.Errors) > 0 {
+			return nil, fmt.Errorf("failed to read vault secret %s: HTTP %d: %s", path, resp.StatusCode, strings.Join(body.Errors, "; "))
+		}
+		return nil, fmt.Errorf("failed to read vault secret %s: HTTP %d", path, resp.StatusCode)
+	}
+
+	data := body.Data
+	// KV v2 nests the fields under data.data, next to data.metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	if vaultSecrets.data == nil {
+		vaultSecrets.data = make(map[string]map[string]interface{})
+	}
+	vaultSecrets.data[path] = data
+	return data, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// verifyFleet checks the SHA-256 of the broadcast file on every host that
+// received it and returns an error for each host whose copy differs or cannot be read
+func (s *SftpSender) verifyFleet(localPath string, targets []broadcastTarget, results map[string]error) map[string]error {
+	mismatches := make(map[string]error)
+
+	expected, err := hashFile(localPath)
+	if err != nil {
+		logWarnf("Skipping checksum verification: %v\n", err)
+		return mismatches
+	}
+	var received []broadcastTarget
+	for _, t := range targets {
+		if results[t.host] == nil {
+			received = append(received, t)
+		}
+	}
+	logInfof("\nVerifying SHA-256 %s on %d hosts...\n", expected, len(received))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, t := range received {
+		wg.Add(1)
+		go func(t broadcastTarget) {
+			defer wg.Done()
+			location := t.location
+			if location == "" {
+				location = s.config.DefaultRemoteLocation
+			}
+			remotePath := fmt.Sprintf("%s/%s", strings.TrimSuffix(location, "/"), s.remoteName(localPath))
+
+			actual, err := s.remoteChecksum(t.host, remotePath)
+			if err == nil && actual != expected {
+				err = fmt.Errorf("checksum mismatch: %s has SHA-256 %s", remotePath, actual)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				mismatches[t.host] = err
+				s.hostLog(t.host).Errorf("✗ %s: %v\n", t.host, err)
+			} else {
+				s.hostLog(t.host).Infof("✓ %s: checksum OK\n", t.host)
+			}
+		}(t)
+	}
+	wg.Wait()
+	return mismatches
+}
+
+// remoteChecksum returns the SHA-256 of a remote file, computed on the host with
+// sha256sum (or shasum) when available and by reading it over SFTP otherwise
+func (s *SftpSender) remoteChecksum(host, remotePath string) (string, error) {
+	cred, err := s.findCredential(host)
+	if err != nil {
+		return "", err
+	}
+	client, err := s.getSSHClient(cred)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	if sum, err := execChecksum(client, remotePath); err == nil {
+		return sum, nil
+	}
+
+	sftpClient, err := s.getSFTPClient(client, linkTuning{maxConcurrent: s.maxConcurrent, maxPacket: s.maxPacket})
+	if err != nil {
+		return "", err
+	}
+	defer sftpClient.Close()
+	return sftpChecksum(sftpClient, remotePath)
+}
+
+// sftpChecksum returns the SHA-256 of a remote file by reading it over SFTP
+func sftpChecksum(sftpClient *sftp.Client, remotePath string) (string, error) {
+	f, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := f.WriteTo(hash); err != nil {
+		return "", fmt.Errorf("failed to read remote file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func execChecksum(client *ssh.Client, remotePath string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+	session.Stdout = &out
+	session.Stderr = io.Discard
+	quoted := shellQuote(remotePath)
+	if err := session.Run("sha256sum " + quoted + " 2>/dev/null || shasum -a 256 " + quoted); err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("unexpected checksum output %q", out.String())
+	}
+	return fields[0], nil
+}
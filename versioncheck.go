@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rix4uni/sftpsender/banner"
+)
+
+const versionCheckInterval = 24 * time.Hour
+
+var defaultVersionCachePath = stateFile("version_check.json")
+
+// versionCache remembers the latest release seen by the opt-in version check
+type versionCache struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Latest    string    `json:"latest"`
+}
+
+// versionHint prints a one-line hint when the cached latest release is newer
+// than this build, and refreshes the cache in the background at most once a
+// day. The hint never waits for the network: a refresh only shows on the next run.
+func versionHint() {
+	cachePath := expandHomeDir(defaultVersionCachePath)
+	var cache versionCache
+	if data, err := os.ReadFile(cachePath); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+
+	if cache.Latest != "" && compareVersions(cache.Latest, banner.Version()) > 0 {
+		logInfof("sftpsender %s is available (current %s), run \"sftpsender update\" to upgrade\n\n", cache.Latest, banner.Version())
+	}
+
+	if time.Since(cache.CheckedAt) < versionCheckInterval {
+		return
+	}
+	go func() {
+		release, err := fetchLatestRelease(10 * time.Second)
+		if err != nil {
+			return
+		}
+		data, err := json.Marshal(versionCache{CheckedAt: time.Now(), Latest: release.TagName})
+		if err != nil {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+			os.WriteFile(cachePath, data, 0644)
+		}
+	}()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// rotateVersions keeps the copy of remotePath that is about to be overwritten
+// as remotePath.1, shifting older copies up to remotePath.<keepVersions> and
+// deleting the oldest. Renames run newest-last so no target exists yet, which
+// plain SFTP renames require.
+func (s *SftpSender) rotateVersions(c *sftp.Client, remotePath string) error {
+	if s.keepVersions <= 0 {
+		return nil
+	}
+	if _, err := c.Stat(remotePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat remote file: %w", err)
+	}
+
+	version := func(n int) string { return fmt.Sprintf("%s.%d", remotePath, n) }
+	if err := c.Remove(version(s.keepVersions)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove oldest version: %w", err)
+	}
+	for n := s.keepVersions - 1; n >= 1; n-- {
+		if err := c.Rename(version(n), version(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate %s: %w", version(n), err)
+		}
+	}
+	if err := c.Rename(remotePath, version(1)); err != nil {
+		return fmt.Errorf("failed to keep previous version: %w", err)
+	}
+	return nil
+}
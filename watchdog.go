@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transferWatch aborts the transfers of one host when no bytes move on any of
+// its connections for stallTimeout, or when they run longer than maxTime
+type transferWatch struct {
+	mu    sync.Mutex
+	conns []net.Conn
+	last  atomic.Int64 // unix nanoseconds of the last read or write
+}
+
+// activityConn records the time of every read and write on a connection
+type activityConn struct {
+	net.Conn
+	last *atomic.Int64
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watchFor returns the watch of a host, nil if neither limit is set
+func (s *SftpSender) watchFor(cred *Credential) *transferWatch {
+	if s.stallTimeout <= 0 && s.maxTime <= 0 {
+		return nil
+	}
+	w, _ := s.watches.LoadOrStore(cred, &transferWatch{})
+	return w.(*transferWatch)
+}
+
+// track adds a new connection of the host to its watch
+func (w *transferWatch) track(conn net.Conn) net.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conns = append(w.conns, conn)
+	return &activityConn{Conn: conn, last: &w.last}
+}
+
+// watchTransfer starts enforcing --stall-timeout and --max-time on the host's
+// connections. The returned function stops the watch and reports an
+// ErrTransferTimeout error if the limits cut the transfer short.
+func (s *SftpSender) watchTransfer(cred *Credential) func() error {
+	w := s.watchFor(cred)
+	if w == nil {
+		return func() error { return nil }
+	}
+	start := time.Now()
+	w.last.Store(start.UnixNano())
+
+	var fired error
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				idle := now.Sub(time.Unix(0, w.last.Load()))
+				switch {
+				case s.stallTimeout > 0 && idle >= s.stallTimeout:
+					fired = fmt.Errorf("%w: no data moved for %s", ErrTransferTimeout, s.stallTimeout)
+				case s.maxTime > 0 && now.Sub(start) >= s.maxTime:
+					fired = fmt.Errorf("%w: exceeded --max-time %s", ErrTransferTimeout, s.maxTime)
+				default:
+					continue
+				}
+				// Closing the connections makes every pending operation fail
+				w.mu.Lock()
+				for _, c := range w.conns {
+					c.Close()
+				}
+				w.mu.Unlock()
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		close(done)
+		<-stopped
+		w.mu.Lock()
+		w.conns = nil
+		w.mu.Unlock()
+		return fired
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP has no standard way to read or write extended attributes, so --xattrs
+// copies them after the transfer with getfattr and setfattr (the attr package)
+// on the remote host, exchanging getfattr's --dump format. The rsync backend
+// copies them itself with -X -A.
+
+// xattr is one extended attribute of a file
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// copiedXattr reports whether --xattrs copies an attribute: user attributes
+// and POSIX ACLs. security.* (such as SELinux labels) and trusted.* belong to
+// one machine or need root and are left alone.
+func copiedXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") || name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
+// xattrToolMissing warns once per host when the attr tools are not installed
+func (s *SftpSender) xattrToolMissing(client *ssh.Client, host, tool string) bool {
+	if !xattrSupported {
+		s.warnOnce("xattrs local", "--xattrs is not supported on %s, extended attributes are not copied\n", runtime.GOOS)
+		return true
+	}
+	if remoteRun(client, "command -v "+tool+" >/dev/null") != nil {
+		s.warnOnce("xattrs "+host, "%s is not installed on %s (attr package), extended attributes are not copied\n", tool, host)
+		return true
+	}
+	return false
+}
+
+// uploadXattrs sets the extended attributes of the files below localPath on
+// their copies below remotePath
+func (s *SftpSender) uploadXattrs(client *ssh.Client, host, localPath, remotePath string) error {
+	if s.xattrToolMissing(client, host, "setfattr") {
+		return nil
+	}
+	var dump bytes.Buffer
+	count := 0
+	err := filepath.WalkDir(localPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		if s.filter.excludes(filepath.ToSlash(rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		attrs, err := listXattrs(p)
+		if err != nil {
+			return fmt.Errorf("failed to read extended attributes of %s: %w", p, err)
+		}
+		var copied []xattr
+		for _, a := range attrs {
+			if copiedXattr(a.name) {
+				copied = append(copied, a)
+			}
+		}
+		if len(copied) == 0 {
+			return nil
+		}
+		writeXattrDump(&dump, path.Join(remotePath, filepath.ToSlash(rel)), copied)
+		count += len(copied)
+		return nil
+	})
+	if err != nil || count == 0 {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+	var stderr bytes.Buffer
+	session.Stdin = &dump
+	session.Stderr = &stderr
+	if err := session.Run("setfattr --restore=-"); err != nil {
+		return fmt.Errorf("failed to set extended attributes on %s: %v: %s", host, err, strings.TrimSpace(stderr.String()))
+	}
+	s.hostLog(host).Infof("Copied %d extended attributes to %s\n", count, host)
+	return nil
+}
+
+// downloadXattrs sets the extended attributes of the files below remotePath
+// on their copies below localPath
+func (s *SftpSender) downloadXattrs(client *ssh.Client, host, remotePath, localPath string) error {
+	if s.xattrToolMissing(client, host, "getfattr") {
+		return nil
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	// getfattr fails when it cannot read some files but still dumps the others
+	runErr := session.Run("getfattr -R -P -h -d -m - -e base64 --absolute-names -- " + shellQuote(remotePath))
+	if runErr != nil && stdout.Len() == 0 && stderr.Len() > 0 {
+		return fmt.Errorf("failed to read extended attributes on %s: %v: %s", host, runErr, strings.TrimSpace(stderr.String()))
+	}
+
+	files, err := parseXattrDump(&stdout)
+	if err != nil {
+		return fmt.Errorf("failed to parse extended attributes of %s: %w", host, err)
+	}
+	count, failed := 0, 0
+	var firstErr error
+	root := strings.TrimSuffix(remotePath, "/")
+	for file, attrs := range files {
+		rel, ok := strings.CutPrefix(file, root)
+		if !ok || (rel != "" && !strings.HasPrefix(rel, "/")) {
+			continue
+		}
+		target := localPath + filepath.FromSlash(rel)
+		if len(s.filter) > 0 {
+			// Entries the filter left out were not downloaded
+			info, err := os.Lstat(target)
+			if err != nil || s.filter.excludes(strings.TrimPrefix(rel, "/"), info.IsDir()) {
+				continue
+			}
+		}
+		for _, a := range attrs {
+			if !copiedXattr(a.name) {
+				continue
+			}
+			if err := setXattr(target, a.name, a.value); err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s on %s: %w", a.name, target, err)
+				}
+				continue
+			}
+			count++
+		}
+	}
+	if failed > 0 {
+		s.hostLog(host).Warnf("Could not set %d extended attributes from %s, first: %v\n", failed, host, firstErr)
+	}
+	if count > 0 {
+		s.hostLog(host).Infof("Copied %d extended attributes from %s\n", count, host)
+	}
+	return nil
+}
+
+// writeXattrDump appends the attributes of file in getfattr --dump format
+func writeXattrDump(w io.Writer, file string, attrs []xattr) {
+	fmt.Fprintf(w, "# file: %s\n", quoteXattr(file, "\n\r"))
+	for _, a := range attrs {
+		if len(a.value) == 0 {
+			fmt.Fprintf(w, "%s=\"\"\n", quoteXattr(a.name, "=\n\r"))
+			continue
+		}
+		fmt.Fprintf(w, "%s=0s%s\n", quoteXattr(a.name, "=\n\r"), base64.StdEncoding.EncodeToString(a.value))
+	}
+	fmt.Fprintln(w)
+}
+
+// parseXattrDump reads getfattr --dump output into the attributes of each file
+func parseXattrDump(r io.Reader) (map[string][]xattr, error) {
+	files := make(map[string][]xattr)
+	var file string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "# file: "); ok {
+			file = unquoteXattr(name)
+			continue
+		}
+		if line == "" || file == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			files[file] = append(files[file], xattr{name: unquoteXattr(line)})
+			continue
+		}
+		decoded, err := decodeXattrValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s: %w", name, file, err)
+		}
+		files[file] = append(files[file], xattr{name: unquoteXattr(name), value: decoded})
+	}
+	return files, scanner.Err()
+}
+
+// decodeXattrValue decodes the base64 (0s), hex (0x) and quoted text
+// encodings of getfattr values
+func decodeXattrValue(v string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(v, "0s"):
+		return base64.StdEncoding.DecodeString(v[2:])
+	case strings.HasPrefix(v, "0x"):
+		return hex.DecodeString(v[2:])
+	case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+		return []byte(unquoteXattr(v[1 : len(v)-1])), nil
+	}
+	return []byte(v), nil
+}
+
+// quoteXattr escapes like getfattr: backslashes, unprintable bytes and the
+// given special characters become \ooo octal escapes
+func quoteXattr(s, special string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x7f || c == '\\' || strings.IndexByte(special, c) >= 0 {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unquoteXattr reverses quoteXattr
+func unquoteXattr(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+const xattrSupported = false
+
+func listXattrs(path string) ([]xattr, error) {
+	return nil, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}